@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"github.com/ksco/rvld/pkg/utils"
+	"path/filepath"
 	"unsafe"
 )
 
@@ -18,9 +19,7 @@ func ReadFatArchiveMembers(file *File) []*File {
 			data++
 		}
 
-		hdr := &ArHdr{}
-		err := binary.Read(bytes.NewBuffer(file.Contents[data:]), binary.LittleEndian, hdr)
-		utils.MustNo(err)
+		hdr := utils.Read[ArHdr](file.Contents[data:])
 		body := data + int(unsafe.Sizeof(ArHdr{}))
 		data = body + hdr.GetSize()
 
@@ -50,10 +49,159 @@ func ReadFatArchiveMembers(file *File) []*File {
 	return files
 }
 
+// ReadThinArchiveMembers reads the members of a thin archive. A thin
+// archive only contains the headers of its members, whose contents are
+// in separate files relative to the archive's directory.
+func ReadThinArchiveMembers(file *File) []*File {
+	data := 8
+	var strTab []byte
+	var files []*File
+
+	for len(file.Contents)-data >= 2 {
+		if data%2 == 1 {
+			data++
+		}
+
+		hdr := utils.Read[ArHdr](file.Contents[data:])
+		body := data + int(unsafe.Sizeof(ArHdr{}))
+
+		if hdr.IsStrtab() {
+			data = body + hdr.GetSize()
+			strTab = file.Contents[body:data]
+			continue
+		}
+
+		if hdr.IsSymtab() {
+			data = body + hdr.GetSize()
+			continue
+		}
+
+		if !hdr.StartsWith("/") {
+			utils.Fatal(file.Name + ": filename is not stored as a long filename")
+		}
+
+		ptr := file.Contents[body:]
+		name := hdr.ReadName(strTab, &ptr)
+
+		path := name
+		if !filepath.IsAbs(name) {
+			path = filepath.Join(filepath.Dir(file.Name), name)
+		}
+
+		child := MustNewFile(path)
+		child.Parent = file
+		files = append(files, child)
+		data = body
+	}
+
+	return files
+}
+
+// ReadArchiveIndex reads the symbol index of a GNU archive, which maps
+// each symbol name defined by the archive to the header offset of the
+// member defining it. It returns false if the archive has no index.
+func ReadArchiveIndex(file *File) (map[int][]string, []byte, bool) {
+	data := 8
+	var index map[int][]string
+	var strTab []byte
+
+	// The index and the long filename table precede the members.
+	for i := 0; i < 2 && len(file.Contents)-data >= int(unsafe.Sizeof(ArHdr{})); i++ {
+		if data%2 == 1 {
+			data++
+		}
+
+		hdr := utils.Read[ArHdr](file.Contents[data:])
+		body := data + int(unsafe.Sizeof(ArHdr{}))
+		data = body + hdr.GetSize()
+		if hdr.GetSize() < 0 || data > len(file.Contents) {
+			utils.Fatal(file.Name + ": archive member is out of range")
+		}
+
+		switch {
+		case hdr.IsStrtab():
+			strTab = file.Contents[body:data]
+		case hdr.StartsWith("/ "):
+			index = readArchiveSymtab(file, file.Contents[body:data], 4)
+		case hdr.StartsWith("/SYM64/ "):
+			index = readArchiveSymtab(file, file.Contents[body:data], 8)
+		}
+	}
+
+	return index, strTab, index != nil
+}
+
+func readArchiveSymtab(file *File, data []byte, wordSize int) map[int][]string {
+	readWord := func(b []byte) int {
+		if wordSize == 4 {
+			return int(binary.BigEndian.Uint32(b))
+		}
+		return int(binary.BigEndian.Uint64(b))
+	}
+
+	// The table is a member count, followed by as many member offsets
+	// and then as many NUL-terminated names.
+	if len(data) < wordSize {
+		utils.Fatal(file.Name + ": corrupted archive symbol table")
+	}
+	num := readWord(data)
+	if num < 0 || num > len(data)/wordSize-1 {
+		utils.Fatal(file.Name + ": corrupted archive symbol table")
+	}
+
+	offsets := data[wordSize:]
+	names := data[wordSize*(num+1):]
+
+	index := make(map[int][]string)
+	for i := 0; i < num; i++ {
+		end := bytes.IndexByte(names, 0)
+		if end == -1 {
+			utils.Fatal(file.Name + ": corrupted archive symbol table")
+		}
+
+		offset := readWord(offsets[wordSize*i:])
+		if offset < 8 || offset > len(file.Contents)-int(unsafe.Sizeof(ArHdr{})) {
+			utils.Fatal(file.Name + ": corrupted archive symbol table")
+		}
+		index[offset] = append(index[offset], string(names[:end]))
+		names = names[end+1:]
+	}
+	return index
+}
+
+// ReadArchiveMember reads the member of an archive whose header is at
+// the given offset.
+func ReadArchiveMember(file *File, strTab []byte, offset int) *File {
+	hdr := utils.Read[ArHdr](file.Contents[offset:])
+	body := offset + int(unsafe.Sizeof(ArHdr{}))
+
+	ptr := file.Contents[body:]
+	name := hdr.ReadName(strTab, &ptr)
+
+	if GetFileType(file.Contents) == FileTypeThinAr {
+		path := name
+		if !filepath.IsAbs(name) {
+			path = filepath.Join(filepath.Dir(file.Name), name)
+		}
+
+		child := MustNewFile(path)
+		child.Parent = file
+		return child
+	}
+
+	return &File{
+		Name:     name,
+		Contents: file.Contents[body : body+hdr.GetSize()],
+		Parent:   file,
+	}
+}
+
 func ReadArchiveMembers(file *File) []*File {
 	switch GetFileType(file.Contents) {
 	case FileTypeAr:
 		return ReadFatArchiveMembers(file)
+	case FileTypeThinAr:
+		return ReadThinArchiveMembers(file)
 	default:
 		utils.Fatal("unreachable")
 	}
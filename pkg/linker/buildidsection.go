@@ -0,0 +1,101 @@
+package linker
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"debug/elf"
+	"github.com/ksco/rvld/pkg/utils"
+)
+
+// Values of --build-id.
+const (
+	BuildIdNone = iota
+	BuildIdHex
+	BuildIdMd5
+	BuildIdSha1
+	BuildIdUuid
+)
+
+type BuildId struct {
+	Kind  int
+	Value []byte
+}
+
+func (b *BuildId) Size() int {
+	switch b.Kind {
+	case BuildIdHex:
+		return len(b.Value)
+	case BuildIdMd5, BuildIdUuid:
+		return 16
+	case BuildIdSha1:
+		return 20
+	}
+	utils.Fatal("unreachable")
+	return 0
+}
+
+// BuildIdSection is the .note.gnu.build-id note, which identifies the
+// output. Its description is filled in by WriteBuildId once the rest of
+// the file has been written, as it may be a hash of the file contents.
+type BuildIdSection struct {
+	Chunk
+}
+
+// The note header is followed by the "GNU\0" name.
+const buildIdHeaderSize = 16
+
+func NewBuildIdSection() *BuildIdSection {
+	b := &BuildIdSection{Chunk: NewChunk()}
+	b.Name = ".note.gnu.build-id"
+	b.Shdr.Type = uint32(elf.SHT_NOTE)
+	b.Shdr.Flags = uint64(elf.SHF_ALLOC)
+	b.Shdr.AddrAlign = 4
+	return b
+}
+
+func (b *BuildIdSection) UpdateShdr(ctx *Context) {
+	b.Shdr.Size = buildIdHeaderSize + utils.AlignTo(uint64(ctx.Arg.BuildId.Size()), 4)
+}
+
+func (b *BuildIdSection) CopyBuf(ctx *Context) {
+	buf := ctx.Buf[b.Shdr.Offset:]
+	utils.Write[uint32](buf, 4)
+	utils.Write[uint32](buf[4:], uint32(ctx.Arg.BuildId.Size()))
+	utils.Write[uint32](buf[8:], NT_GNU_BUILD_ID)
+	copy(buf[12:], "GNU\x00")
+
+	// The description is hashed along with the rest of the file, so it
+	// must be zero until WriteBuildId fills it in.
+	desc := buf[buildIdHeaderSize:b.Shdr.Size]
+	for i := range desc {
+		desc[i] = 0
+	}
+}
+
+// WriteBuildId fills in the build ID. It must be called after all chunks
+// have been copied to ctx.Buf.
+func (b *BuildIdSection) WriteBuildId(ctx *Context) {
+	desc := ctx.Buf[b.Shdr.Offset+buildIdHeaderSize:][:ctx.Arg.BuildId.Size()]
+
+	switch ctx.Arg.BuildId.Kind {
+	case BuildIdHex:
+		copy(desc, ctx.Arg.BuildId.Value)
+	case BuildIdMd5:
+		sum := md5.Sum(ctx.Buf)
+		copy(desc, sum[:])
+	case BuildIdSha1:
+		sum := sha1.Sum(ctx.Buf)
+		copy(desc, sum[:])
+	case BuildIdUuid:
+		_, err := rand.Read(desc)
+		utils.MustNo(err)
+
+		// Mark it as a version 4 (random) UUID, as described in
+		// RFC 4122.
+		desc[6] = desc[6]&0x0f | 0x40
+		desc[8] = desc[8]&0x3f | 0x80
+	default:
+		utils.Fatal("unreachable")
+	}
+}
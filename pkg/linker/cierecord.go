@@ -0,0 +1,52 @@
+package linker
+
+import (
+	"bytes"
+	"github.com/ksco/rvld/pkg/utils"
+)
+
+type CieRecord struct {
+	File         *ObjectFile
+	InputSection *InputSection
+	InputOffset  uint32
+	OutputOffset uint32
+	RelBegin     uint32
+	RelEnd       uint32
+	IsLeader     bool
+}
+
+func (c *CieRecord) Size() uint32 {
+	return utils.Read[uint32](c.InputSection.Contents[c.InputOffset:]) + 4
+}
+
+func (c *CieRecord) GetContents() []byte {
+	return c.InputSection.Contents[c.InputOffset : c.InputOffset+c.Size()]
+}
+
+func (c *CieRecord) GetRels() []Rela {
+	return c.InputSection.GetRels()[c.RelBegin:c.RelEnd]
+}
+
+// Equals reports whether two CIEs would be identical in the output, which
+// requires the same contents and relocations against the same symbols.
+func (c *CieRecord) Equals(other *CieRecord) bool {
+	if !bytes.Equal(c.GetContents(), other.GetContents()) {
+		return false
+	}
+
+	x := c.GetRels()
+	y := other.GetRels()
+	if len(x) != len(y) {
+		return false
+	}
+
+	for i := 0; i < len(x); i++ {
+		if x[i].Offset-uint64(c.InputOffset) != y[i].Offset-uint64(other.InputOffset) ||
+			x[i].Type != y[i].Type ||
+			c.File.Symbols[x[i].Sym] != other.File.Symbols[y[i].Sym] ||
+			x[i].Addend != y[i].Addend {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,30 @@
+package linker
+
+import "math"
+
+// ComdatGroup is shared by every section group with the same signature.
+// Only the group of the file with the smallest priority is kept.
+type ComdatGroup struct {
+	Owner uint32
+}
+
+type ComdatGroupRef struct {
+	Group   *ComdatGroup
+	Members []uint32
+
+	// SymIdx is the symbol whose name is the group signature.
+	SymIdx uint32
+}
+
+func GetComdatGroupInstance(ctx *Context, signature string) *ComdatGroup {
+	ctx.comdatGroupsMu.Lock()
+	defer ctx.comdatGroupsMu.Unlock()
+
+	if g, ok := ctx.ComdatGroups[signature]; ok {
+		return g
+	}
+
+	g := &ComdatGroup{Owner: math.MaxUint32}
+	ctx.ComdatGroups[signature] = g
+	return g
+}
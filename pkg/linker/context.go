@@ -1,18 +1,60 @@
 package linker
 
-import "github.com/ksco/rvld/pkg/utils"
+import (
+	"github.com/ksco/rvld/pkg/utils"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
 
 type ContextArg struct {
-	Output    string
-	Emulation MachineType
+	Output          string
+	Entry           string
+	Emulation       MachineType
+	StripAll        bool
+	DiscardAll      bool
+	DiscardLocals   bool
+	GcSections      bool
+	EhFrameHdr      bool
+	Relax           bool
+	PrintGcSections bool
+	WarnBackrefs    bool
+	ZDefs           bool
+	MulDefs         bool
+	Relocatable     bool
+	PrintMap        bool
+	Threads         int
+	IsStatic        bool
+	Pie             bool
+	Pic             bool
+	Shared          bool
+	Soname          string
+	DynamicLinker   string
+	Sysroot         string
+	Map             string
+	ImageBase       uint64
+	BuildId         BuildId
+
+	AllowShlibUndefined bool
+	UnresolvedSymbols   int
 
 	LibraryPaths []string
+	Defsyms      []Defsym
+	Scripts      []string
 }
 
 type Context struct {
 	Arg ContextArg
 
-	SymbolMap map[string]*Symbol
+	SymbolMap    map[string]*Symbol
+	ComdatGroups map[string]*ComdatGroup
+
+	// These protect the maps and lists of shared instances, which
+	// objects parsed in parallel look up and create.
+	symbolMapMu      sync.Mutex
+	comdatGroupsMu   sync.Mutex
+	outputSectionsMu sync.Mutex
+	mergedSectionsMu sync.Mutex
 
 	SymbolsAux []SymbolAux
 
@@ -21,12 +63,38 @@ type Context struct {
 	Phdr *OutputPhdr
 	Got  *GotSection
 
+	Interp  *InterpSection
+	Dynamic *DynamicSection
+	Dynsym  *DynsymSection
+	Dynstr  *DynstrSection
+	Hash    *HashSection
+	RelaDyn *RelaDynSection
+	RelaPlt *RelaPltSection
+	Plt     *PltSection
+	GotPlt  *GotPltSection
+	Copyrel *CopyrelSection
+
+	EhFrame    *EhFrameSection
+	EhFrameHdr *EhFrameHdrSection
+	BuildId    *BuildIdSection
+
+	Symtab   *SymtabSection
+	Strtab   *StrtabSection
+	Shstrtab *ShstrtabSection
+
 	Buf []byte
 
 	FilePriority int64
 	Visited      utils.MapSet[string]
+	IsStatic     bool
+	WholeArchive bool
+	FileGroup    int64
+	NumGroups    int64
 
 	Objs []*ObjectFile
+	Dsos []*SharedFile
+
+	Script *LinkerScript
 
 	InternalObj   *ObjectFile
 	InternalEsyms []Sym
@@ -40,6 +108,8 @@ type Context struct {
 
 	TpAddr uint64
 
+	HasTextrel atomic.Bool
+
 	__InitArrayStart    *Symbol
 	__InitArrayEnd      *Symbol
 	__FiniArrayStart    *Symbol
@@ -47,6 +117,9 @@ type Context struct {
 	__PreinitArrayStart *Symbol
 	__PreinitArrayEnd   *Symbol
 	__GlobalPointer     *Symbol
+	_Dynamic            *Symbol
+
+	Defsyms []*Symbol
 }
 
 func NewContext() *Context {
@@ -54,8 +127,12 @@ func NewContext() *Context {
 		Arg: ContextArg{
 			Emulation: MachineTypeNone,
 			Output:    "a.out",
+			Relax:     true,
+			ImageBase: ImageBase,
+			Threads:   runtime.NumCPU(),
 		},
 		SymbolMap:      make(map[string]*Symbol),
+		ComdatGroups:   make(map[string]*ComdatGroup),
 		Visited:        utils.NewMapSet[string](),
 		FilePriority:   10000,
 		DefaultVersion: VER_NDX_LOCAL,
@@ -0,0 +1,65 @@
+package linker
+
+import (
+	"debug/elf"
+	"github.com/ksco/rvld/pkg/utils"
+	"unsafe"
+)
+
+type CopyrelSection struct {
+	Chunk
+	Symbols []*Symbol
+}
+
+func NewCopyrelSection() *CopyrelSection {
+	c := &CopyrelSection{Chunk: NewChunk()}
+	c.Name = ".copyrel"
+	c.Shdr.Type = uint32(elf.SHT_NOBITS)
+	c.Shdr.Flags = uint64(elf.SHF_ALLOC | elf.SHF_WRITE)
+	return c
+}
+
+func (c *CopyrelSection) AddSymbol(ctx *Context, sym *Symbol) {
+	if sym.HasCopyrel {
+		return
+	}
+
+	file := GetSharedFile(ctx, sym.File)
+	utils.Assert(file != nil && sym.IsImported)
+
+	aliases := file.FindAliases(sym)
+	alignment := file.GetAlignment(sym)
+
+	c.Shdr.Size = utils.AlignTo(c.Shdr.Size, alignment)
+	if c.Shdr.AddrAlign < alignment {
+		c.Shdr.AddrAlign = alignment
+	}
+
+	sym.HasCopyrel = true
+	sym.IsExported = true
+	sym.Value = c.Shdr.Size
+	c.Shdr.Size += sym.ElfSym().Size
+	c.Symbols = append(c.Symbols, sym)
+	ctx.Dynsym.AddSymbol(ctx, sym)
+
+	// Aliases of the symbol must resolve to the same copy at runtime.
+	for _, alias := range aliases {
+		addSymbolAux(ctx, alias)
+		alias.IsImported = true
+		alias.IsExported = true
+		alias.HasCopyrel = true
+		alias.Value = sym.Value
+		ctx.Dynsym.AddSymbol(ctx, alias)
+	}
+}
+
+func (c *CopyrelSection) CopyBuf(ctx *Context) {
+	base := ctx.Buf[ctx.RelaDyn.Shdr.Offset+ctx.Got.GetRelaDynSize(ctx):]
+	for i, sym := range c.Symbols {
+		utils.Write[Rela](base[i*int(unsafe.Sizeof(Rela{})):], Rela{
+			Offset: sym.GetAddr(ctx),
+			Type:   uint32(elf.R_RISCV_COPY),
+			Sym:    uint32(sym.GetDynsymIdx(ctx)),
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package linker
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"fmt"
+	"github.com/ksco/rvld/pkg/utils"
+	"path/filepath"
+	"sort"
+)
+
+// LineTable maps locations in the sections of an object file to source
+// lines, as recorded in its .debug_line section.
+//
+// The line program of a relocatable object refers to section addresses
+// through relocations. To tell the sections apart, each allocated
+// section is given a distinct base address when the relocations are
+// applied, and rows are looked up by base address plus offset.
+type LineTable struct {
+	Bases []uint64
+	Rows  []LineRow
+}
+
+type LineRow struct {
+	Addr        uint64
+	File        string
+	Line        int
+	EndSequence bool
+}
+
+// ReadLineTable parses the line programs of o. It returns an empty table
+// if o has no usable debug info.
+func ReadLineTable(o *ObjectFile) *LineTable {
+	t := &LineTable{Bases: make([]uint64, len(o.ElfSections))}
+
+	addr := uint64(1 << 32)
+	for i := range o.ElfSections {
+		shdr := &o.ElfSections[i]
+		if shdr.Flags&uint64(elf.SHF_ALLOC) != 0 {
+			t.Bases[i] = addr
+			addr += utils.AlignTo(shdr.Size, 16) + 16
+		}
+	}
+
+	sections := make(map[string][]byte)
+	for i := range o.ElfSections {
+		shdr := &o.ElfSections[i]
+		name := getName(o.ShStrtab, shdr.Name)
+		switch name {
+		case ".debug_abbrev", ".debug_info", ".debug_line", ".debug_str",
+			".debug_line_str", ".debug_addr", ".debug_str_offsets":
+		default:
+			continue
+		}
+		if shdr.Flags&uint64(elf.SHF_COMPRESSED) != 0 {
+			return t
+		}
+
+		contents := make([]byte, shdr.Size)
+		copy(contents, o.GetBytesFromShdr(shdr))
+		t.applyRelocs(o, int64(i), contents)
+		sections[name] = contents
+	}
+
+	if sections[".debug_info"] == nil || sections[".debug_line"] == nil {
+		return t
+	}
+
+	d, err := dwarf.New(sections[".debug_abbrev"], nil, nil, sections[".debug_info"],
+		sections[".debug_line"], nil, nil, sections[".debug_str"])
+	if err != nil {
+		return t
+	}
+	for _, name := range []string{".debug_line_str", ".debug_addr", ".debug_str_offsets"} {
+		if contents, ok := sections[name]; ok {
+			if d.AddSection(name, contents) != nil {
+				return t
+			}
+		}
+	}
+
+	r := d.Reader()
+	for {
+		e, err := r.Next()
+		if e == nil || err != nil {
+			break
+		}
+		if e.Tag != dwarf.TagCompileUnit {
+			r.SkipChildren()
+			continue
+		}
+
+		lr, err := d.LineReader(e)
+		r.SkipChildren()
+		if lr == nil || err != nil {
+			continue
+		}
+
+		var entry dwarf.LineEntry
+		for lr.Next(&entry) == nil {
+			row := LineRow{Addr: entry.Address, Line: entry.Line,
+				EndSequence: entry.EndSequence}
+			if entry.File != nil {
+				row.File = entry.File.Name
+			}
+			t.Rows = append(t.Rows, row)
+		}
+	}
+
+	// A sequence may start where another ends, in which case the end
+	// must come first so that the start is found by Find.
+	sort.SliceStable(t.Rows, func(i, j int) bool {
+		a, b := &t.Rows[i], &t.Rows[j]
+		if a.Addr != b.Addr {
+			return a.Addr < b.Addr
+		}
+		return a.EndSequence && !b.EndSequence
+	})
+	return t
+}
+
+// applyRelocs applies the relocations for section shndx to its contents,
+// placing the allocated sections at their base addresses.
+func (t *LineTable) applyRelocs(o *ObjectFile, shndx int64, contents []byte) {
+	for i := range o.ElfSections {
+		shdr := &o.ElfSections[i]
+		if shdr.Type != uint32(elf.SHT_RELA) || int64(shdr.Info) != shndx {
+			continue
+		}
+
+		for _, rel := range utils.ReadSlice[Rela](o.GetBytesFromShdr(shdr)) {
+			if rel.Sym >= uint32(len(o.ElfSyms)) ||
+				rel.Offset >= uint64(len(contents)) {
+				continue
+			}
+
+			esym := &o.ElfSyms[rel.Sym]
+			S := esym.Val
+			if !esym.IsAbs() && !esym.IsUndef() && !esym.IsCommon() {
+				if idx := o.GetShndx(esym, int64(rel.Sym)); idx < int64(len(t.Bases)) {
+					S += t.Bases[idx]
+				}
+			}
+			A := uint64(rel.Addend)
+			loc := contents[rel.Offset:]
+
+			switch elf.R_RISCV(rel.Type) {
+			case elf.R_RISCV_32:
+				utils.Write[uint32](loc, uint32(S+A))
+			case elf.R_RISCV_64:
+				utils.Write[uint64](loc, S+A)
+			case elf.R_RISCV_ADD8:
+				loc[0] += uint8(S + A)
+			case elf.R_RISCV_ADD16:
+				utils.Write[uint16](loc, utils.Read[uint16](loc)+uint16(S+A))
+			case elf.R_RISCV_ADD32:
+				utils.Write[uint32](loc, utils.Read[uint32](loc)+uint32(S+A))
+			case elf.R_RISCV_ADD64:
+				utils.Write[uint64](loc, utils.Read[uint64](loc)+S+A)
+			case elf.R_RISCV_SUB8:
+				loc[0] -= uint8(S + A)
+			case elf.R_RISCV_SUB16:
+				utils.Write[uint16](loc, utils.Read[uint16](loc)-uint16(S+A))
+			case elf.R_RISCV_SUB32:
+				utils.Write[uint32](loc, utils.Read[uint32](loc)-uint32(S+A))
+			case elf.R_RISCV_SUB64:
+				utils.Write[uint64](loc, utils.Read[uint64](loc)-S-A)
+			case elf.R_RISCV_SET8:
+				loc[0] = uint8(S + A)
+			case elf.R_RISCV_SET16:
+				utils.Write[uint16](loc, uint16(S+A))
+			case elf.R_RISCV_SET32:
+				utils.Write[uint32](loc, uint32(S+A))
+			}
+		}
+	}
+}
+
+// Find returns the row describing the given offset in section shndx.
+func (t *LineTable) Find(shndx uint32, offset uint64) (LineRow, bool) {
+	if int(shndx) >= len(t.Bases) || t.Bases[shndx] == 0 {
+		return LineRow{}, false
+	}
+
+	addr := t.Bases[shndx] + offset
+	i := sort.Search(len(t.Rows), func(i int) bool {
+		return t.Rows[i].Addr > addr
+	})
+	if i == 0 || t.Rows[i-1].EndSequence {
+		return LineRow{}, false
+	}
+	return t.Rows[i-1], true
+}
+
+// GetSourceLine returns the source file and line of the given offset in
+// isec, e.g. "foo.c:12", or an empty string if it is unknown.
+func (o *ObjectFile) GetSourceLine(isec *InputSection, offset uint64) string {
+	if o.LineTable == nil {
+		o.LineTable = ReadLineTable(o)
+	}
+
+	row, ok := o.LineTable.Find(isec.Shndx, offset)
+	if !ok || row.File == "" || row.Line == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d", filepath.Base(row.File), row.Line)
+}
@@ -0,0 +1,44 @@
+package linker
+
+import (
+	"fmt"
+	"github.com/ksco/rvld/pkg/utils"
+	"strconv"
+)
+
+// Defsym is a symbol defined on the command line with --defsym. Its
+// value is either a number or the name of another symbol.
+type Defsym struct {
+	Name string
+	Expr string
+}
+
+// GetAddr returns the address the symbol is defined to, and whether the
+// expression is a plain number rather than a symbol reference.
+func (d *Defsym) GetAddr() (uint64, bool) {
+	val, err := strconv.ParseUint(d.Expr, 0, 64)
+	return val, err == nil
+}
+
+func isDefsym(ctx *Context, name string) bool {
+	for _, def := range ctx.Arg.Defsyms {
+		if def.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckDefsyms reports --defsym expressions that name undefined symbols.
+// It runs once before relaxation, as FixSyntheticSymbols runs once per
+// relaxation pass and skips those symbols.
+func CheckDefsyms(ctx *Context) {
+	for _, def := range ctx.Arg.Defsyms {
+		if _, ok := def.GetAddr(); ok {
+			continue
+		}
+		if target, ok := ctx.SymbolMap[def.Expr]; !ok || target.File == nil {
+			utils.Error(fmt.Sprintf("--defsym: undefined symbol: %s", def.Expr))
+		}
+	}
+}
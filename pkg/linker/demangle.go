@@ -0,0 +1,119 @@
+package linker
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Demangle decodes an Itanium C++ ABI mangled function name such as
+// _ZN2ns3fooEPKci into its qualified name "ns::foo" and its parameter
+// list "(char const*, int)". Only names with namespaces, classes and
+// builtin types are supported; ok is false for anything else.
+func Demangle(name string) (qualified string, params string, ok bool) {
+	d := &demangler{s: name}
+	if !d.consume("_Z") {
+		return "", "", false
+	}
+
+	qualified, ok = d.name()
+	if !ok {
+		return "", "", false
+	}
+
+	if d.s == "v" {
+		return qualified, "()", true
+	}
+
+	types := make([]string, 0)
+	for d.s != "" {
+		t, ok := d.typ()
+		if !ok {
+			return "", "", false
+		}
+		types = append(types, t)
+	}
+	return qualified, "(" + strings.Join(types, ", ") + ")", true
+}
+
+type demangler struct {
+	s string
+}
+
+func (d *demangler) consume(prefix string) bool {
+	if !strings.HasPrefix(d.s, prefix) {
+		return false
+	}
+	d.s = d.s[len(prefix):]
+	return true
+}
+
+// sourceName reads a <length><identifier> pair.
+func (d *demangler) sourceName() (string, bool) {
+	n := 0
+	for n < len(d.s) && '0' <= d.s[n] && d.s[n] <= '9' {
+		n++
+	}
+	length, err := strconv.Atoi(d.s[:n])
+	if n == 0 || err != nil || length == 0 || n+length > len(d.s) {
+		return "", false
+	}
+
+	id := d.s[n : n+length]
+	d.s = d.s[n+length:]
+	return id, true
+}
+
+// name reads a plain or a nested (N...E) name.
+func (d *demangler) name() (string, bool) {
+	if !d.consume("N") {
+		return d.sourceName()
+	}
+
+	// Qualifiers of member functions.
+	for d.consume("K") || d.consume("V") || d.consume("r") {
+	}
+
+	parts := make([]string, 0)
+	for !d.consume("E") {
+		part, ok := d.sourceName()
+		if !ok {
+			return "", false
+		}
+		parts = append(parts, part)
+	}
+	if len(parts) == 0 {
+		return "", false
+	}
+	return strings.Join(parts, "::"), true
+}
+
+var builtinTypes = map[byte]string{
+	'v': "void", 'w': "wchar_t", 'b': "bool", 'c': "char", 'a': "signed char",
+	'h': "unsigned char", 's': "short", 't': "unsigned short", 'i': "int",
+	'j': "unsigned int", 'l': "long", 'm': "unsigned long", 'x': "long long",
+	'y': "unsigned long long", 'n': "__int128", 'o': "unsigned __int128",
+	'f': "float", 'd': "double", 'e': "long double", 'z': "...",
+}
+
+var typeSuffixes = map[byte]string{
+	'P': "*", 'R': "&", 'O': "&&", 'K': " const", 'V': " volatile",
+}
+
+func (d *demangler) typ() (string, bool) {
+	if d.s == "" {
+		return "", false
+	}
+
+	switch c := d.s[0]; {
+	case typeSuffixes[c] != "":
+		d.s = d.s[1:]
+		t, ok := d.typ()
+		return t + typeSuffixes[c], ok
+	case c == 'N' || ('0' <= c && c <= '9'):
+		return d.name()
+	default:
+		t, ok := builtinTypes[c]
+		d.s = d.s[1:]
+		return t, ok
+	}
+}
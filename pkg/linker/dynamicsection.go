@@ -0,0 +1,103 @@
+package linker
+
+import (
+	"debug/elf"
+	"github.com/ksco/rvld/pkg/utils"
+	"unsafe"
+)
+
+type DynamicSection struct {
+	Chunk
+}
+
+func NewDynamicSection() *DynamicSection {
+	d := &DynamicSection{Chunk: NewChunk()}
+	d.Name = ".dynamic"
+	d.Shdr.Type = uint32(elf.SHT_DYNAMIC)
+	d.Shdr.Flags = uint64(elf.SHF_ALLOC | elf.SHF_WRITE)
+	d.Shdr.EntSize = uint64(unsafe.Sizeof(Dyn{}))
+	d.Shdr.AddrAlign = 8
+	return d
+}
+
+func createDynamicSection(ctx *Context) []Dyn {
+	vec := make([]Dyn, 0)
+	define := func(tag elf.DynTag, val uint64) {
+		vec = append(vec, Dyn{Tag: int64(tag), Val: val})
+	}
+
+	if ctx.Arg.Soname != "" {
+		define(elf.DT_SONAME, uint64(ctx.Dynstr.FindString(ctx.Arg.Soname)))
+	}
+
+	for _, file := range ctx.Dsos {
+		define(elf.DT_NEEDED, uint64(ctx.Dynstr.FindString(file.Soname)))
+	}
+
+	if ctx.RelaDyn.Shdr.Size > 0 {
+		define(elf.DT_RELA, ctx.RelaDyn.Shdr.Addr)
+		define(elf.DT_RELASZ, ctx.RelaDyn.Shdr.Size)
+		define(elf.DT_RELAENT, uint64(unsafe.Sizeof(Rela{})))
+	}
+
+	if ctx.RelaPlt.Shdr.Size > 0 {
+		define(elf.DT_JMPREL, ctx.RelaPlt.Shdr.Addr)
+		define(elf.DT_PLTRELSZ, ctx.RelaPlt.Shdr.Size)
+		define(elf.DT_PLTREL, uint64(elf.DT_RELA))
+	}
+
+	if ctx.GotPlt.Shdr.Size > 0 {
+		define(elf.DT_PLTGOT, ctx.GotPlt.Shdr.Addr)
+	}
+
+	define(elf.DT_SYMTAB, ctx.Dynsym.Shdr.Addr)
+	define(elf.DT_SYMENT, uint64(unsafe.Sizeof(Sym{})))
+	define(elf.DT_STRTAB, ctx.Dynstr.Shdr.Addr)
+	define(elf.DT_STRSZ, ctx.Dynstr.Shdr.Size)
+	define(elf.DT_HASH, ctx.Hash.Shdr.Addr)
+
+	for _, chunk := range ctx.Chunks {
+		switch chunk.GetShdr().Type {
+		case uint32(elf.SHT_INIT_ARRAY):
+			define(elf.DT_INIT_ARRAY, chunk.GetShdr().Addr)
+			define(elf.DT_INIT_ARRAYSZ, chunk.GetShdr().Size)
+		case uint32(elf.SHT_PREINIT_ARRAY):
+			define(elf.DT_PREINIT_ARRAY, chunk.GetShdr().Addr)
+			define(elf.DT_PREINIT_ARRAYSZ, chunk.GetShdr().Size)
+		case uint32(elf.SHT_FINI_ARRAY):
+			define(elf.DT_FINI_ARRAY, chunk.GetShdr().Addr)
+			define(elf.DT_FINI_ARRAYSZ, chunk.GetShdr().Size)
+		}
+	}
+
+	if sym, ok := ctx.SymbolMap["_init"]; ok && sym.File != nil && !sym.File.IsDso {
+		define(elf.DT_INIT, sym.GetAddr(ctx))
+	}
+	if sym, ok := ctx.SymbolMap["_fini"]; ok && sym.File != nil && !sym.File.IsDso {
+		define(elf.DT_FINI, sym.GetAddr(ctx))
+	}
+
+	if ctx.HasTextrel.Load() {
+		define(elf.DT_TEXTREL, 0)
+		define(elf.DT_FLAGS, uint64(elf.DF_TEXTREL))
+	}
+
+	if ctx.Arg.Pie {
+		define(elf.DT_FLAGS_1, DF_1_PIE)
+	}
+
+	if !ctx.Arg.Shared {
+		define(elf.DT_DEBUG, 0)
+	}
+	define(elf.DT_NULL, 0)
+	return vec
+}
+
+func (d *DynamicSection) UpdateShdr(ctx *Context) {
+	d.Shdr.Link = uint32(ctx.Dynstr.Shndx)
+	d.Shdr.Size = uint64(len(createDynamicSection(ctx))) * uint64(unsafe.Sizeof(Dyn{}))
+}
+
+func (d *DynamicSection) CopyBuf(ctx *Context) {
+	utils.WriteSlice[Dyn](ctx.Buf[d.Shdr.Offset:], createDynamicSection(ctx))
+}
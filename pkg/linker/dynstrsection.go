@@ -0,0 +1,45 @@
+package linker
+
+import "debug/elf"
+
+type DynstrSection struct {
+	Chunk
+	Strs    []string
+	Offsets map[string]uint32
+}
+
+func NewDynstrSection() *DynstrSection {
+	d := &DynstrSection{
+		Chunk:   NewChunk(),
+		Offsets: make(map[string]uint32),
+	}
+	d.Name = ".dynstr"
+	d.Shdr.Type = uint32(elf.SHT_STRTAB)
+	d.Shdr.Flags = uint64(elf.SHF_ALLOC)
+	d.Shdr.Size = 1
+	return d
+}
+
+func (d *DynstrSection) AddString(str string) uint32 {
+	if offset, ok := d.Offsets[str]; ok {
+		return offset
+	}
+
+	offset := uint32(d.Shdr.Size)
+	d.Offsets[str] = offset
+	d.Strs = append(d.Strs, str)
+	d.Shdr.Size += uint64(len(str)) + 1
+	return offset
+}
+
+func (d *DynstrSection) FindString(str string) uint32 {
+	return d.Offsets[str]
+}
+
+func (d *DynstrSection) CopyBuf(ctx *Context) {
+	base := ctx.Buf[d.Shdr.Offset:]
+	base[0] = 0
+	for _, str := range d.Strs {
+		writeString(base[d.Offsets[str]:], str)
+	}
+}
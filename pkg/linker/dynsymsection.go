@@ -0,0 +1,72 @@
+package linker
+
+import (
+	"debug/elf"
+	"github.com/ksco/rvld/pkg/utils"
+	"unsafe"
+)
+
+type DynsymSection struct {
+	Chunk
+	Symbols []*Symbol
+}
+
+func NewDynsymSection() *DynsymSection {
+	d := &DynsymSection{Chunk: NewChunk()}
+	d.Name = ".dynsym"
+	d.Shdr.Type = uint32(elf.SHT_DYNSYM)
+	d.Shdr.Flags = uint64(elf.SHF_ALLOC)
+	d.Shdr.EntSize = uint64(unsafe.Sizeof(Sym{}))
+	d.Shdr.AddrAlign = 8
+	d.Shdr.Info = 1
+	d.Symbols = []*Symbol{nil}
+	return d
+}
+
+func (d *DynsymSection) AddSymbol(ctx *Context, sym *Symbol) {
+	if sym.GetDynsymIdx(ctx) != -1 {
+		return
+	}
+
+	sym.SetDynsymIdx(ctx, int32(len(d.Symbols)))
+	d.Symbols = append(d.Symbols, sym)
+	ctx.Dynstr.AddString(sym.Name)
+}
+
+func (d *DynsymSection) UpdateShdr(ctx *Context) {
+	d.Shdr.Link = uint32(ctx.Dynstr.Shndx)
+	d.Shdr.Size = uint64(len(d.Symbols)) * uint64(unsafe.Sizeof(Sym{}))
+}
+
+func (d *DynsymSection) CopyBuf(ctx *Context) {
+	base := ctx.Buf[d.Shdr.Offset:]
+	utils.Write[Sym](base, Sym{})
+
+	for i := 1; i < len(d.Symbols); i++ {
+		utils.Write[Sym](base[i*int(unsafe.Sizeof(Sym{})):],
+			toDynsymEsym(ctx, d.Symbols[i]))
+	}
+}
+
+func toDynsymEsym(ctx *Context, sym *Symbol) Sym {
+	name := ctx.Dynstr.FindString(sym.Name)
+	if !sym.IsImported {
+		return toOutputEsym(ctx, sym, name)
+	}
+
+	esym := sym.ElfSym()
+	ret := Sym{Name: name, Info: esym.Info, Size: esym.Size}
+	if esym.IsUndefWeak() {
+		ret.SetBind(uint8(elf.STB_WEAK))
+	} else {
+		ret.SetBind(uint8(elf.STB_GLOBAL))
+	}
+
+	if sym.HasCopyrel {
+		ret.Shndx = uint16(ctx.Copyrel.Shndx)
+		ret.Val = sym.GetAddr(ctx)
+	} else if sym.IsCanonical {
+		ret.Val = sym.GetPltAddr(ctx)
+	}
+	return ret
+}
@@ -0,0 +1,93 @@
+package linker
+
+import (
+	"debug/elf"
+	"github.com/ksco/rvld/pkg/utils"
+	"sort"
+)
+
+const EhFrameHdrSize uint64 = 12
+
+const (
+	DW_EH_PE_udata4  = 0x03
+	DW_EH_PE_sdata4  = 0x0b
+	DW_EH_PE_pcrel   = 0x10
+	DW_EH_PE_datarel = 0x30
+)
+
+type EhFrameHdrSection struct {
+	Chunk
+}
+
+func NewEhFrameHdrSection() *EhFrameHdrSection {
+	e := &EhFrameHdrSection{Chunk: NewChunk()}
+	e.Name = ".eh_frame_hdr"
+	e.Shdr.Type = uint32(elf.SHT_PROGBITS)
+	e.Shdr.Flags = uint64(elf.SHF_ALLOC)
+	e.Shdr.AddrAlign = 4
+	return e
+}
+
+func getLiveFdes(ctx *Context) []*FdeRecord {
+	fdes := make([]*FdeRecord, 0)
+	for _, file := range ctx.Objs {
+		for _, isec := range file.Sections {
+			if isec == nil || !isec.IsAlive {
+				continue
+			}
+
+			for i := isec.FdeBegin; i < isec.FdeEnd; i++ {
+				fdes = append(fdes, &file.Fdes[i])
+			}
+		}
+	}
+	return fdes
+}
+
+func (e *EhFrameHdrSection) UpdateShdr(ctx *Context) {
+	n := uint64(len(getLiveFdes(ctx)))
+	if n == 0 {
+		e.Shdr.Size = 0
+		return
+	}
+	e.Shdr.Size = EhFrameHdrSize + n*8
+}
+
+// CopyBuf writes a binary search table that maps function addresses to
+// their FDEs, so that unwinders don't have to scan .eh_frame linearly.
+func (e *EhFrameHdrSection) CopyBuf(ctx *Context) {
+	base := ctx.Buf[e.Shdr.Offset:]
+	fdes := getLiveFdes(ctx)
+
+	base[0] = 1
+	base[1] = DW_EH_PE_pcrel | DW_EH_PE_sdata4
+	base[2] = DW_EH_PE_udata4
+	base[3] = DW_EH_PE_datarel | DW_EH_PE_sdata4
+	utils.Write[uint32](base[4:], uint32(ctx.EhFrame.Shdr.Addr-e.Shdr.Addr-4))
+	utils.Write[uint32](base[8:], uint32(len(fdes)))
+
+	type entry struct {
+		InitVal int32
+		FdeVal  int32
+	}
+
+	entries := make([]entry, 0, len(fdes))
+	for _, fde := range fdes {
+		rel := fde.GetRels()[0]
+		sym := fde.InputSection.File.Symbols[rel.Sym]
+		entries = append(entries, entry{
+			InitVal: int32(sym.GetAddr(ctx) + uint64(rel.Addend) - e.Shdr.Addr),
+			FdeVal:  int32(ctx.EhFrame.Shdr.Addr + uint64(fde.OutputOffset) - e.Shdr.Addr),
+		})
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].InitVal < entries[j].InitVal
+	})
+
+	buf := base[EhFrameHdrSize:]
+	for _, ent := range entries {
+		utils.Write[entry](buf, ent)
+		buf = buf[8:]
+	}
+}
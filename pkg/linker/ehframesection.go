@@ -0,0 +1,204 @@
+package linker
+
+import (
+	"debug/elf"
+	"fmt"
+	"github.com/ksco/rvld/pkg/utils"
+	"math"
+)
+
+type EhFrameSection struct {
+	Chunk
+}
+
+func NewEhFrameSection() *EhFrameSection {
+	e := &EhFrameSection{Chunk: NewChunk()}
+	e.Name = ".eh_frame"
+	e.Shdr.Type = uint32(elf.SHT_PROGBITS)
+	e.Shdr.Flags = uint64(elf.SHF_ALLOC)
+	e.Shdr.AddrAlign = 8
+	return e
+}
+
+// UpdateShdr lays out the output .eh_frame: one copy of each distinct CIE,
+// followed by the FDEs of live sections and a null terminator.
+func (e *EhFrameSection) UpdateShdr(ctx *Context) {
+	leaders := make(map[string][]*CieRecord)
+	offset := uint32(0)
+
+	for _, file := range ctx.Objs {
+		for i := range file.Cies {
+			cie := &file.Cies[i]
+			key := string(cie.GetContents())
+
+			var leader *CieRecord
+			for _, c := range leaders[key] {
+				if cie.Equals(c) {
+					leader = c
+					break
+				}
+			}
+
+			if leader != nil {
+				cie.IsLeader = false
+				cie.OutputOffset = leader.OutputOffset
+				continue
+			}
+
+			cie.IsLeader = true
+			cie.OutputOffset = offset
+			offset += cie.Size()
+			leaders[key] = append(leaders[key], cie)
+		}
+	}
+
+	for _, file := range ctx.Objs {
+		for i := range file.Fdes {
+			file.Fdes[i].OutputOffset = math.MaxUint32
+		}
+
+		for _, isec := range file.Sections {
+			if isec == nil || !isec.IsAlive {
+				continue
+			}
+
+			fdes := isec.GetFdes()
+			for i := range fdes {
+				fdes[i].OutputOffset = offset
+				offset += fdes[i].Size()
+			}
+		}
+	}
+
+	if offset == 0 {
+		e.Shdr.Size = 0
+		return
+	}
+	e.Shdr.Size = uint64(offset) + 4
+}
+
+func (e *EhFrameSection) CopyBuf(ctx *Context) {
+	base := ctx.Buf[e.Shdr.Offset:]
+
+	for _, file := range ctx.Objs {
+		for i := range file.Cies {
+			cie := &file.Cies[i]
+			if !cie.IsLeader {
+				continue
+			}
+
+			copy(base[cie.OutputOffset:], cie.GetContents())
+			for _, rel := range cie.GetRels() {
+				e.applyReloc(ctx, file, &rel,
+					cie.OutputOffset+uint32(rel.Offset)-cie.InputOffset)
+			}
+		}
+	}
+
+	for _, file := range ctx.Objs {
+		for i := range file.Fdes {
+			fde := &file.Fdes[i]
+			if !fde.IsAlive() {
+				continue
+			}
+
+			copy(base[fde.OutputOffset:], fde.GetContents())
+
+			// The second word of an FDE is the distance back to its CIE.
+			cie := &file.Cies[fde.CieIdx]
+			utils.Write[uint32](base[fde.OutputOffset+4:],
+				fde.OutputOffset+4-cie.OutputOffset)
+
+			for _, rel := range fde.GetRels() {
+				e.applyReloc(ctx, file, &rel,
+					fde.OutputOffset+uint32(rel.Offset)-fde.InputOffset)
+			}
+		}
+	}
+
+	utils.Write[uint32](base[e.Shdr.Size-4:], 0)
+}
+
+func (e *EhFrameSection) applyReloc(
+	ctx *Context, file *ObjectFile, rel *Rela, offset uint32,
+) {
+	loc := ctx.Buf[e.Shdr.Offset+uint64(offset):]
+	sym := file.Symbols[rel.Sym]
+	S := sym.GetAddr(ctx)
+	A := uint64(rel.Addend)
+	P := e.Shdr.Addr + uint64(offset)
+
+	switch elf.R_RISCV(rel.Type) {
+	case elf.R_RISCV_NONE, elf.R_RISCV_RELAX, elf.R_RISCV_ALIGN:
+	case elf.R_RISCV_32:
+		utils.Write[uint32](loc, uint32(S+A))
+	case elf.R_RISCV_64:
+		utils.Write[uint64](loc, S+A)
+	case elf.R_RISCV_32_PCREL:
+		utils.Write[uint32](loc, uint32(S+A-P))
+	case elf.R_RISCV_ADD8:
+		utils.Write[uint8](loc, utils.Read[uint8](loc)+uint8(S+A))
+	case elf.R_RISCV_ADD16:
+		utils.Write[uint16](loc, utils.Read[uint16](loc)+uint16(S+A))
+	case elf.R_RISCV_ADD32:
+		utils.Write[uint32](loc, utils.Read[uint32](loc)+uint32(S+A))
+	case elf.R_RISCV_ADD64:
+		utils.Write[uint64](loc, utils.Read[uint64](loc)+S+A)
+	case elf.R_RISCV_SUB8:
+		utils.Write[uint8](loc, utils.Read[uint8](loc)-uint8(S+A))
+	case elf.R_RISCV_SUB16:
+		utils.Write[uint16](loc, utils.Read[uint16](loc)-uint16(S+A))
+	case elf.R_RISCV_SUB32:
+		utils.Write[uint32](loc, utils.Read[uint32](loc)-uint32(S+A))
+	case elf.R_RISCV_SUB64:
+		utils.Write[uint64](loc, utils.Read[uint64](loc)-(S+A))
+	case elf.R_RISCV_SUB6:
+		loc[0] = (loc[0] & 0b1100_0000) | ((loc[0] - uint8(S+A)) & 0b0011_1111)
+	case elf.R_RISCV_SET6:
+		loc[0] = (loc[0] & 0b1100_0000) | (uint8(S+A) & 0b0011_1111)
+	case elf.R_RISCV_SET8:
+		utils.Write[uint8](loc, uint8(S+A))
+	case elf.R_RISCV_SET16:
+		utils.Write[uint16](loc, uint16(S+A))
+	case elf.R_RISCV_SET32:
+		utils.Write[uint32](loc, uint32(S+A))
+	default:
+		utils.Fatal(fmt.Sprintf("%s:(.eh_frame+0x%x): unsupported relocation: %s",
+			file, rel.Offset, elf.R_RISCV(rel.Type)))
+	}
+}
+
+// GetSymbolAddr returns the output address of a symbol defined in an input
+// .eh_frame section. Such symbols are rare, but crtbegin.o and crtend.o
+// use them to mark the beginning and the end of the section.
+func (e *EhFrameSection) GetSymbolAddr(ctx *Context, sym *Symbol) uint64 {
+	isec := sym.InputSection
+	val := uint32(sym.Value)
+
+	contains := func(begin, size uint32) bool {
+		return begin <= val && val < begin+size
+	}
+
+	for i := range isec.File.Cies {
+		cie := &isec.File.Cies[i]
+		if cie.InputSection == isec && contains(cie.InputOffset, cie.Size()) {
+			return e.Shdr.Addr + uint64(cie.OutputOffset+val-cie.InputOffset)
+		}
+	}
+
+	for i := range isec.File.Fdes {
+		fde := &isec.File.Fdes[i]
+		if fde.InputSection == isec && fde.IsAlive() &&
+			contains(fde.InputOffset, fde.Size()) {
+			return e.Shdr.Addr + uint64(fde.OutputOffset+val-fde.InputOffset)
+		}
+	}
+
+	switch sym.Name {
+	case "__FRAME_END__", "__EH_FRAME_LIST_END__":
+		if e.Shdr.Size > 0 {
+			return e.Shdr.Addr + e.Shdr.Size - 4
+		}
+	}
+	return e.Shdr.Addr
+}
@@ -6,12 +6,20 @@ import (
 )
 
 const SHF_EXCLUDE uint32 = 0x80000000
+const SHF_GNU_RETAIN uint32 = 0x200000
 const SHT_LLVM_ADDRSIG uint32 = 0x6fff4c03
+const SHT_RISCV_ATTRIBUTES uint32 = 0x70000003
 const VER_NDX_LOCAL uint16 = 0
+const VER_NDX_GLOBAL uint16 = 1
+const VERSYM_HIDDEN uint16 = 0x8000
 const EF_RISCV_RVC uint32 = 1
+const GRP_COMDAT uint32 = 1
+const DF_1_PIE uint64 = 0x08000000
+const NT_GNU_BUILD_ID uint32 = 3
 
 const PageSize = 4096
 const ImageBase uint64 = 0x200000
+const TLS_DTV_OFFSET uint64 = 0x800
 
 type Ehdr struct {
 	Ident     [16]uint8
@@ -99,7 +107,7 @@ func (s *Sym) Bind() uint8 {
 	return s.Info >> 4
 }
 func (s *Sym) SetBind(bind uint8) {
-	s.Info = (s.Info & 0xf) | (bind & 0xf0)
+	s.Info = (s.Info & 0xf) | (bind << 4)
 }
 
 func (s *Sym) StVisibility() uint8 {
@@ -117,6 +125,11 @@ type Rela struct {
 	Addend int64
 }
 
+type Dyn struct {
+	Tag int64
+	Val uint64
+}
+
 type Chdr struct {
 	Type      uint32
 	Reserved  uint32
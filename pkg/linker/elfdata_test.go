@@ -0,0 +1,367 @@
+package linker
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"github.com/ksco/rvld/pkg/utils"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"unsafe"
+)
+
+// These benchmarks compare the utils accessors with the encoding/binary
+// based ones they replaced, on a set of synthetic object files about the
+// size of those of a large program.
+
+const (
+	benchNumObjs = 200
+	benchNumSyms = 2000
+	benchNumRels = 5000
+)
+
+// binaryRead and binaryWrite are the original implementations of
+// utils.Read and utils.Write.
+func binaryRead[T any](data []byte) (val T) {
+	reader := bytes.NewReader(data)
+	err := binary.Read(reader, binary.LittleEndian, &val)
+	utils.MustNo(err)
+	return
+}
+
+func binaryWrite[T any](data []byte, e T) {
+	buf := &bytes.Buffer{}
+	err := binary.Write(buf, binary.LittleEndian, e)
+	utils.MustNo(err)
+	copy(data, buf.Bytes())
+}
+
+// binaryReadSlice reads elements one by one, as GetRels and
+// FillUpElfSyms used to.
+func binaryReadSlice[T any](bs []byte) []T {
+	var zero T
+	nums := len(bs) / int(unsafe.Sizeof(zero))
+	vals := make([]T, 0)
+	for nums > 0 {
+		vals = append(vals, binaryRead[T](bs))
+		bs = bs[unsafe.Sizeof(zero):]
+		nums--
+	}
+	return vals
+}
+
+// benchObj is an object file whose first section is a symbol table and
+// whose second section is a relocation section for the third, .text.
+type benchObj struct {
+	obj  *ObjectFile
+	isec *InputSection
+}
+
+func newBenchObjs() []benchObj {
+	symsSize := benchNumSyms * int(unsafe.Sizeof(Sym{}))
+	relsSize := benchNumRels * int(unsafe.Sizeof(Rela{}))
+	textSize := benchNumRels * 8
+
+	objs := make([]benchObj, benchNumObjs)
+	for i := range objs {
+		contents := make([]byte, symsSize+relsSize+textSize)
+		for j := 0; j < benchNumSyms; j++ {
+			utils.Write[Sym](contents[j*int(unsafe.Sizeof(Sym{})):],
+				Sym{Name: uint32(j), Val: uint64(j * 16), Size: 16})
+		}
+		for j := 0; j < benchNumRels; j++ {
+			utils.Write[Rela](contents[symsSize+j*int(unsafe.Sizeof(Rela{})):],
+				Rela{Offset: uint64(j * 8), Type: 2, Sym: uint32(j % benchNumSyms)})
+		}
+
+		obj := &ObjectFile{}
+		obj.File = &File{Name: "bench.o", Contents: contents}
+		obj.ElfSections = []Shdr{
+			{Offset: 0, Size: uint64(symsSize)},
+			{Offset: uint64(symsSize), Size: uint64(relsSize)},
+			{Offset: uint64(symsSize + relsSize), Size: uint64(textSize)},
+		}
+
+		isec := &InputSection{File: obj, Shndx: 2, RelsecIdx: 1}
+		isec.Contents = contents[symsSize+relsSize:]
+		objs[i] = benchObj{obj, isec}
+	}
+	return objs
+}
+
+func BenchmarkGetRels(b *testing.B) {
+	objs := newBenchObjs()
+
+	b.Run("binary.Read", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			for _, o := range objs {
+				bs := o.obj.GetBytesFromIdx(int64(o.isec.RelsecIdx))
+				if len(binaryReadSlice[Rela](bs)) != benchNumRels {
+					b.Fatal("wrong number of relocations")
+				}
+			}
+		}
+	})
+
+	b.Run("utils", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			for _, o := range objs {
+				o.isec.Rels = nil
+				if len(o.isec.GetRels()) != benchNumRels {
+					b.Fatal("wrong number of relocations")
+				}
+			}
+		}
+	})
+}
+
+func BenchmarkFillUpElfSyms(b *testing.B) {
+	objs := newBenchObjs()
+
+	b.Run("binary.Read", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			for _, o := range objs {
+				bs := o.obj.GetBytesFromIdx(0)
+				if len(binaryReadSlice[Sym](bs)) != benchNumSyms {
+					b.Fatal("wrong number of symbols")
+				}
+			}
+		}
+	})
+
+	b.Run("utils", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			for _, o := range objs {
+				o.obj.FillUpElfSyms(&o.obj.ElfSections[0])
+				if len(o.obj.ElfSyms) != benchNumSyms {
+					b.Fatal("wrong number of symbols")
+				}
+			}
+		}
+	})
+}
+
+// BenchmarkApplyRelocs reads and writes instruction words at each
+// relocation, as ApplyRelocAlloc does.
+func BenchmarkApplyRelocs(b *testing.B) {
+	objs := newBenchObjs()
+	buf := make([]byte, benchNumRels*8)
+
+	apply := func(isec *InputSection, read func([]byte) uint32,
+		write func([]byte, uint32)) {
+		for _, rel := range isec.GetRels() {
+			loc := buf[rel.Offset:]
+			val := read(isec.Contents[rel.Offset:])
+			write(loc, val|uint32(rel.Sym)<<12)
+			write(loc[4:], math.MaxUint32)
+		}
+	}
+
+	b.Run("binary.Read", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			for _, o := range objs {
+				apply(o.isec, binaryRead[uint32], binaryWrite[uint32])
+			}
+		}
+	})
+
+	b.Run("utils", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			for _, o := range objs {
+				apply(o.isec, utils.Read[uint32], utils.Write[uint32])
+			}
+		}
+	})
+}
+
+// writeBenchObject writes a relocatable object file that defines
+// benchNumSyms/4 functions, each of which calls a function in the next
+// object, and a data section with a pointer to each of them.
+func writeBenchObject(path string, idx int) error {
+	const numFuncs = benchNumSyms / 4
+
+	strtab := []byte{0}
+	addStr := func(tab *[]byte, s string) uint32 {
+		off := uint32(len(*tab))
+		*tab = append(append(*tab, s...), 0)
+		return off
+	}
+
+	shstrtab := []byte{0}
+	shNames := make([]uint32, 0)
+	for _, name := range []string{"", ".text", ".rela.text", ".data",
+		".rela.data", ".rodata.str1.1", ".symtab", ".strtab", ".shstrtab"} {
+		shNames = append(shNames, addStr(&shstrtab, name))
+	}
+
+	// The local section symbol for .rodata.str1.1 comes first, followed
+	// by the defined functions and the undefined callees.
+	syms := []Sym{{}, {Info: uint8(elf.STT_SECTION), Shndx: 5}}
+	firstGlobal := len(syms)
+	for j := 0; j < numFuncs; j++ {
+		syms = append(syms, Sym{
+			Name:  addStr(&strtab, fmt.Sprintf("f_%d_%d", idx, j)),
+			Info:  uint8(elf.STB_GLOBAL)<<4 | uint8(elf.STT_FUNC),
+			Shndx: 1, Val: uint64(j * 16), Size: 16,
+		})
+	}
+	for j := 0; j < numFuncs; j++ {
+		syms = append(syms, Sym{
+			Name: addStr(&strtab, fmt.Sprintf("f_%d_%d", (idx+1)%benchNumObjs, j)),
+			Info: uint8(elf.STB_GLOBAL) << 4,
+		})
+	}
+
+	rodata := make([]byte, 0)
+	strOffs := make([]int64, numFuncs)
+	for j := 0; j < numFuncs; j++ {
+		strOffs[j] = int64(len(rodata))
+		rodata = append(append(rodata, fmt.Sprintf("str%d", j%100)...), 0)
+	}
+
+	// auipc ra, 0; jalr ra, 0(ra); lui a0, 0; addi a0, a0, 0
+	text := make([]byte, numFuncs*16)
+	textRels := make([]Rela, 0)
+	for j := 0; j < numFuncs; j++ {
+		off := uint64(j * 16)
+		utils.Write[uint32](text[off:], 0x00000097)
+		utils.Write[uint32](text[off+4:], 0x000080e7)
+		utils.Write[uint32](text[off+8:], 0x00000537)
+		utils.Write[uint32](text[off+12:], 0x00050513)
+		callee := uint32(firstGlobal + numFuncs + j)
+		textRels = append(textRels,
+			Rela{Offset: off, Type: uint32(elf.R_RISCV_CALL_PLT), Sym: callee},
+			Rela{Offset: off, Type: uint32(elf.R_RISCV_RELAX)},
+			Rela{Offset: off + 8, Type: uint32(elf.R_RISCV_HI20), Sym: 1,
+				Addend: strOffs[j]},
+			Rela{Offset: off + 12, Type: uint32(elf.R_RISCV_LO12_I), Sym: 1,
+				Addend: strOffs[j]})
+	}
+
+	data := make([]byte, numFuncs*8)
+	dataRels := make([]Rela, 0)
+	for j := 0; j < numFuncs; j++ {
+		dataRels = append(dataRels, Rela{Offset: uint64(j * 8),
+			Type: uint32(elf.R_RISCV_64), Sym: uint32(firstGlobal + j)})
+	}
+
+	symSize := uint64(unsafe.Sizeof(Sym{}))
+	relaSize := uint64(unsafe.Sizeof(Rela{}))
+	shdrs := []Shdr{
+		{},
+		{Type: uint32(elf.SHT_PROGBITS),
+			Flags: uint64(elf.SHF_ALLOC | elf.SHF_EXECINSTR), AddrAlign: 4},
+		{Type: uint32(elf.SHT_RELA), Flags: uint64(elf.SHF_INFO_LINK),
+			Link: 6, Info: 1, AddrAlign: 8, EntSize: relaSize},
+		{Type: uint32(elf.SHT_PROGBITS),
+			Flags: uint64(elf.SHF_ALLOC | elf.SHF_WRITE), AddrAlign: 8},
+		{Type: uint32(elf.SHT_RELA), Flags: uint64(elf.SHF_INFO_LINK),
+			Link: 6, Info: 3, AddrAlign: 8, EntSize: relaSize},
+		{Type: uint32(elf.SHT_PROGBITS),
+			Flags:     uint64(elf.SHF_ALLOC | elf.SHF_MERGE | elf.SHF_STRINGS),
+			AddrAlign: 1, EntSize: 1},
+		{Type: uint32(elf.SHT_SYMTAB), Link: 7, Info: uint32(firstGlobal),
+			AddrAlign: 8, EntSize: symSize},
+		{Type: uint32(elf.SHT_STRTAB), AddrAlign: 1},
+		{Type: uint32(elf.SHT_STRTAB), AddrAlign: 1},
+	}
+
+	contents := make([]byte, unsafe.Sizeof(Ehdr{}))
+	place := func(i int, bs []byte) {
+		for len(contents)%8 != 0 {
+			contents = append(contents, 0)
+		}
+		shdrs[i].Name = shNames[i]
+		shdrs[i].Offset = uint64(len(contents))
+		shdrs[i].Size = uint64(len(bs))
+		contents = append(contents, bs...)
+	}
+	encode := func(n int, size uint64, write func(bs []byte, j int)) []byte {
+		bs := make([]byte, uint64(n)*size)
+		for j := 0; j < n; j++ {
+			write(bs[uint64(j)*size:], j)
+		}
+		return bs
+	}
+	encodeRels := func(rels []Rela) []byte {
+		return encode(len(rels), relaSize, func(bs []byte, j int) {
+			utils.Write[Rela](bs, rels[j])
+		})
+	}
+
+	place(1, text)
+	place(2, encodeRels(textRels))
+	place(3, data)
+	place(4, encodeRels(dataRels))
+	place(5, rodata)
+	place(6, encode(len(syms), symSize, func(bs []byte, j int) {
+		utils.Write[Sym](bs, syms[j])
+	}))
+	place(7, strtab)
+	place(8, shstrtab)
+	for len(contents)%8 != 0 {
+		contents = append(contents, 0)
+	}
+
+	ehdr := Ehdr{
+		Type:      uint16(elf.ET_REL),
+		Machine:   uint16(elf.EM_RISCV),
+		Version:   uint32(elf.EV_CURRENT),
+		ShOff:     uint64(len(contents)),
+		Flags:     EF_RISCV_RVC,
+		EhSize:    uint16(unsafe.Sizeof(Ehdr{})),
+		ShEntSize: uint16(unsafe.Sizeof(Shdr{})),
+		ShNum:     uint16(len(shdrs)),
+		ShStrndx:  8,
+	}
+	copy(ehdr.Ident[:], "\177ELF")
+	ehdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	ehdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	ehdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	utils.Write[Ehdr](contents, ehdr)
+
+	contents = append(contents, encode(len(shdrs), uint64(unsafe.Sizeof(Shdr{})),
+		func(bs []byte, j int) { utils.Write[Shdr](bs, shdrs[j]) })...)
+	return os.WriteFile(path, contents, 0666)
+}
+
+// BenchmarkReadInputFiles reads and parses a set of object files,
+// resolves their symbols and then reads the instruction word at each
+// relocation, which covers most of the ELF data a link reads.
+func BenchmarkReadInputFiles(b *testing.B) {
+	dir := b.TempDir()
+	paths := make([]string, benchNumObjs)
+	for i := range paths {
+		paths[i] = filepath.Join(dir, fmt.Sprintf("%d.o", i))
+		if err := writeBenchObject(paths[i], i); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		ctx := NewContext()
+		ctx.Arg.Emulation = MachineTypeRISCV64
+		ReadInputFiles(ctx, paths)
+		CreateInternalFile(ctx)
+		ResolveSymbols(ctx)
+
+		var sum uint32
+		for _, file := range ctx.Objs {
+			for _, isec := range file.Sections {
+				if isec == nil {
+					continue
+				}
+				for _, rel := range isec.GetRels() {
+					sum += utils.Read[uint32](isec.Contents[rel.Offset:])
+				}
+			}
+		}
+		if sum == 0 {
+			b.Fatal("no relocations were read")
+		}
+	}
+}
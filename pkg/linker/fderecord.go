@@ -0,0 +1,40 @@
+package linker
+
+import (
+	"github.com/ksco/rvld/pkg/utils"
+	"math"
+)
+
+type FdeRecord struct {
+	InputSection *InputSection
+	InputOffset  uint32
+	OutputOffset uint32
+	RelBegin     uint32
+	RelEnd       uint32
+	CieIdx       uint32
+}
+
+func NewFdeRecord(isec *InputSection, offset, relBegin uint32) FdeRecord {
+	return FdeRecord{
+		InputSection: isec,
+		InputOffset:  offset,
+		OutputOffset: math.MaxUint32,
+		RelBegin:     relBegin,
+	}
+}
+
+func (f *FdeRecord) Size() uint32 {
+	return utils.Read[uint32](f.InputSection.Contents[f.InputOffset:]) + 4
+}
+
+func (f *FdeRecord) GetContents() []byte {
+	return f.InputSection.Contents[f.InputOffset : f.InputOffset+f.Size()]
+}
+
+func (f *FdeRecord) GetRels() []Rela {
+	return f.InputSection.GetRels()[f.RelBegin:f.RelEnd]
+}
+
+func (f *FdeRecord) IsAlive() bool {
+	return f.OutputOffset != math.MaxUint32
+}
@@ -1,10 +1,21 @@
 package linker
 
 import (
+	"fmt"
 	"github.com/ksco/rvld/pkg/utils"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
+// File is an input file read into memory.
+//
+// The ELF data in Contents is used in place: the symbol tables,
+// relocations and section headers of object files are slices that refer
+// to it, and some passes modify them. Contents must therefore be private
+// to the File and writable, which is the case for data read with
+// os.ReadFile. Archive members are disjoint parts of their archive's
+// contents.
 type File struct {
 	Name     string
 	Contents []byte
@@ -21,6 +32,15 @@ func MustNewFile(filename string) *File {
 	}
 }
 
+// FullName returns the file name, along with the archive name for an
+// archive member.
+func (f *File) FullName() string {
+	if f.Parent != nil {
+		return fmt.Sprintf("%s(%s)", f.Parent.Name, f.Name)
+	}
+	return f.Name
+}
+
 func OpenLibrary(path string) *File {
 	contents, err := os.ReadFile(path)
 	if err != nil {
@@ -33,18 +53,56 @@ func OpenLibrary(path string) *File {
 		return file
 	}
 
-	utils.Fatal("incompatible file")
+	utils.Fatal(fmt.Sprintf("%s: incompatible file type: %s",
+		file.FullName(), MachineTypeStringer{ty}))
 	return nil
 }
 
 func FindLibrary(ctx *Context, name string) *File {
 	for _, dir := range ctx.Arg.LibraryPaths {
 		stem := dir + "/lib" + name
+		if !ctx.IsStatic {
+			if f := OpenLibrary(stem + ".so"); f != nil {
+				return f
+			}
+		}
 		if f := OpenLibrary(stem + ".a"); f != nil {
 			return f
 		}
 	}
 
-	utils.Fatal("library not found")
+	utils.Fatal(fmt.Sprintf("library not found: -l%s", name))
 	return nil
 }
+
+// ResolveSysroot replaces a leading `=` or `$SYSROOT` in a path with the
+// --sysroot directory.
+func ResolveSysroot(ctx *Context, path string) string {
+	if rest, ok := utils.RemovePrefix(path, "="); ok {
+		return filepath.Join(ctx.Arg.Sysroot, rest)
+	}
+	if rest, ok := utils.RemovePrefix(path, "$SYSROOT"); ok {
+		return filepath.Join(ctx.Arg.Sysroot, rest)
+	}
+	return path
+}
+
+// isInSysroot returns true if a path is located under the --sysroot
+// directory.
+func isInSysroot(ctx *Context, path string) bool {
+	if ctx.Arg.Sysroot == "" {
+		return false
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	root, err := filepath.Abs(ctx.Arg.Sysroot)
+	if err != nil {
+		return false
+	}
+
+	rel, err := filepath.Rel(root, abs)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
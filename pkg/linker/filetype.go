@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"debug/elf"
 	"encoding/binary"
+	"fmt"
 	"github.com/ksco/rvld/pkg/utils"
 	"unicode"
 )
@@ -61,6 +62,9 @@ func GetFileType(contents []byte) FileType {
 func CheckFileCompatibility(ctx *Context, file *File) {
 	mt := GetMachineTypeFromContents(file.Contents)
 	if mt != ctx.Arg.Emulation {
-		utils.Fatal("incompatible file type")
+		utils.Fatal(fmt.Sprintf(
+			"%s: incompatible file type: %s is incompatible with %s",
+			file.FullName(), MachineTypeStringer{mt},
+			MachineTypeStringer{ctx.Arg.Emulation}))
 	}
 }
@@ -0,0 +1,161 @@
+package linker
+
+import (
+	"debug/elf"
+	"fmt"
+	"github.com/ksco/rvld/pkg/utils"
+	"strings"
+)
+
+// isCIdentifier reports whether a section name is a valid C identifier.
+// The runtime may find such sections through __start_ and __stop_
+// symbols, so they are never collected.
+func isCIdentifier(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for i, c := range name {
+		if c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') {
+			continue
+		}
+		if i > 0 && '0' <= c && c <= '9' {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+func isGcRoot(isec *InputSection) bool {
+	if isec.InputDesc != nil && isec.InputDesc.Keep {
+		return true
+	}
+
+	shdr := isec.Shdr()
+	if shdr.Flags&uint64(SHF_GNU_RETAIN) != 0 {
+		return true
+	}
+
+	switch elf.SectionType(shdr.Type) {
+	case elf.SHT_NOTE, elf.SHT_INIT_ARRAY, elf.SHT_FINI_ARRAY,
+		elf.SHT_PREINIT_ARRAY:
+		return true
+	}
+
+	name := isec.Name()
+	for _, prefix := range []string{".ctors", ".dtors", ".init", ".fini"} {
+		if name == prefix || strings.HasPrefix(name, prefix+".") {
+			return true
+		}
+	}
+	return isCIdentifier(name)
+}
+
+func GcSections(ctx *Context) {
+	worklist := make([]*InputSection, 0)
+
+	enqueueSection := func(isec *InputSection) {
+		if isec == nil || !isec.IsAlive || isec.IsVisited {
+			return
+		}
+		isec.IsVisited = true
+		worklist = append(worklist, isec)
+	}
+
+	enqueueSymbol := func(sym *Symbol) {
+		if sym == nil || sym.File == nil {
+			return
+		}
+		if sym.SectionFragment != nil {
+			sym.SectionFragment.IsAlive = true
+			return
+		}
+		enqueueSection(sym.InputSection)
+	}
+
+	for _, file := range ctx.Objs {
+		// Fragments of non-allocated sections, such as .debug_str and
+		// .comment, are not reachable through relocations we scan.
+		for i, m := range file.MergeableSections {
+			if m == nil ||
+				file.ElfSections[i].Flags&uint64(elf.SHF_ALLOC) != 0 {
+				continue
+			}
+			for _, frag := range m.Fragments {
+				frag.IsAlive = true
+			}
+		}
+
+		for _, isec := range file.Sections {
+			if isec == nil || !isec.IsAlive {
+				continue
+			}
+
+			// Non-allocated sections are kept, but what they refer to
+			// is not kept alive by them.
+			if isec.Shdr().Flags&uint64(elf.SHF_ALLOC) == 0 {
+				isec.IsVisited = true
+				continue
+			}
+
+			if isGcRoot(isec) {
+				enqueueSection(isec)
+			}
+		}
+
+		// Personality routines referenced by CIEs are always needed.
+		for i := range file.Cies {
+			for _, rel := range file.Cies[i].GetRels() {
+				enqueueSymbol(file.Symbols[rel.Sym])
+			}
+		}
+
+		for _, sym := range file.GetGlobalSyms() {
+			if sym.File == file && sym.IsExported {
+				enqueueSymbol(sym)
+			}
+		}
+	}
+
+	if sym, ok := ctx.SymbolMap[ctx.Arg.Entry]; ok {
+		enqueueSymbol(sym)
+	}
+
+	for _, def := range ctx.Arg.Defsyms {
+		if _, ok := def.GetAddr(); !ok {
+			enqueueSymbol(ctx.SymbolMap[def.Expr])
+		}
+	}
+
+	for len(worklist) > 0 {
+		isec := worklist[len(worklist)-1]
+		worklist = worklist[:len(worklist)-1]
+
+		for _, rel := range isec.GetRels() {
+			enqueueSymbol(isec.File.Symbols[rel.Sym])
+		}
+
+		// A live section keeps alive what its FDEs refer to, such as
+		// LSDAs. The first relocation points back to the section itself.
+		for _, fde := range isec.GetFdes() {
+			for _, rel := range fde.GetRels()[1:] {
+				enqueueSymbol(isec.File.Symbols[rel.Sym])
+			}
+		}
+	}
+
+	for _, file := range ctx.Objs {
+		for _, isec := range file.Sections {
+			if isec == nil || !isec.IsAlive || isec.IsVisited {
+				continue
+			}
+
+			isec.IsAlive = false
+			if ctx.Arg.PrintGcSections {
+				utils.Info(fmt.Sprintf("removing unused section %s:(%s)",
+					file, isec.Name()))
+			}
+		}
+	}
+}
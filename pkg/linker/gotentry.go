@@ -6,13 +6,15 @@ type GotEntry struct {
 	Idx  int64
 	Val  uint64
 	Type int64
+	Sym  *Symbol
 }
 
-func NewGotEntry(idx int64, val uint64, typ int64) GotEntry {
+func NewGotEntry(idx int64, val uint64, typ int64, sym *Symbol) GotEntry {
 	e := GotEntry{
 		Idx:  idx,
 		Val:  val,
 		Type: typ,
+		Sym:  sym,
 	}
 	return e
 }
@@ -0,0 +1,43 @@
+package linker
+
+import (
+	"debug/elf"
+	"github.com/ksco/rvld/pkg/utils"
+)
+
+// The first two words of .got.plt are reserved for the dynamic linker,
+// which stores the address of its resolver and the link map there.
+const GotPltHdrSize uint64 = 16
+
+type GotPltSection struct {
+	Chunk
+}
+
+func NewGotPltSection() *GotPltSection {
+	g := &GotPltSection{Chunk: NewChunk()}
+	g.Name = ".got.plt"
+	g.Shdr.Type = uint32(elf.SHT_PROGBITS)
+	g.Shdr.Flags = uint64(elf.SHF_ALLOC | elf.SHF_WRITE)
+	g.Shdr.AddrAlign = 8
+	return g
+}
+
+func (g *GotPltSection) UpdateShdr(ctx *Context) {
+	if len(ctx.Plt.Symbols) == 0 {
+		g.Shdr.Size = 0
+		return
+	}
+	g.Shdr.Size = GotPltHdrSize + uint64(len(ctx.Plt.Symbols))*8
+}
+
+func (g *GotPltSection) CopyBuf(ctx *Context) {
+	base := ctx.Buf[g.Shdr.Offset:]
+	utils.Write[uint64](base, 0)
+	utils.Write[uint64](base[8:], 0)
+
+	// Until a PLT entry is resolved, its slot points to the PLT header,
+	// which calls into the dynamic linker.
+	for _, sym := range ctx.Plt.Symbols {
+		utils.Write[uint64](base[sym.GetGotPltAddr(ctx)-g.Shdr.Addr:], ctx.Plt.Shdr.Addr)
+	}
+}
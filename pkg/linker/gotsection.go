@@ -3,12 +3,14 @@ package linker
 import (
 	"debug/elf"
 	"github.com/ksco/rvld/pkg/utils"
+	"unsafe"
 )
 
 type GotSection struct {
 	Chunk
 	GotSyms   []*Symbol
 	GotTpSyms []*Symbol
+	TlsGdSyms []*Symbol
 }
 
 func NewGotSection() *GotSection {
@@ -32,23 +34,89 @@ func (g *GotSection) AddGotTpSymbol(ctx *Context, sym *Symbol) {
 	g.GotTpSyms = append(g.GotTpSyms, sym)
 }
 
+func (g *GotSection) AddTlsGdSymbol(ctx *Context, sym *Symbol) {
+	sym.SetTlsGdIdx(ctx, int32(g.Shdr.Size/8))
+	g.Shdr.Size += 16
+	g.TlsGdSyms = append(g.TlsGdSyms, sym)
+}
+
 func (g *GotSection) GetEntries(ctx *Context) []GotEntry {
 	entries := make([]GotEntry, 0)
 	for _, sym := range g.GotSyms {
-		idx := sym.GetGotIdx(ctx)
+		idx := int64(sym.GetGotIdx(ctx))
+		if sym.IsPreemptible(ctx) {
+			entries = append(entries,
+				NewGotEntry(idx, 0, int64(elf.R_RISCV_64), sym))
+			continue
+		}
+
+		if ctx.Arg.Pic && !sym.IsAbsolute() {
+			entries = append(entries,
+				NewGotEntry(idx, sym.GetAddr(ctx), int64(elf.R_RISCV_RELATIVE), nil))
+			continue
+		}
+
 		entries = append(entries,
-			NewGotEntry(int64(idx), sym.GetAddr(ctx), int64(elf.R_RISCV_NONE)))
+			NewGotEntry(idx, sym.GetAddr(ctx), int64(elf.R_RISCV_NONE), nil))
 	}
 
 	for _, sym := range g.GotTpSyms {
-		idx := sym.GetGotTpIdx(ctx)
+		idx := int64(sym.GetGotTpIdx(ctx))
+		if sym.IsPreemptible(ctx) {
+			entries = append(entries,
+				NewGotEntry(idx, 0, int64(elf.R_RISCV_TLS_TPREL64), sym))
+			continue
+		}
+
+		// The offset of a shared object's TLS block from the thread
+		// pointer is only known at load time.
+		if ctx.Arg.Shared {
+			entries = append(entries,
+				NewGotEntry(idx, sym.GetAddr(ctx)-ctx.TpAddr,
+					int64(elf.R_RISCV_TLS_TPREL64), nil))
+			continue
+		}
+
 		entries = append(entries,
-			NewGotEntry(int64(idx), sym.GetAddr(ctx)-ctx.TpAddr, int64(elf.R_RISCV_NONE)))
+			NewGotEntry(idx, sym.GetAddr(ctx)-ctx.TpAddr, int64(elf.R_RISCV_NONE), nil))
+	}
+
+	for _, sym := range g.TlsGdSyms {
+		idx := int64(sym.GetTlsGdIdx(ctx))
+		if sym.IsPreemptible(ctx) {
+			entries = append(entries,
+				NewGotEntry(idx, 0, int64(elf.R_RISCV_TLS_DTPMOD64), sym),
+				NewGotEntry(idx+1, 0, int64(elf.R_RISCV_TLS_DTPREL64), sym))
+			continue
+		}
+
+		dtprel := sym.GetAddr(ctx) - ctx.TpAddr - TLS_DTV_OFFSET
+		if ctx.Arg.Shared {
+			entries = append(entries,
+				NewGotEntry(idx, 0, int64(elf.R_RISCV_TLS_DTPMOD64), nil),
+				NewGotEntry(idx+1, dtprel, int64(elf.R_RISCV_NONE), nil))
+			continue
+		}
+
+		// The executable is always the first module in the TLS block list.
+		entries = append(entries,
+			NewGotEntry(idx, 1, int64(elf.R_RISCV_NONE), nil),
+			NewGotEntry(idx+1, dtprel, int64(elf.R_RISCV_NONE), nil))
 	}
 
 	return entries
 }
 
+func (g *GotSection) GetRelaDynSize(ctx *Context) uint64 {
+	n := uint64(0)
+	for _, ent := range g.GetEntries(ctx) {
+		if ent.IsRel() {
+			n++
+		}
+	}
+	return n * uint64(unsafe.Sizeof(Rela{}))
+}
+
 func (g *GotSection) UpdateShdr(ctx *Context) {
 	if g.Shdr.Size == 0 {
 		g.Shdr.Size = 8
@@ -57,17 +125,32 @@ func (g *GotSection) UpdateShdr(ctx *Context) {
 
 func (g *GotSection) CopyBuf(ctx *Context) {
 	buf := ctx.Buf[g.Shdr.Offset:]
-	for i := uint64(0); i < g.Shdr.Size*8; i++ {
+	for i := uint64(0); i < g.Shdr.Size; i++ {
 		buf[i] = 0
 	}
 
+	var rel []byte
+	if ctx.RelaDyn != nil {
+		rel = ctx.Buf[ctx.RelaDyn.Shdr.Offset:]
+	}
+
 	for _, ent := range g.GetEntries(ctx) {
-		if ent.Type == int64(elf.R_RISCV_NONE) {
+		if !ent.IsRel() {
 			utils.Write[uint64](buf[ent.Idx*8:], ent.Val)
+			continue
 		}
 
-		if ent.IsRel() {
-			utils.Fatal("unreachable")
+		dynsymIdx := uint32(0)
+		if ent.Sym != nil {
+			dynsymIdx = uint32(ent.Sym.GetDynsymIdx(ctx))
 		}
+
+		utils.Write[Rela](rel, Rela{
+			Offset: g.Shdr.Addr + uint64(ent.Idx)*8,
+			Type:   uint32(ent.Type),
+			Sym:    dynsymIdx,
+			Addend: int64(ent.Val),
+		})
+		rel = rel[unsafe.Sizeof(Rela{}):]
 	}
 }
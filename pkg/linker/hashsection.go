@@ -0,0 +1,56 @@
+package linker
+
+import (
+	"debug/elf"
+	"github.com/ksco/rvld/pkg/utils"
+)
+
+type HashSection struct {
+	Chunk
+}
+
+func NewHashSection() *HashSection {
+	h := &HashSection{Chunk: NewChunk()}
+	h.Name = ".hash"
+	h.Shdr.Type = uint32(elf.SHT_HASH)
+	h.Shdr.Flags = uint64(elf.SHF_ALLOC)
+	h.Shdr.EntSize = 4
+	h.Shdr.AddrAlign = 4
+	return h
+}
+
+func (h *HashSection) UpdateShdr(ctx *Context) {
+	n := uint64(len(ctx.Dynsym.Symbols))
+	h.Shdr.Link = uint32(ctx.Dynsym.Shndx)
+	h.Shdr.Size = (2 + n*2) * 4
+}
+
+func (h *HashSection) CopyBuf(ctx *Context) {
+	base := ctx.Buf[h.Shdr.Offset:]
+	n := uint32(len(ctx.Dynsym.Symbols))
+	buckets := make([]uint32, n)
+	chains := make([]uint32, n)
+
+	for i := uint32(1); i < n; i++ {
+		idx := elfHash(ctx.Dynsym.Symbols[i].Name) % n
+		chains[i] = buckets[idx]
+		buckets[idx] = i
+	}
+
+	utils.Write[uint32](base, n)
+	utils.Write[uint32](base[4:], n)
+	utils.WriteSlice[uint32](base[8:], buckets)
+	utils.WriteSlice[uint32](base[8+n*4:], chains)
+}
+
+func elfHash(name string) uint32 {
+	h := uint32(0)
+	for i := 0; i < len(name); i++ {
+		h = (h << 4) + uint32(name[i])
+		if g := h & 0xf0000000; g != 0 {
+			h ^= g >> 24
+		}
+		h &= ^uint32(0xf0000000)
+	}
+	return h
+}
@@ -1,20 +1,70 @@
 package linker
 
-import "github.com/ksco/rvld/pkg/utils"
+import (
+	"github.com/ksco/rvld/pkg/utils"
+	"math"
+	"sort"
+)
 
 func ReadInputFiles(ctx *Context, args []string) {
+	ctx.IsStatic = ctx.Arg.IsStatic
+
+	for _, path := range ctx.Arg.Scripts {
+		ParseLinkerScript(ctx, openScriptFile(ctx, path))
+	}
+
 	for _, arg := range args {
 		var ok bool
-		if arg, ok = utils.RemovePrefix(arg, "-l"); ok {
+		if arg == "-Bstatic" {
+			ctx.IsStatic = true
+		} else if arg == "-Bdynamic" {
+			ctx.IsStatic = false
+		} else if arg == "--whole-archive" {
+			ctx.WholeArchive = true
+		} else if arg == "--no-whole-archive" {
+			ctx.WholeArchive = false
+		} else if arg == "--start-group" {
+			if ctx.FileGroup != 0 {
+				utils.Fatal("nested --start-group")
+			}
+			StartGroup(ctx)
+		} else if arg == "--end-group" {
+			if ctx.FileGroup == 0 {
+				utils.Fatal("stray --end-group")
+			}
+			ctx.FileGroup = 0
+		} else if arg, ok = utils.RemovePrefix(arg, "-l"); ok {
 			ReadFile(ctx, FindLibrary(ctx, arg))
 		} else {
 			ReadFile(ctx, MustNewFile(arg))
 		}
 	}
 
+	if ctx.FileGroup != 0 {
+		utils.Fatal("missing --end-group")
+	}
+
+	utils.ParallelForEach(ctx.Objs, ctx.Arg.Threads, func(file *ObjectFile) {
+		file.parse(ctx)
+	})
+	sortSectionInstances(ctx)
+
+	if ctx.Arg.Entry == "" {
+		ctx.Arg.Entry = "_start"
+		if ctx.Script != nil && ctx.Script.Entry != "" {
+			ctx.Arg.Entry = ctx.Script.Entry
+		}
+	}
+
 	if len(ctx.Objs) == 0 {
 		utils.Fatal("no input files")
 	}
+
+	// Definitions in object files take precedence over those in DSOs.
+	for _, file := range ctx.Dsos {
+		file.Priority = uint32(ctx.FilePriority)
+		ctx.FilePriority++
+	}
 }
 
 func ReadFile(ctx *Context, file *File) {
@@ -25,30 +75,119 @@ func ReadFile(ctx *Context, file *File) {
 	ft := GetFileType(file.Contents)
 	switch ft {
 	case FileTypeObject:
-		ctx.Objs = append(ctx.Objs, CreateObjectFile(ctx, file, ""))
+		obj := CreateObjectFile(ctx, file, "")
+		obj.Group = ctx.FileGroup
+		ctx.Objs = append(ctx.Objs, obj)
+	case FileTypeDso:
+		if ctx.Arg.IsStatic {
+			utils.Fatal(file.Name + ": cannot link a shared library in static mode")
+		}
+		ctx.Dsos = append(ctx.Dsos, CreateSharedFile(ctx, file))
+		ctx.Visited.Add(file.Name)
 	case FileTypeThinAr, FileTypeAr:
+		if !ctx.WholeArchive {
+			if index, strTab, ok := ReadArchiveIndex(file); ok {
+				ReadLazyArchive(ctx, file, index, strTab)
+				ctx.Visited.Add(file.Name)
+				return
+			}
+		}
+
+		group := ctx.FileGroup
+		if group == 0 {
+			ctx.NumGroups++
+			group = ctx.NumGroups
+		}
+
 		for _, child := range ReadArchiveMembers(file) {
 			switch GetFileType(child.Contents) {
 			case FileTypeObject:
-				ctx.Objs = append(ctx.Objs, CreateObjectFile(ctx, child, file.Name))
+				obj := CreateObjectFile(ctx, child, file.Name)
+				obj.Group = group
+				ctx.Objs = append(ctx.Objs, obj)
 			default:
-				utils.Fatal("unknown file type")
+				utils.Fatal(child.FullName() + ": unknown file type")
 			}
 		}
 		ctx.Visited.Add(file.Name)
+	case FileTypeText:
+		// A text file given as an input is a linker script. It is usually
+		// a stub such as glibc's libc.so, which names the files to be
+		// linked in place of itself.
+		ctx.Visited.Add(file.Name)
+		ParseLinkerScript(ctx, file)
 	default:
-		utils.Fatal("unknown file type")
+		utils.Fatal(file.FullName() + ": unknown file type")
 	}
 }
 
+// StartGroup begins a new group of files, within which archives may
+// refer to each other in any order.
+func StartGroup(ctx *Context) {
+	ctx.NumGroups++
+	ctx.FileGroup = ctx.NumGroups
+}
+
 func CreateObjectFile(ctx *Context, file *File, archiveName string) *ObjectFile {
 	CheckFileCompatibility(ctx, file)
 
-	inLib := len(archiveName) > 0
+	inLib := len(archiveName) > 0 && !ctx.WholeArchive
 	obj := NewObjectFile(file, inLib)
 	obj.Priority = uint32(ctx.FilePriority)
 	ctx.FilePriority++
-
-	obj.parse(ctx)
 	return obj
 }
+
+// sortSectionInstances puts output sections and merged sections, which
+// are created in an arbitrary order when objects are parsed in parallel,
+// in the order of their first use by the input files.
+func sortSectionInstances(ctx *Context) {
+	osecs := make(map[*OutputSection]int)
+	msecs := make(map[*MergedSection]int)
+
+	for _, file := range ctx.Objs {
+		for _, isec := range file.Sections {
+			if isec == nil || isec.OutputSection == nil {
+				continue
+			}
+			if _, ok := osecs[isec.OutputSection]; !ok {
+				osecs[isec.OutputSection] = len(osecs)
+			}
+		}
+
+		for _, m := range file.MergeableSections {
+			if m == nil {
+				continue
+			}
+			if _, ok := msecs[m.Parent]; !ok {
+				msecs[m.Parent] = len(msecs)
+			}
+		}
+	}
+
+	getOrder := func(osec *OutputSection) int {
+		if order, ok := osecs[osec]; ok {
+			return order
+		}
+		return math.MaxInt
+	}
+
+	sort.SliceStable(ctx.OutputSections, func(i, j int) bool {
+		return getOrder(ctx.OutputSections[i]) < getOrder(ctx.OutputSections[j])
+	})
+	for i, osec := range ctx.OutputSections {
+		osec.Idx = uint32(i)
+	}
+
+	sort.SliceStable(ctx.MergedSections, func(i, j int) bool {
+		return msecs[ctx.MergedSections[i]] < msecs[ctx.MergedSections[j]]
+	})
+}
+
+func CreateSharedFile(ctx *Context, file *File) *SharedFile {
+	CheckFileCompatibility(ctx, file)
+
+	dso := NewSharedFile(file)
+	dso.parse(ctx)
+	return dso
+}
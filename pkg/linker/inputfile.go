@@ -17,6 +17,7 @@ type InputFile struct {
 
 	ElfSyms  []Sym
 	IsAlive  bool
+	IsDso    bool
 	Priority uint32
 
 	LocalSyms []Symbol
@@ -26,10 +27,10 @@ type InputFile struct {
 func NewInputFile(file *File) *InputFile {
 	f := &InputFile{File: file}
 	if len(file.Contents) < int(unsafe.Sizeof(Ehdr{})) {
-		utils.Fatal("file too small")
+		utils.Fatal(file.FullName() + ": file too small")
 	}
 	if !CheckMagic(file.Contents) {
-		utils.Fatal("not an ELF file")
+		utils.Fatal(file.FullName() + ": not an ELF file")
 	}
 
 	ehdr := utils.Read[Ehdr](file.Contents)
@@ -42,12 +43,8 @@ func NewInputFile(file *File) *InputFile {
 		numSections = int64(shdr.Size)
 	}
 
-	f.ElfSections = []Shdr{shdr}
-	for numSections > 1 {
-		contents = contents[unsafe.Sizeof(Shdr{}):]
-		f.ElfSections = append(f.ElfSections, utils.Read[Shdr](contents))
-		numSections--
-	}
+	f.ElfSections = utils.ReadSlice[Shdr](
+		contents[:numSections*int64(unsafe.Sizeof(Shdr{}))])
 
 	shstrtabIdx := int64(ehdr.ShStrndx)
 	if ehdr.ShStrndx == uint16(elf.SHN_XINDEX) {
@@ -58,10 +55,19 @@ func NewInputFile(file *File) *InputFile {
 	return f
 }
 
+// String returns the name of the file for diagnostics, which includes
+// the archive name for an archive member.
+func (f *InputFile) String() string {
+	if f.File == nil {
+		return "<internal>"
+	}
+	return f.File.FullName()
+}
+
 func (f *InputFile) GetBytesFromShdr(s *Shdr) []byte {
 	end := s.Offset + s.Size
 	if uint64(len(f.File.Contents)) < end {
-		utils.Fatal(fmt.Sprintf("section header is out of range: %d", s.Offset))
+		utils.Fatal(fmt.Sprintf("%s: section header is out of range: %d", f, s.Offset))
 	}
 
 	return f.File.Contents[s.Offset:end]
@@ -73,16 +79,7 @@ func (f *InputFile) GetBytesFromIdx(idx int64) []byte {
 }
 
 func (f *InputFile) FillUpElfSyms(s *Shdr) {
-	bs := f.GetBytesFromShdr(s)
-	nums := len(bs) / int(unsafe.Sizeof(Sym{}))
-	elfSyms := make([]Sym, 0)
-	for nums > 0 {
-		elfSyms = append(elfSyms, utils.Read[Sym](bs))
-		bs = bs[unsafe.Sizeof(Sym{}):]
-		nums--
-	}
-
-	f.ElfSyms = elfSyms
+	f.ElfSyms = utils.ReadSlice[Sym](f.GetBytesFromShdr(s))
 }
 
 func (f *InputFile) FindSection(ty uint32) *Shdr {
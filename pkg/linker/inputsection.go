@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/ksco/rvld/pkg/utils"
 	"math"
+	"strings"
 	"unsafe"
 )
 
@@ -13,13 +14,20 @@ type InputSection struct {
 	OutputSection *OutputSection
 	Contents      []byte
 	Deltas        []int32
+	ReldynOffset  uint64
 	Offset        uint32
 	Shndx         uint32
 	RelsecIdx     uint32
+	FdeBegin      uint32
+	FdeEnd        uint32
 	ShSize        uint32
 	IsAlive       bool
+	IsVisited     bool
 	P2Align       uint8
 	Rels          []Rela
+
+	// The linker script rule that selected this section, if any.
+	InputDesc *InputSectionDesc
 }
 
 func NewInputSection(
@@ -56,12 +64,25 @@ func NewInputSection(
 		s.P2Align = uint8(toP2Align(shdr.AddrAlign))
 	}
 
+	if input := ctx.Script.FindInputSectionDesc(file, name); input != nil {
+		s.InputDesc = input
+		if !input.Parent.IsDiscard() {
+			s.OutputSection = input.Parent.GetOutputSection(ctx, shdr.Type, shdr.Flags)
+			return s
+		}
+		s.IsAlive = false
+	}
+
 	s.OutputSection =
 		GetOutputSectionInstance(ctx, name, uint64(shdr.Type), shdr.Flags)
 
 	return s
 }
 
+func (s *InputSection) GetFdes() []FdeRecord {
+	return s.File.Fdes[s.FdeBegin:s.FdeEnd]
+}
+
 func (s *InputSection) Shdr() *Shdr {
 	if s.Shndx < uint32(len(s.File.ElfSections)) {
 		return &s.File.ElfSections[s.Shndx]
@@ -86,26 +107,136 @@ func (s *InputSection) Name() string {
 	return getName(s.File.ShStrtab, s.File.ElfSections[s.Shndx].Name)
 }
 
+// String returns the file and section name of s for diagnostics, e.g.
+// "foo.a(bar.o):(.text)".
+func (s *InputSection) String() string {
+	return fmt.Sprintf("%s:(%s)", s.File, s.Name())
+}
+
+// Location returns a string pointing to the given offset in s for
+// diagnostics, e.g. "foo.a(bar.o):(.text+0x10)".
+func (s *InputSection) Location(offset uint64) string {
+	return fmt.Sprintf("%s:(%s+0x%x)", s.File, s.Name(), offset)
+}
+
+// Describe returns a line for a diagnostic pointing to the given offset
+// in s, e.g. "\n>>> defined at foo.o:(.text+0x10)". The source line is
+// shown as well if it is known.
+func (s *InputSection) Describe(prefix string, offset uint64) string {
+	loc := s.Location(offset)
+	if line := s.File.GetSourceLine(s, offset); line != "" {
+		return fmt.Sprintf("\n>>> %s %s\n>>> %s %s",
+			prefix, line, strings.Repeat(" ", len(prefix)), loc)
+	}
+	return fmt.Sprintf("\n>>> %s %s", prefix, loc)
+}
+
 func (s *InputSection) GetRels() []Rela {
 	if s.RelsecIdx == math.MaxUint32 || s.Rels != nil {
 		return s.Rels
 	}
 
 	bs := s.File.GetBytesFromShdr(&s.File.InputFile.ElfSections[s.RelsecIdx])
-	nums := len(bs) / int(unsafe.Sizeof(Rela{}))
-	s.Rels = make([]Rela, 0)
-	for nums > 0 {
-		s.Rels = append(s.Rels, utils.Read[Rela](bs))
-		bs = bs[unsafe.Sizeof(Rela{}):]
-		nums--
+	s.Rels = utils.ReadSlice[Rela](bs)
+	return s.Rels
+}
+
+const (
+	ActionNone = iota
+	ActionError
+	ActionCopyrel
+	ActionPlt
+	ActionCplt
+	ActionDynrel
+	ActionBaserel
+)
+
+// Action tables for relocations that refer to a symbol's address. The
+// row is selected by getOutputType and the column by getSymbolType.
+var absrelTable = [3][4]int{
+	{ActionNone, ActionError, ActionError, ActionError}, // DSO
+	{ActionNone, ActionError, ActionError, ActionError}, // PIE
+	{ActionNone, ActionNone, ActionCopyrel, ActionCplt}, // PDE
+}
+
+var pcrelTable = [3][4]int{
+	{ActionError, ActionNone, ActionError, ActionPlt},   // DSO
+	{ActionError, ActionNone, ActionCopyrel, ActionPlt}, // PIE
+	{ActionNone, ActionNone, ActionCopyrel, ActionCplt}, // PDE
+}
+
+var dynAbsrelTable = [3][4]int{
+	{ActionNone, ActionBaserel, ActionDynrel, ActionDynrel}, // DSO
+	{ActionNone, ActionBaserel, ActionDynrel, ActionDynrel}, // PIE
+	{ActionNone, ActionNone, ActionDynrel, ActionDynrel},    // PDE
+}
+
+// getOutputType returns the action table row for the output file: 0 for
+// a shared object, 1 for a position-independent executable and 2 for a
+// position-dependent one.
+func getOutputType(ctx *Context) int {
+	if ctx.Arg.Shared {
+		return 0
+	}
+	if ctx.Arg.Pie {
+		return 1
 	}
+	return 2
+}
 
-	return s.Rels
+// getSymbolType classifies a symbol as absolute (0), local (1),
+// preemptible data (2) or preemptible code (3).
+func getSymbolType(ctx *Context, sym *Symbol) int {
+	if sym.IsPreemptible(ctx) {
+		if sym.ElfSym().Type() == uint8(elf.STT_FUNC) {
+			return 3
+		}
+		return 2
+	}
+
+	if sym.IsAbsolute() {
+		return 0
+	}
+	return 1
+}
+
+func (s *InputSection) dispatch(
+	ctx *Context, table *[3][4]int, rel *Rela, sym *Symbol,
+) {
+	switch table[getOutputType(ctx)][getSymbolType(ctx, sym)] {
+	case ActionNone:
+	case ActionError:
+		// Undefined weak symbols resolve to zero regardless of the image base.
+		if sym.ElfSym().IsUndefWeak() {
+			return
+		}
+		kind, flag := "a PIE object", "-fPIE"
+		if ctx.Arg.Shared {
+			kind, flag = "a shared object", "-fPIC"
+		}
+		utils.Error(fmt.Sprintf("%s: relocation %s against `%s' can not be "+
+			"used when making %s; recompile with %s",
+			s.Location(rel.Offset), elf.R_RISCV(rel.Type), sym.Name, kind, flag))
+	case ActionCopyrel:
+		sym.SetFlags(NEEDS_COPYREL)
+	case ActionPlt:
+		sym.SetFlags(NEEDS_PLT)
+	case ActionCplt:
+		sym.SetFlags(NEEDS_CPLT)
+	case ActionDynrel, ActionBaserel:
+		if s.Shdr().Flags&uint64(elf.SHF_WRITE) == 0 {
+			ctx.HasTextrel.Store(true)
+		}
+		s.File.NumDynrel++
+	default:
+		utils.Fatal("unreachable")
+	}
 }
 
 func (s *InputSection) ScanRelocations(ctx *Context) {
 	utils.Assert(s.Shdr().Flags&uint64(elf.SHF_ALLOC) != 0)
 
+	s.ReldynOffset = s.File.NumDynrel * uint64(unsafe.Sizeof(Rela{}))
 	rels := s.GetRels()
 	for i := 0; i < len(rels); i++ {
 		rel := &rels[i]
@@ -115,21 +246,30 @@ func (s *InputSection) ScanRelocations(ctx *Context) {
 
 		sym := s.File.Symbols[rel.Sym]
 		if sym.File == nil {
-			utils.Fatal(fmt.Sprintf("undefined symbol: %s", sym.Name))
+			utils.Fatal(fmt.Sprintf("%s: undefined symbol: %s",
+				s.Location(rel.Offset), sym.Name))
 		}
 
 		switch elf.R_RISCV(rel.Type) {
-		case elf.R_RISCV_32, elf.R_RISCV_HI20, elf.R_RISCV_64:
-			// Do nothing.
-		case elf.R_RISCV_32_PCREL, elf.R_RISCV_TLS_GD_HI20:
+		case elf.R_RISCV_32, elf.R_RISCV_HI20:
+			s.dispatch(ctx, &absrelTable, rel, sym)
+		case elf.R_RISCV_64:
+			s.dispatch(ctx, &dynAbsrelTable, rel, sym)
+		case elf.R_RISCV_PCREL_HI20:
+			s.dispatch(ctx, &pcrelTable, rel, sym)
+		case elf.R_RISCV_32_PCREL:
 			utils.Fatal("unreachable")
 		case elf.R_RISCV_CALL, elf.R_RISCV_CALL_PLT:
-			// Do nothing.
+			if sym.IsPreemptible(ctx) {
+				sym.SetFlags(NEEDS_PLT)
+			}
 		case elf.R_RISCV_GOT_HI20:
-			sym.Flags |= NEEDS_GOT
+			sym.SetFlags(NEEDS_GOT)
 		case elf.R_RISCV_TLS_GOT_HI20:
-			sym.Flags |= NEEDS_GOTTP
-		case elf.R_RISCV_BRANCH, elf.R_RISCV_JAL, elf.R_RISCV_PCREL_HI20,
+			sym.SetFlags(NEEDS_GOTTP)
+		case elf.R_RISCV_TLS_GD_HI20:
+			sym.SetFlags(NEEDS_TLSGD)
+		case elf.R_RISCV_BRANCH, elf.R_RISCV_JAL,
 			elf.R_RISCV_PCREL_LO12_I, elf.R_RISCV_PCREL_LO12_S, elf.R_RISCV_LO12_I,
 			elf.R_RISCV_LO12_S, elf.R_RISCV_TPREL_HI20, elf.R_RISCV_TPREL_LO12_I,
 			elf.R_RISCV_TPREL_LO12_S, elf.R_RISCV_TPREL_ADD, elf.R_RISCV_ADD8,
@@ -141,7 +281,8 @@ func (s *InputSection) ScanRelocations(ctx *Context) {
 			elf.R_RISCV_SET32:
 			break
 		default:
-			utils.Fatal("unknown relocation")
+			utils.Error(fmt.Sprintf("%s: unknown relocation: %s",
+				s.Location(rel.Offset), elf.R_RISCV(rel.Type)))
 		}
 	}
 }
@@ -256,7 +397,7 @@ func writeCjtype(loc []byte, val uint16) {
 }
 
 func setRs1(loc []byte, rs1 uint32) {
-	utils.Write[uint32](loc, utils.Read[uint32](loc)&0b111111_11111_00000_111_11111_1111111)
+	utils.Write[uint32](loc, utils.Read[uint32](loc)&0b111111111111_00000_111_11111_1111111)
 	utils.Write[uint32](loc, utils.Read[uint32](loc)|(rs1<<15))
 }
 
@@ -270,6 +411,35 @@ func (s *InputSection) ApplyRelocAlloc(ctx *Context, base []byte) {
 		return s.Deltas[idx]
 	}
 
+	// A lui deleted by relaxation is paired with its lo12 instructions by
+	// the symbol and the addend. Those must then use zero or gp as their
+	// base register, as decided by relaxHi20, instead of the register the
+	// lui would have set.
+	type hi20Key struct {
+		sym    *Symbol
+		addend int64
+	}
+	var hi20Base map[hi20Key]uint32
+	for i, rel := range rels {
+		if rel.Type != uint32(elf.R_RISCV_HI20) || getDelta(i+1)-getDelta(i) != 4 {
+			continue
+		}
+		if hi20Base == nil {
+			hi20Base = make(map[hi20Key]uint32)
+		}
+		sym := s.File.Symbols[rel.Sym]
+		base := uint32(0)
+		if !isInt(sym.GetAddr(ctx)+uint64(rel.Addend), 12) {
+			base = 3
+		}
+		hi20Base[hi20Key{sym, rel.Addend}] = base
+	}
+
+	var dynrel []byte
+	if ctx.RelaDyn != nil {
+		dynrel = ctx.Buf[ctx.RelaDyn.Shdr.Offset+s.File.ReldynOffset+s.ReldynOffset:]
+	}
+
 	for i := 0; i < len(rels); i++ {
 		rel := rels[i]
 		if rel.Type == uint32(elf.R_RISCV_NONE) || rel.Type == uint32(elf.R_RISCV_RELAX) {
@@ -278,10 +448,12 @@ func (s *InputSection) ApplyRelocAlloc(ctx *Context, base []byte) {
 
 		sym := s.File.Symbols[rel.Sym]
 		offset := rel.Offset - uint64(getDelta(i))
+		removed := getDelta(i+1) - getDelta(i)
 		loc := base[offset:]
 
 		if sym.File == nil {
-			utils.Fatal(fmt.Sprintf("undefined symbol: %s", sym.Name))
+			utils.Fatal(fmt.Sprintf("%s: undefined symbol: %s",
+				s.Location(rel.Offset), sym.Name))
 		}
 
 		S := sym.GetAddr(ctx)
@@ -294,7 +466,27 @@ func (s *InputSection) ApplyRelocAlloc(ctx *Context, base []byte) {
 		case elf.R_RISCV_32:
 			utils.Write[uint32](loc, uint32(S+A))
 		case elf.R_RISCV_64:
-			utils.Write[uint64](loc, S+A)
+			switch dynAbsrelTable[getOutputType(ctx)][getSymbolType(ctx, sym)] {
+			case ActionDynrel:
+				utils.Write[Rela](dynrel, Rela{
+					Offset: P,
+					Type:   uint32(elf.R_RISCV_64),
+					Sym:    uint32(sym.GetDynsymIdx(ctx)),
+					Addend: int64(A),
+				})
+				dynrel = dynrel[unsafe.Sizeof(Rela{}):]
+				utils.Write[uint64](loc, A)
+			case ActionBaserel:
+				utils.Write[Rela](dynrel, Rela{
+					Offset: P,
+					Type:   uint32(elf.R_RISCV_RELATIVE),
+					Addend: int64(S + A),
+				})
+				dynrel = dynrel[unsafe.Sizeof(Rela{}):]
+				utils.Write[uint64](loc, S+A)
+			default:
+				utils.Write[uint64](loc, S+A)
+			}
 		case elf.R_RISCV_BRANCH:
 			val := S + A - P
 			writeBtype(loc, uint32(val))
@@ -303,34 +495,67 @@ func (s *InputSection) ApplyRelocAlloc(ctx *Context, base []byte) {
 			writeJtype(loc, uint32(val))
 		case elf.R_RISCV_CALL, elf.R_RISCV_CALL_PLT:
 			val := uint32(0)
-			if !sym.ElfSym().IsUndefWeak() {
-				val = uint32(S + A - P)
+			if !sym.ElfSym().IsUndefWeak() || sym.IsImported {
+				val = uint32(getCallTarget(ctx, sym, &rel) - P)
+			}
+
+			switch removed {
+			case 6:
+				// c.j
+				utils.Write[uint16](loc, 0b101_00000000000_01|cjtype(uint16(val)))
+			case 4:
+				// jal rd
+				rd := utils.Bits(utils.Read[uint32](s.Contents[rel.Offset+4:]), 11, 7)
+				utils.Write[uint32](loc, 0b1101111|rd<<7|jtype(val))
+			default:
+				writeUtype(loc, val)
+				writeItype(loc[4:], val)
 			}
-			writeUtype(loc, val)
-			writeItype(loc[4:], val)
 		case elf.R_RISCV_GOT_HI20:
 			utils.Write[uint32](loc, uint32(G+GOT+A-P))
 		case elf.R_RISCV_TLS_GOT_HI20:
 			utils.Write[uint32](loc, uint32(sym.GetGotTpAddr(ctx)+A-P))
 		case elf.R_RISCV_TLS_GD_HI20:
-			utils.Fatal("unreachable")
+			utils.Write[uint32](loc, uint32(sym.GetTlsGdAddr(ctx)+A-P))
 		case elf.R_RISCV_PCREL_HI20:
 			utils.Write[uint32](loc, uint32(S+A-P))
 		case elf.R_RISCV_HI20:
-			writeUtype(loc, uint32(S+A))
+			switch removed {
+			case 4:
+				// The lui was deleted.
+			case 2:
+				// c.lui rd
+				imm := uint16((S + A + 0x800) >> 12)
+				rd := uint16(utils.Bits(utils.Read[uint32](s.Contents[rel.Offset:]), 11, 7))
+				utils.Write[uint16](loc, 0b011_0_00000_00000_01|
+					utils.Bit(imm, 5)<<12|rd<<7|utils.Bits(imm, 4, 0)<<2)
+			default:
+				writeUtype(loc, uint32(S+A))
+			}
 		case elf.R_RISCV_LO12_I, elf.R_RISCV_LO12_S:
-			val := S + A
-			if rel.Type == uint32(elf.R_RISCV_LO12_I) {
-				writeItype(loc, uint32(val))
-			} else {
-				writeStype(loc, uint32(val))
+			write := func(val uint64) {
+				if rel.Type == uint32(elf.R_RISCV_LO12_I) {
+					writeItype(loc, uint32(val))
+				} else {
+					writeStype(loc, uint32(val))
+				}
 			}
 
-			if utils.SignExtend(val, 11) == val {
-				setRs1(loc, 0)
+			// If the lui stays, the lo12 keeps its base register.
+			val := S + A
+			if base, ok := hi20Base[hi20Key{sym, rel.Addend}]; ok {
+				if base == 3 {
+					val -= ctx.__GlobalPointer.GetAddr(ctx)
+				}
+				write(val)
+				setRs1(loc, base)
+			} else {
+				write(val)
 			}
 		case elf.R_RISCV_TPREL_HI20:
-			writeUtype(loc, uint32(S+A-ctx.TpAddr))
+			if removed == 0 {
+				writeUtype(loc, uint32(S+A-ctx.TpAddr))
+			}
 		case elf.R_RISCV_TPREL_ADD:
 			break
 		case elf.R_RISCV_TPREL_LO12_I, elf.R_RISCV_TPREL_LO12_S:
@@ -0,0 +1,83 @@
+package linker
+
+import (
+	"github.com/ksco/rvld/pkg/utils"
+	"sort"
+)
+
+// LazyObject is an archive member that is not parsed until one of the
+// symbols it defines according to the archive index is needed.
+type LazyObject struct {
+	Archive  *File
+	StrTab   []byte
+	Offset   int
+	Priority uint32
+	Group    int64
+
+	// WholeArchive is the value of --whole-archive when the archive was
+	// read, as members are loaded after all arguments are processed.
+	WholeArchive bool
+
+	Obj *ObjectFile
+}
+
+// ReadLazyArchive registers the symbols in an archive index as lazy
+// definitions. Members are assigned priorities in the archive order, as
+// if they were parsed eagerly.
+func ReadLazyArchive(ctx *Context, file *File, index map[int][]string, strTab []byte) {
+	group := ctx.FileGroup
+	if group == 0 {
+		ctx.NumGroups++
+		group = ctx.NumGroups
+	}
+
+	offsets := make([]int, 0, len(index))
+	for offset := range index {
+		offsets = append(offsets, offset)
+	}
+	sort.Ints(offsets)
+
+	for _, offset := range offsets {
+		l := &LazyObject{
+			Archive:  file,
+			StrTab:   strTab,
+			Offset:   offset,
+			Priority: uint32(ctx.FilePriority),
+			Group:    group,
+
+			WholeArchive: ctx.WholeArchive,
+		}
+		ctx.FilePriority++
+
+		for _, name := range index[offset] {
+			sym := GetSymbolByName(ctx, name)
+			if sym.Lazy == nil {
+				sym.Lazy = l
+			}
+		}
+	}
+}
+
+// Load parses the member and resolves its symbols. It returns nil if the
+// member has already been loaded.
+func (l *LazyObject) Load(ctx *Context) *ObjectFile {
+	if l.Obj != nil {
+		return nil
+	}
+
+	child := ReadArchiveMember(l.Archive, l.StrTab, l.Offset)
+	if GetFileType(child.Contents) != FileTypeObject {
+		utils.Fatal(child.FullName() + ": unknown file type")
+	}
+
+	CheckFileCompatibility(ctx, child)
+	l.Obj = NewObjectFile(child, !l.WholeArchive)
+	l.Obj.parse(ctx)
+	l.Obj.Priority = l.Priority
+	l.Obj.Group = l.Group
+	l.Obj.IsAlive = true
+	ctx.Objs = append(ctx.Objs, l.Obj)
+
+	l.Obj.ResolveSymbols(ctx)
+	return l.Obj
+}
@@ -0,0 +1,528 @@
+package linker
+
+import (
+	"debug/elf"
+	"fmt"
+	"github.com/ksco/rvld/pkg/utils"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// LinkerScript is the contents of the linker scripts given with -T. If it
+// has a SECTIONS command, the script decides which output section each
+// input section goes to, the order of the output sections and their
+// addresses, instead of the built-in rules.
+type LinkerScript struct {
+	Entry          string
+	Regions        []*MemoryRegion
+	Phdrs          []*PhdrDesc
+	HasSectionsCmd bool
+
+	// Top-level commands, including those in SECTIONS, in order.
+	Commands    []*ScriptCommand
+	Descs       []*OutputSectionDesc
+	Inputs      []*InputSectionDesc
+	Assignments []*ScriptAssignment
+
+	values     map[string]uint64
+	ranks      map[Chunker]int
+	lmas       map[Chunker]uint64
+	chunkPhdrs map[Chunker][]string
+}
+
+func NewLinkerScript() *LinkerScript {
+	return &LinkerScript{
+		values:     make(map[string]uint64),
+		ranks:      make(map[Chunker]int),
+		lmas:       make(map[Chunker]uint64),
+		chunkPhdrs: make(map[Chunker][]string),
+	}
+}
+
+// HasSections reports whether the script controls the section layout.
+// It may be called on a nil script.
+func (s *LinkerScript) HasSections() bool {
+	return s != nil && s.HasSectionsCmd
+}
+
+// Defines reports whether the script assigns a value to a symbol.
+func (s *LinkerScript) Defines(name string) bool {
+	if s == nil {
+		return false
+	}
+	for _, a := range s.Assignments {
+		if a.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// globMatch matches a name against a wildcard pattern. Unlike path.Match,
+// `*` also matches `/`, so that `*crt0.o` matches any path to crt0.o.
+func globMatch(pattern, name string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(name); i >= 0; i-- {
+				if globMatch(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if name == "" {
+				return false
+			}
+		case '[':
+			end := strings.IndexByte(pattern, ']')
+			if end == -1 || name == "" {
+				return false
+			}
+			class := strings.Replace(pattern[:end+1], "[!", "[^", 1)
+			if ok, _ := path.Match(class, name[:1]); !ok {
+				return false
+			}
+			pattern, name = pattern[end+1:], name[1:]
+			continue
+		default:
+			if name == "" || name[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return name == ""
+}
+
+// FindInputSectionDesc returns the first input section description that
+// matches an input section, or nil if the section is an orphan.
+func (s *LinkerScript) FindInputSectionDesc(
+	file *ObjectFile, name string) *InputSectionDesc {
+	if !s.HasSections() {
+		return nil
+	}
+	for _, input := range s.Inputs {
+		if input.Matches(file, name) {
+			return input
+		}
+	}
+	return nil
+}
+
+// FindDesc returns the output section description with the given name.
+func (s *LinkerScript) FindDesc(name string) *OutputSectionDesc {
+	if !s.HasSections() {
+		return nil
+	}
+	for _, desc := range s.Descs {
+		if desc.Name == name && !desc.IsDiscard() {
+			return desc
+		}
+	}
+	return nil
+}
+
+// CreateOutputSections creates the output sections that contain no input
+// section, but define symbols or data.
+func (s *LinkerScript) CreateOutputSections(ctx *Context) {
+	for _, desc := range s.Descs {
+		if desc.Osec == nil && !desc.IsDiscard() && desc.NeedsOutputSection() {
+			desc.GetOutputSection(ctx, uint32(elf.SHT_PROGBITS),
+				uint64(elf.SHF_ALLOC|elf.SHF_WRITE))
+		}
+	}
+}
+
+func initPriority(name string) uint64 {
+	if idx := strings.LastIndexByte(name, '.'); idx != -1 {
+		if val, err := strconv.ParseUint(name[idx+1:], 10, 64); err == nil {
+			return val
+		}
+	}
+	return math.MaxUint64
+}
+
+// SortMembers orders the members of an output section as they are listed
+// in the script. Orphan sections come last.
+func (s *LinkerScript) SortMembers(osec *OutputSection) {
+	rank := func(isec *InputSection) int {
+		if isec.InputDesc == nil {
+			return math.MaxInt32
+		}
+		return isec.InputDesc.Idx
+	}
+
+	sort.SliceStable(osec.Members, func(i, j int) bool {
+		x, y := osec.Members[i], osec.Members[j]
+		if rank(x) != rank(y) || x.InputDesc == nil {
+			return rank(x) < rank(y)
+		}
+
+		switch x.InputDesc.Sort {
+		case SortByName:
+			return x.Name() < y.Name()
+		case SortByAlignment:
+			return x.P2Align > y.P2Align
+		case SortByInitPriority:
+			return initPriority(x.Name()) < initPriority(y.Name())
+		}
+		return false
+	})
+}
+
+// getRank returns the position of a chunk in the output. Chunks that are
+// not mentioned in the script are placed after the last output section
+// with the same kind of contents, as GNU ld does.
+func (s *LinkerScript) getRank(ctx *Context, chunk Chunker) int {
+	shdr := chunk.GetShdr()
+	switch {
+	case chunk == ctx.Shdr:
+		return math.MaxInt32
+	case chunk.Kind() == ChunkKindHeader:
+		return -1
+	case shdr.Flags&uint64(elf.SHF_ALLOC) == 0:
+		return math.MaxInt32 - 1
+	}
+
+	if desc := s.FindDesc(chunk.GetName()); desc != nil {
+		return desc.Idx * 2
+	}
+
+	class := func(shdr *Shdr) uint64 {
+		mask := uint64(elf.SHF_WRITE | elf.SHF_EXECINSTR | elf.SHF_TLS)
+		if shdr.Type == uint32(elf.SHT_NOBITS) {
+			return shdr.Flags&mask | 1<<63
+		}
+		return shdr.Flags & mask
+	}
+
+	best := -1
+	for _, desc := range s.Descs {
+		if desc.Osec != nil && class(&desc.Osec.Shdr) == class(shdr) {
+			best = desc.Idx
+		}
+	}
+	if best == -1 {
+		for _, desc := range s.Descs {
+			if desc.Osec != nil && (desc.Osec.Shdr.Flags^shdr.Flags)&
+				uint64(elf.SHF_WRITE) == 0 {
+				best = desc.Idx
+			}
+		}
+	}
+	if best == -1 {
+		return math.MaxInt32 - 2
+	}
+	return best*2 + 1
+}
+
+// SortChunks sorts the output chunks in the order of the script.
+func (s *LinkerScript) SortChunks(ctx *Context) {
+	for _, chunk := range ctx.Chunks {
+		s.ranks[chunk] = s.getRank(ctx, chunk)
+	}
+	sort.SliceStable(ctx.Chunks, func(i, j int) bool {
+		return s.ranks[ctx.Chunks[i]] < s.ranks[ctx.Chunks[j]]
+	})
+}
+
+func (s *LinkerScript) GetLoadAddr(chunk Chunker) uint64 {
+	if lma, ok := s.lmas[chunk]; ok {
+		return lma
+	}
+	return chunk.GetShdr().Addr
+}
+
+// GetPhdrs returns the names of the program headers a chunk is assigned
+// to with `:phdr`.
+func (s *LinkerScript) GetPhdrs(chunk Chunker) []string {
+	return s.chunkPhdrs[chunk]
+}
+
+// assign evaluates an assignment. It returns the new value of the
+// location counter. osec is the output section the assignment is in,
+// whose address is start, or nil if it is outside of output sections.
+func (s *LinkerScript) assign(ctx *Context, a *ScriptAssignment,
+	dot uint64, osec Chunker, start uint64) uint64 {
+	val := s.Eval(ctx, a.Expr, dot)
+
+	if a.Op != "=" {
+		cur := dot
+		if a.Name != "." {
+			cur, _ = s.getSymbolValue(ctx, a.Name)
+		}
+		val = s.Eval(ctx, &ScriptExpr{
+			Op:   strings.TrimSuffix(a.Op, "="),
+			Args: []*ScriptExpr{{Op: "num", Num: cur}, {Op: "num", Num: val}},
+		}, dot)
+	}
+
+	if a.Name != "." {
+		if a.Sym != nil {
+			s.values[a.Name] = val
+			a.Value = val
+			a.Section = osec
+		}
+		return dot
+	}
+
+	if osec == nil {
+		return val
+	}
+
+	// In an output section, a constant assigned to the location counter
+	// is an offset from the beginning of the section.
+	if a.Op == "=" && a.Expr.IsConstant() {
+		val += start
+	}
+	if val < dot {
+		utils.Fatal(fmt.Sprintf("linker script: %s: cannot move location "+
+			"counter backwards", osec.GetName()))
+	}
+	return val
+}
+
+// layoutOutputSection assigns offsets to the members of an output section
+// created by an output section description, and computes its size.
+func (s *LinkerScript) layoutOutputSection(ctx *Context, osec *OutputSection) {
+	start := osec.Shdr.Addr
+	dot := start
+	members := osec.Members
+	i := 0
+
+	place := func(isec *InputSection) {
+		dot = utils.AlignTo(dot, 1<<isec.P2Align)
+		isec.Offset = uint32(dot - start)
+		dot += uint64(isec.ShSize)
+	}
+
+	for _, cmd := range osec.ScriptDesc.Commands {
+		switch {
+		case cmd.Input != nil:
+			for ; i < len(members) && members[i].InputDesc == cmd.Input; i++ {
+				place(members[i])
+			}
+		case cmd.Assign != nil:
+			dot = s.assign(ctx, cmd.Assign, dot, osec, start)
+		case cmd.Data != nil:
+			cmd.Data.Offset = dot - start
+			cmd.Data.Value = s.Eval(ctx, cmd.Data.Expr, dot)
+			dot += uint64(cmd.Data.Size)
+		case cmd.Assert != nil:
+			cmd.Assert.Failed = s.Eval(ctx, cmd.Assert.Expr, dot) == 0
+		}
+	}
+
+	for ; i < len(members); i++ {
+		place(members[i])
+	}
+	osec.Shdr.Size = dot - start
+}
+
+// AssignAddresses evaluates the SECTIONS command to assign addresses to
+// the allocated chunks, which have been sorted by SortChunks.
+func (s *LinkerScript) AssignAddresses(ctx *Context) {
+	s.values = make(map[string]uint64)
+	for _, r := range s.Regions {
+		r.Cur = r.Origin
+	}
+
+	chunks := make([]Chunker, 0)
+	for _, chunk := range ctx.Chunks {
+		if chunk.Kind() != ChunkKindHeader &&
+			chunk.GetShdr().Flags&uint64(elf.SHF_ALLOC) != 0 {
+			chunks = append(chunks, chunk)
+		}
+	}
+
+	dot := uint64(0)
+	var region, lmaRegion *MemoryRegion
+	var phdrs []string
+	lmaOffset := uint64(0)
+
+	place := func(chunk Chunker, desc *OutputSectionDesc) {
+		shdr := chunk.GetShdr()
+
+		if desc != nil {
+			region = nil
+			lmaRegion = nil
+			lmaOffset = 0
+
+			switch {
+			case desc.Addr != nil:
+				dot = s.Eval(ctx, desc.Addr, dot)
+			case desc.Region != "":
+				region = s.findRegion(desc.Region)
+				dot = region.Cur
+			}
+			if desc.Align != nil {
+				dot = utils.AlignTo(dot, s.Eval(ctx, desc.Align, dot))
+			}
+			if desc.LmaRegion != "" {
+				lmaRegion = s.findRegion(desc.LmaRegion)
+			}
+			if len(desc.Phdrs) > 0 {
+				phdrs = desc.Phdrs
+			}
+		}
+
+		addr := utils.AlignTo(dot, shdr.AddrAlign)
+		shdr.Addr = addr
+		if osec, ok := chunk.(*OutputSection); ok && osec.ScriptDesc != nil {
+			s.layoutOutputSection(ctx, osec)
+		}
+
+		if desc != nil {
+			switch {
+			case desc.Lma != nil:
+				lmaOffset = s.Eval(ctx, desc.Lma, addr) - addr
+			case lmaRegion != nil:
+				lmaOffset = utils.AlignTo(lmaRegion.Cur, shdr.AddrAlign) - addr
+			}
+		}
+
+		s.lmas[chunk] = addr + lmaOffset
+		s.chunkPhdrs[chunk] = phdrs
+
+		// TLS BSS does not occupy address space in the image.
+		if isTbss(chunk) {
+			return
+		}
+
+		dot = addr + shdr.Size
+		if region != nil {
+			region.Cur = dot
+		}
+		if lmaRegion != nil && shdr.Type != uint32(elf.SHT_NOBITS) {
+			lmaRegion.Cur = addr + lmaOffset + shdr.Size
+		}
+	}
+
+	i := 0
+	for _, cmd := range s.Commands {
+		switch {
+		case cmd.Assign != nil:
+			dot = s.assign(ctx, cmd.Assign, dot, nil, 0)
+		case cmd.Assert != nil:
+			cmd.Assert.Failed = s.Eval(ctx, cmd.Assert.Expr, dot) == 0
+		case cmd.Desc != nil && !cmd.Desc.IsDiscard():
+			rank := cmd.Desc.Idx * 2
+			first := true
+			for ; i < len(chunks) && s.ranks[chunks[i]] <= rank+1; i++ {
+				if s.ranks[chunks[i]] == rank && first {
+					place(chunks[i], cmd.Desc)
+					first = false
+				} else {
+					place(chunks[i], nil)
+				}
+			}
+		}
+	}
+
+	for ; i < len(chunks); i++ {
+		place(chunks[i], nil)
+	}
+}
+
+// AddSymbols defines the symbols assigned in the script. A symbol in
+// PROVIDE is defined only if it is referenced but not defined elsewhere.
+func (s *LinkerScript) AddSymbols(
+	ctx *Context, add func(name string, visibility elf.SymVis) *Symbol) {
+	if s == nil {
+		return
+	}
+
+	defined := make(map[string]*Symbol)
+	for _, a := range s.Assignments {
+		if a.Name == "." {
+			continue
+		}
+		if sym, ok := defined[a.Name]; ok {
+			a.Sym = sym
+			continue
+		}
+
+		if a.Provide {
+			sym, ok := ctx.SymbolMap[a.Name]
+			if !ok || sym.File != nil {
+				continue
+			}
+		}
+
+		visibility := elf.STV_DEFAULT
+		if a.Hidden {
+			visibility = elf.STV_HIDDEN
+		}
+		a.Sym = add(a.Name, visibility)
+		defined[a.Name] = a.Sym
+	}
+}
+
+// Snapshot returns the values that expressions in the script may refer
+// to: the values of the symbols assigned in the script, and the
+// addresses, sizes and load addresses of the chunks. AssignAddresses
+// evaluates forward references with the values of its previous call, so
+// its result is final only if the snapshot is the same before and after
+// the call. It may be called on a nil script.
+func (s *LinkerScript) Snapshot(ctx *Context) []uint64 {
+	if !s.HasSections() {
+		return nil
+	}
+
+	vals := make([]uint64, 0, len(s.Assignments)+len(ctx.Chunks)*3)
+	for _, a := range s.Assignments {
+		vals = append(vals, a.Value)
+	}
+	for _, chunk := range ctx.Chunks {
+		vals = append(vals, chunk.GetShdr().Addr, chunk.GetShdr().Size,
+			s.GetLoadAddr(chunk))
+	}
+	return vals
+}
+
+// FixSymbols sets the values of the symbols assigned in the script to
+// those computed by the last AssignAddresses.
+func (s *LinkerScript) FixSymbols() {
+	if s == nil {
+		return
+	}
+
+	for _, a := range s.Assignments {
+		if a.Sym != nil {
+			a.Sym.SetOutputSection(a.Section)
+			a.Sym.Value = a.Value
+		}
+	}
+}
+
+// Check reports memory regions that are too small for their sections and
+// failed assertions.
+func (s *LinkerScript) Check() {
+	if s == nil {
+		return
+	}
+
+	for _, r := range s.Regions {
+		if r.Cur > r.End() {
+			utils.Error(fmt.Sprintf("region `%s' overflowed by %d bytes",
+				r.Name, r.Cur-r.End()))
+		}
+	}
+
+	check := func(cmds []*ScriptCommand) {
+		for _, cmd := range cmds {
+			if cmd.Assert != nil && cmd.Assert.Failed {
+				utils.Error(cmd.Assert.Msg)
+			}
+		}
+	}
+
+	check(s.Commands)
+	for _, desc := range s.Descs {
+		check(desc.Commands)
+	}
+}
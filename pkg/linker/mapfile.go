@@ -0,0 +1,151 @@
+package linker
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/ksco/rvld/pkg/utils"
+	"io"
+	"os"
+	"sort"
+)
+
+// PrintMap writes the link map to the -Map file, or to stdout for
+// --print-map. It lists the archive members that were linked along with
+// the reason why, followed by the output chunks, the input sections in
+// them and the global symbols they define.
+func PrintMap(ctx *Context) {
+	var out io.Writer = os.Stdout
+	if ctx.Arg.Map != "" {
+		file, err := os.Create(ctx.Arg.Map)
+		if err != nil {
+			utils.Fatal(fmt.Sprintf("cannot open %s: %s", ctx.Arg.Map, err))
+		}
+		defer file.Close()
+		out = file
+	}
+
+	w := bufio.NewWriter(out)
+	printArchiveMembers(ctx, w)
+	printChunks(ctx, w)
+	if err := w.Flush(); err != nil {
+		utils.Fatal(fmt.Sprintf("%s: write failed: %s", ctx.Arg.Map, err))
+	}
+}
+
+func printArchiveMembers(ctx *Context, w io.Writer) {
+	header := false
+	for _, file := range ctx.Objs {
+		if file.ExtractedBy == nil {
+			continue
+		}
+		if !header {
+			fmt.Fprintln(w, "Archive members linked to satisfy references")
+			fmt.Fprintln(w)
+			header = true
+		}
+		fmt.Fprintf(w, "%s: pulled in by symbol %s from file %s\n",
+			file, file.ExtractedBy.Name, file.ExtractedFrom)
+	}
+	if header {
+		fmt.Fprintln(w)
+	}
+}
+
+func printChunks(ctx *Context, w io.Writer) {
+	// Global symbols by the input section or, for symbols in merged
+	// sections and synthetic symbols, by the chunk that defines them.
+	isecSyms := make(map[*InputSection][]*Symbol)
+	chunkSyms := make(map[Chunker][]*Symbol)
+	for _, file := range ctx.Objs {
+		for _, sym := range file.GetGlobalSyms() {
+			if sym.File != file {
+				continue
+			}
+			switch {
+			case sym.SectionFragment != nil:
+				if sym.SectionFragment.IsAlive {
+					osec := sym.SectionFragment.OutputSection
+					chunkSyms[osec] = append(chunkSyms[osec], sym)
+				}
+			case sym.InputSection != nil:
+				if sym.InputSection.IsAlive {
+					isecSyms[sym.InputSection] = append(isecSyms[sym.InputSection], sym)
+				}
+			case sym.OutputSection != nil:
+				chunkSyms[sym.OutputSection] = append(chunkSyms[sym.OutputSection], sym)
+			}
+		}
+	}
+
+	getAddr := func(sym *Symbol) uint64 {
+		// With -r, input sections are placed by CombineObjects, and all
+		// sections are at address zero.
+		if ctx.Arg.Relocatable && sym.InputSection != nil {
+			return uint64(sym.InputSection.Offset) + sym.Value
+		}
+		return sym.GetAddr(ctx)
+	}
+
+	printSyms := func(syms []*Symbol) {
+		sort.SliceStable(syms, func(i, j int) bool {
+			x, y := getAddr(syms[i]), getAddr(syms[j])
+			if x != y {
+				return x < y
+			}
+			return syms[i].Name < syms[j].Name
+		})
+		for _, sym := range syms {
+			fmt.Fprintf(w, "%16x %10s %10s %5s                 %s\n",
+				getAddr(sym), "", "", "", sym.Name)
+		}
+	}
+
+	printMembers := func(shdr *Shdr, members []*InputSection) {
+		for _, isec := range members {
+			fmt.Fprintf(w, "%16x %10x %10x %5d         %s\n",
+				shdr.Addr+uint64(isec.Offset), shdr.Offset+uint64(isec.Offset),
+				isec.ShSize, uint64(1)<<isec.P2Align, isec)
+			printSyms(isecSyms[isec])
+		}
+	}
+
+	fmt.Fprintf(w, "%16s %10s %10s %5s %s\n",
+		"Address", "Offset", "Size", "Align", "Chunk / Input section / Symbol")
+
+	for _, chunk := range ctx.Chunks {
+		shdr := chunk.GetShdr()
+		fmt.Fprintf(w, "%16x %10x %10x %5d %s\n",
+			shdr.Addr, shdr.Offset, shdr.Size, shdr.AddrAlign, chunkName(chunk))
+
+		switch c := chunk.(type) {
+		case *OutputSection:
+			printMembers(shdr, c.Members)
+		case *ROutputSection:
+			printMembers(shdr, c.Members)
+		case *MergedSection:
+			n := 0
+			for _, frag := range c.Map {
+				if frag.IsAlive {
+					n++
+				}
+			}
+			fmt.Fprintf(w, "%16s %10s %10s %5s         <fragments: %d>\n",
+				"", "", "", "", n)
+		}
+		printSyms(chunkSyms[chunk])
+	}
+}
+
+// chunkName returns the name of a chunk for the link map. The headers
+// have no section name.
+func chunkName(chunk Chunker) string {
+	switch chunk.(type) {
+	case *OutputEhdr:
+		return "<ELF header>"
+	case *OutputPhdr:
+		return "<program headers>"
+	case *OutputShdr:
+		return "<section headers>"
+	}
+	return chunk.GetName()
+}
@@ -0,0 +1,15 @@
+package linker
+
+// MemoryRegion is a region declared in the MEMORY command of a linker
+// script. Cur is the next free address in the region during layout.
+type MemoryRegion struct {
+	Name   string
+	Attrs  string
+	Origin uint64
+	Length uint64
+	Cur    uint64
+}
+
+func (r *MemoryRegion) End() uint64 {
+	return r.Origin + r.Length
+}
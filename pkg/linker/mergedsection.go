@@ -4,11 +4,14 @@ import (
 	"debug/elf"
 	"github.com/ksco/rvld/pkg/utils"
 	"sort"
+	"sync"
 )
 
 type MergedSection struct {
 	Chunk
 	Map map[string]*SectionFragment
+
+	mu sync.Mutex
 }
 
 func NewMergedSection(name string, flags uint64, typ uint32) *MergedSection {
@@ -24,9 +27,12 @@ func NewMergedSection(name string, flags uint64, typ uint32) *MergedSection {
 
 func GetMergedSectionInstance(ctx *Context, name string, typ uint32, flags uint64) *MergedSection {
 	name = GetOutputName(name, flags)
-	flags = flags & ^uint64(elf.SHF_GROUP) & ^uint64(elf.SHF_MERGE) &
+	flags = CanonicalizeFlags(name, flags) & ^uint64(elf.SHF_GROUP) & ^uint64(elf.SHF_MERGE) &
 		^uint64(elf.SHF_STRINGS) & ^uint64(elf.SHF_COMPRESSED)
 
+	ctx.mergedSectionsMu.Lock()
+	defer ctx.mergedSectionsMu.Unlock()
+
 	find := func() *MergedSection {
 		for _, osec := range ctx.MergedSections {
 			if name == osec.Name && flags == osec.Shdr.Flags && typ == osec.Shdr.Type {
@@ -46,6 +52,9 @@ func GetMergedSectionInstance(ctx *Context, name string, typ uint32, flags uint6
 }
 
 func (m *MergedSection) Insert(key string, p2align uint32) *SectionFragment {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	fragment, ok := m.Map[key]
 	if !ok {
 		fragment = NewSectionFragment(m)
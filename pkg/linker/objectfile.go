@@ -3,6 +3,7 @@ package linker
 import (
 	"bytes"
 	"debug/elf"
+	"fmt"
 	"github.com/ksco/rvld/pkg/utils"
 	"math"
 	"sort"
@@ -17,11 +18,42 @@ type ObjectFile struct {
 
 	SymtabSec      *Shdr
 	SymtabShndxSec []uint32
+	ComdatGroups   []ComdatGroupRef
+
+	Cies []CieRecord
+	Fdes []FdeRecord
+
+	LocalSymtabIdx  int64
+	GlobalSymtabIdx int64
+	NumLocalSymtab  int64
+	NumGlobalSymtab int64
+	StrtabOffset    int64
+	StrtabSize      int64
+
+	NumDynrel    uint64
+	ReldynOffset uint64
+
+	// InLib is true for archive members that are linked only if they
+	// are needed. Files in the same archive or in the same
+	// --start-group and --end-group have the same Group.
+	InLib bool
+	Group int64
+
+	// For an archive member, the symbol that caused it to be linked and
+	// the file that referred to the symbol. They are shown in the link
+	// map.
+	ExtractedBy   *Symbol
+	ExtractedFrom *InputFile
+
+	// LineTable is read from the debug info when it is first needed to
+	// report a source location.
+	LineTable *LineTable
 }
 
 func NewObjectFile(file *File, inLib bool) *ObjectFile {
 	o := &ObjectFile{InputFile: *NewInputFile(file)}
 	o.IsAlive = !inLib
+	o.InLib = inLib
 	return o
 }
 
@@ -38,8 +70,12 @@ func (o *ObjectFile) parse(ctx *Context) {
 	o.initializeSections(ctx)
 	o.initializeSymbols(ctx)
 	o.sortRelocations()
-	o.initializeMergeableSections(ctx)
-	o.skipEhframeSections(ctx)
+
+	// Relocatable output keeps mergeable sections as they are.
+	if !ctx.Arg.Relocatable {
+		o.initializeMergeableSections(ctx)
+	}
+	o.initializeEhFrameSections()
 }
 
 func (o *ObjectFile) initializeSections(ctx *Context) {
@@ -54,7 +90,7 @@ func (o *ObjectFile) initializeSections(ctx *Context) {
 
 		switch elf.SectionType(shdr.Type) {
 		case elf.SHT_GROUP:
-			// Ignore
+			o.initializeComdatGroup(ctx, shdr)
 		case elf.SHT_SYMTAB_SHNDX:
 			o.FillUpSymtabShndxSec(shdr)
 		case elf.SHT_SYMTAB, elf.SHT_STRTAB, elf.SHT_REL, elf.SHT_RELA,
@@ -81,7 +117,7 @@ func (o *ObjectFile) initializeSections(ctx *Context) {
 		}
 
 		if shdr.Info >= uint32(len(o.Sections)) {
-			utils.Fatal("invalid relocated section index")
+			utils.Fatal(fmt.Sprintf("%s: invalid relocated section index: %d", o, shdr.Info))
 		}
 
 		if target := o.Sections[shdr.Info]; target != nil {
@@ -91,6 +127,43 @@ func (o *ObjectFile) initializeSections(ctx *Context) {
 	}
 }
 
+func (o *ObjectFile) initializeComdatGroup(ctx *Context, shdr *Shdr) {
+	if shdr.Info >= uint32(len(o.ElfSyms)) {
+		utils.Fatal(fmt.Sprintf("%s: invalid symbol index in section group: %d",
+			o, shdr.Info))
+	}
+
+	bs := o.GetBytesFromShdr(shdr)
+	entries := make([]uint32, 0, len(bs)/4)
+	for len(bs) >= 4 {
+		entries = append(entries, utils.Read[uint32](bs))
+		bs = bs[4:]
+	}
+
+	if len(entries) == 0 {
+		utils.Fatal(fmt.Sprintf("%s: empty section group", o))
+	}
+
+	// Only COMDAT groups are deduplicated; other groups are just a set
+	// of sections that are kept together.
+	if entries[0]&GRP_COMDAT == 0 {
+		return
+	}
+
+	esym := &o.ElfSyms[shdr.Info]
+	signature := getName(o.SymbolStrtab, esym.Name)
+	if signature == "" && esym.Type() == uint8(elf.STT_SECTION) {
+		signature = getName(o.ShStrtab,
+			o.ElfSections[o.GetShndx(esym, int64(shdr.Info))].Name)
+	}
+
+	o.ComdatGroups = append(o.ComdatGroups, ComdatGroupRef{
+		Group:   GetComdatGroupInstance(ctx, signature),
+		Members: entries[1:],
+		SymIdx:  shdr.Info,
+	})
+}
+
 func (o *ObjectFile) initializeSymbols(ctx *Context) {
 	if o.SymtabSec == nil {
 		return
@@ -106,7 +179,8 @@ func (o *ObjectFile) initializeSymbols(ctx *Context) {
 	for i := int64(1); i < o.FirstGlobal; i++ {
 		esym := &o.ElfSyms[i]
 		if esym.IsCommon() {
-			utils.Fatal("common local symbol?")
+			utils.Fatal(fmt.Sprintf("%s: common local symbol: %s", o,
+				getName(o.SymbolStrtab, esym.Name)))
 		}
 
 		name := getName(o.SymbolStrtab, esym.Name)
@@ -147,6 +221,7 @@ func (o *ObjectFile) sortRelocations() {
 			continue
 		}
 
+		// This sorts the relocations in the input file's contents.
 		rels := isec.GetRels()
 		sort.SliceStable(rels, func(i, j int) bool {
 			return rels[i].Offset < rels[j].Offset
@@ -180,7 +255,8 @@ func splitSection(ctx *Context, isec *InputSection) *MergeableSection {
 		for len(data) > 0 {
 			end := findNull(data, int(shdr.EntSize))
 			if end == -1 {
-				utils.Fatal("string is not null terminated")
+				utils.Fatal(fmt.Sprintf("%s: string is not null terminated",
+					isec.Location(offset)))
 			}
 
 			substr := data[:uint64(end)+shdr.EntSize]
@@ -191,7 +267,7 @@ func splitSection(ctx *Context, isec *InputSection) *MergeableSection {
 		}
 	} else {
 		if uint64(len(data))%shdr.EntSize != 0 {
-			utils.Fatal("section size is not multiple of entsize")
+			utils.Fatal(fmt.Sprintf("%s: section size is not multiple of entsize", isec))
 		}
 		for len(data) > 0 {
 			substr := data[:shdr.EntSize]
@@ -218,26 +294,123 @@ func (o *ObjectFile) initializeMergeableSections(ctx *Context) {
 	}
 }
 
-func (o *ObjectFile) skipEhframeSections(ctx *Context) {
+func (o *ObjectFile) initializeEhFrameSections() {
 	for i := 0; i < len(o.Sections); i++ {
 		isec := o.Sections[i]
 		if isec != nil && isec.IsAlive && isec.Name() == ".eh_frame" {
+			o.readEhFrame(isec)
 			isec.IsAlive = false
 		}
 	}
+
+	// Sort FDEs by the section they describe, so that each section can
+	// refer to its FDEs as a contiguous range.
+	getShndx := func(fde *FdeRecord) int64 {
+		idx := int64(fde.GetRels()[0].Sym)
+		return o.GetShndx(&o.ElfSyms[idx], idx)
+	}
+
+	sort.SliceStable(o.Fdes, func(i, j int) bool {
+		return getShndx(&o.Fdes[i]) < getShndx(&o.Fdes[j])
+	})
+
+	for i := 0; i < len(o.Fdes); {
+		isec := o.Sections[getShndx(&o.Fdes[i])]
+		isec.FdeBegin = uint32(i)
+		for i < len(o.Fdes) && o.Sections[getShndx(&o.Fdes[i])] == isec {
+			i++
+		}
+		isec.FdeEnd = uint32(i)
+	}
 }
 
-func (o *ObjectFile) FillUpSymtabShndxSec(s *Shdr) {
-	bs := o.InputFile.GetBytesFromShdr(s)
-	nums := len(bs) / int(unsafe.Sizeof(uint32(1)))
-	o.SymtabShndxSec = make([]uint32, 0)
-	for nums > 0 {
-		o.SymtabShndxSec = append(o.SymtabShndxSec, utils.Read[uint32](bs))
-		bs = bs[4:]
-		nums--
+func (o *ObjectFile) readEhFrame(isec *InputSection) {
+	rels := isec.GetRels()
+	data := isec.Contents
+	cies := make(map[uint32]uint32)
+	fdes := make([]FdeRecord, 0)
+	cieOffsets := make([]uint32, 0)
+
+	relIdx := uint32(0)
+	for offset := uint32(0); offset < uint32(len(data)); {
+		size := utils.Read[uint32](data[offset:])
+		if size == 0 {
+			break
+		}
+		if size == math.MaxUint32 {
+			utils.Fatal(fmt.Sprintf("%s: 64-bit .eh_frame records are not supported",
+				isec.Location(uint64(offset))))
+		}
+
+		begin := offset
+		end := offset + size + 4
+		if end > uint32(len(data)) {
+			utils.Fatal(fmt.Sprintf("%s: .eh_frame record extends past the end of the section",
+				isec.Location(uint64(offset))))
+		}
+
+		relBegin := relIdx
+		for relIdx < uint32(len(rels)) && rels[relIdx].Offset < uint64(end) {
+			relIdx++
+		}
+
+		id := utils.Read[uint32](data[begin+4:])
+		if id == 0 {
+			cies[begin] = uint32(len(o.Cies))
+			o.Cies = append(o.Cies, CieRecord{
+				File:         o,
+				InputSection: isec,
+				InputOffset:  begin,
+				RelBegin:     relBegin,
+				RelEnd:       relIdx,
+			})
+		} else {
+			fde := NewFdeRecord(isec, begin, relBegin)
+			fde.RelEnd = relIdx
+			fdes = append(fdes, fde)
+			cieOffsets = append(cieOffsets, begin+4-id)
+		}
+
+		offset = end
+	}
+
+	for i := range fdes {
+		fde := &fdes[i]
+		cieIdx, ok := cies[cieOffsets[i]]
+		if !ok {
+			utils.Fatal(fmt.Sprintf("%s: bad FDE: CIE not found",
+				isec.Location(uint64(fde.InputOffset))))
+		}
+		fde.CieIdx = cieIdx
+
+		// An FDE without relocations doesn't describe any code we link.
+		if fde.RelBegin == fde.RelEnd {
+			continue
+		}
+
+		rel := &rels[fde.RelBegin]
+		if rel.Offset-uint64(fde.InputOffset) != 8 {
+			utils.Fatal(fmt.Sprintf("%s: FDE's first relocation should have offset 8",
+				isec.Location(uint64(fde.InputOffset))))
+		}
+
+		esym := &o.ElfSyms[rel.Sym]
+		if esym.IsUndef() || esym.IsAbs() || esym.IsCommon() ||
+			o.GetSection(esym, int64(rel.Sym)) == nil {
+			continue
+		}
+		o.Fdes = append(o.Fdes, *fde)
 	}
 }
 
+func (o *ObjectFile) FillUpSymtabShndxSec(s *Shdr) {
+	o.SymtabShndxSec = utils.ReadSlice[uint32](o.InputFile.GetBytesFromShdr(s))
+}
+
+func (o *ObjectFile) IsRvc() bool {
+	return o.GetEhdr().Flags&EF_RISCV_RVC != 0
+}
+
 func (o *ObjectFile) GetSection(esym *Sym, idx int64) *InputSection {
 	return o.Sections[o.GetShndx(esym, idx)]
 }
@@ -279,6 +452,74 @@ func (o *ObjectFile) ResolveSymbols(ctx *Context) {
 	}
 }
 
+// CheckDuplicateSymbols reports global symbols that o defines strongly
+// but that are resolved to a strong definition in another object file.
+// Definitions in discarded COMDAT group members do not count.
+func (o *ObjectFile) CheckDuplicateSymbols(ctx *Context) {
+	for i := o.FirstGlobal; i < int64(len(o.ElfSyms)); i++ {
+		sym := o.Symbols[i]
+		esym := &o.ElfSyms[i]
+
+		if sym.File == nil || sym.File == o || sym.File == ctx.InternalObj ||
+			sym.File.IsDso || esym.IsUndef() || esym.IsCommon() || esym.IsWeak() ||
+			sym.IsWeak || sym.ElfSym().IsCommon() {
+			continue
+		}
+
+		if !o.isDefinedInLiveSection(esym, i) ||
+			!sym.File.isDefinedInLiveSection(sym.ElfSym(), int64(sym.SymIdx)) {
+			continue
+		}
+
+		utils.Error(fmt.Sprintf("duplicate symbol: %s%s%s", sym.Name,
+			sym.File.describeDefinition(int64(sym.SymIdx)), o.describeDefinition(i)))
+	}
+}
+
+func (o *ObjectFile) isDefinedInLiveSection(esym *Sym, idx int64) bool {
+	if esym.IsAbs() {
+		return true
+	}
+
+	shndx := o.GetShndx(esym, idx)
+	isec := o.Sections[shndx]
+	return isec != nil && (isec.IsAlive || o.MergeableSections[shndx] != nil)
+}
+
+func (o *ObjectFile) describeDefinition(idx int64) string {
+	esym := &o.ElfSyms[idx]
+	if esym.IsAbs() {
+		return fmt.Sprintf("\n>>> defined at %s", o)
+	}
+	return o.GetSection(esym, idx).Describe("defined at", esym.Val)
+}
+
+func (o *ObjectFile) ResolveComdatGroups() {
+	for _, ref := range o.ComdatGroups {
+		if o.Priority < ref.Group.Owner {
+			ref.Group.Owner = o.Priority
+		}
+	}
+}
+
+func (o *ObjectFile) EliminateDuplicateComdatGroups() {
+	for _, ref := range o.ComdatGroups {
+		if ref.Group.Owner == o.Priority {
+			continue
+		}
+
+		for _, idx := range ref.Members {
+			if idx >= uint32(len(o.Sections)) {
+				utils.Fatal(fmt.Sprintf("%s: invalid section index in section group: %d",
+					o, idx))
+			}
+			if isec := o.Sections[idx]; isec != nil {
+				isec.IsAlive = false
+			}
+		}
+	}
+}
+
 func (o *ObjectFile) MarkLiveObjects(ctx *Context, feeder func(*ObjectFile)) {
 	utils.Assert(o.IsAlive)
 
@@ -293,11 +534,20 @@ func (o *ObjectFile) MarkLiveObjects(ctx *Context, feeder func(*ObjectFile)) {
 		}
 
 		if sym.File == nil {
+			if esym.IsUndef() && sym.Lazy != nil {
+				if file := sym.Lazy.Load(ctx); file != nil {
+					file.ExtractedBy = sym
+					file.ExtractedFrom = &o.InputFile
+					feeder(file)
+				}
+			}
 			continue
 		}
 
 		keep := esym.IsUndef() || (esym.IsCommon() && !sym.ElfSym().IsCommon())
 		if keep && !sym.File.SwapIsAlive(true) {
+			sym.File.ExtractedBy = sym
+			sym.File.ExtractedFrom = &o.InputFile
 			feeder(sym.File)
 		}
 	}
@@ -317,7 +567,7 @@ func (o *ObjectFile) MergeVisibility(ctx *Context, sym *Symbol, visibility uint8
 		case uint8(elf.STV_DEFAULT):
 			return 3
 		}
-		utils.Fatal("unknown symbol visibility")
+		utils.Fatal(fmt.Sprintf("%s: %s: unknown symbol visibility", o, sym.Name))
 		return 0
 	}
 
@@ -349,7 +599,9 @@ func (o *ObjectFile) RegisterSectionPieces() {
 		sym := o.Symbols[i]
 		esym := &o.ElfSyms[i]
 
-		if esym.IsAbs() || esym.IsCommon() || esym.IsUndef() {
+		// Files are processed in parallel, so only the file that defines
+		// a global symbol may update it.
+		if sym.File != o || esym.IsAbs() || esym.IsCommon() || esym.IsUndef() {
 			continue
 		}
 
@@ -360,7 +612,7 @@ func (o *ObjectFile) RegisterSectionPieces() {
 
 		frag, fragOffset := m.GetFragment(uint32(esym.Val))
 		if frag == nil {
-			utils.Fatal("bad symbol value")
+			utils.Fatal(fmt.Sprintf("%s: %s: bad symbol value", o, sym.Name))
 		}
 		sym.SetSectionFragment(frag)
 		sym.Value = uint64(fragOffset)
@@ -403,7 +655,8 @@ func (o *ObjectFile) RegisterSectionPieces() {
 
 			frag, fragOffset := m.GetFragment(uint32(esym.Val) + uint32(r.Addend))
 			if frag == nil {
-				utils.Fatal("bad relocation")
+				utils.Fatal(fmt.Sprintf("%s: bad relocation against a mergeable section",
+					isec.Location(r.Offset)))
 			}
 
 			sym := &o.FragSyms[idx]
@@ -414,6 +667,8 @@ func (o *ObjectFile) RegisterSectionPieces() {
 			sym.SetSectionFragment(frag)
 			sym.Value = uint64(fragOffset) - uint64(r.Addend)
 
+			// Redirect the relocation, which is in the input file's
+			// contents, to the fragment symbol.
 			r.Sym = uint32(len(o.ElfSyms)) + uint32(idx)
 			idx++
 		}
@@ -433,13 +688,22 @@ func (o *ObjectFile) ComputeImportExport() {
 			continue
 		}
 
+		if sym.File != o && sym.File.IsDso {
+			sym.IsImported = true
+			continue
+		}
+
 		if sym.File == o {
 			sym.IsExported = true
 		}
 	}
 }
 
-func (o *ObjectFile) ClaimUnresolvedSymbols(ctx *Context) {
+// ClaimUnresolvedSymbols makes o define the symbols it refers to that are
+// left undefined, if they are allowed to be. strongRefs are the symbols
+// that some file refers to with a non-weak reference; such a symbol must
+// be reported instead of being resolved to zero by a weak reference.
+func (o *ObjectFile) ClaimUnresolvedSymbols(ctx *Context, strongRefs utils.MapSet[*Symbol]) {
 	if !o.IsAlive {
 		return
 	}
@@ -455,7 +719,11 @@ func (o *ObjectFile) ClaimUnresolvedSymbols(ctx *Context) {
 			continue
 		}
 
-		if esym.IsUndefWeak() {
+		// Shared objects may leave symbols undefined; they are resolved
+		// by the dynamic linker against the other loaded modules.
+		// Undefined symbols that are ignored resolve to zero otherwise.
+		if ignoreUndefinedInObjs(ctx) ||
+			(esym.IsUndefWeak() && !strongRefs.Contains(sym)) {
 			sym.File = o
 			sym.InputSection = nil
 			sym.OutputSection = nil
@@ -465,6 +733,7 @@ func (o *ObjectFile) ClaimUnresolvedSymbols(ctx *Context) {
 			sym.IsWeak = false
 			sym.IsExported = false
 			sym.VerIdx = ctx.DefaultVersion
+			sym.IsImported = ctx.Arg.Shared
 		}
 	}
 }
@@ -476,3 +745,98 @@ func (o *ObjectFile) ScanRelocations(ctx *Context) {
 		}
 	}
 }
+
+func shouldWriteToLocalSymtab(ctx *Context, sym *Symbol) bool {
+	if sym.ElfSym().Type() == uint8(elf.STT_SECTION) {
+		return false
+	}
+
+	if strings.HasPrefix(sym.Name, ".L") {
+		if ctx.Arg.DiscardLocals {
+			return false
+		}
+		if sym.SectionFragment != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (o *ObjectFile) ComputeSymtabSize(ctx *Context) {
+	isAlive := func(sym *Symbol) bool {
+		if sym.SectionFragment != nil {
+			return sym.SectionFragment.IsAlive
+		}
+		if sym.InputSection != nil {
+			return sym.InputSection.IsAlive
+		}
+		return true
+	}
+
+	if !ctx.Arg.DiscardAll {
+		for i := int64(1); i < o.FirstGlobal; i++ {
+			sym := o.Symbols[i]
+			if !o.ElfSyms[i].IsAbs() && sym.InputSection == nil &&
+				sym.SectionFragment == nil {
+				continue
+			}
+
+			if isAlive(sym) && shouldWriteToLocalSymtab(ctx, sym) {
+				o.StrtabSize += int64(len(sym.Name)) + 1
+				o.NumLocalSymtab++
+				sym.WriteToSymtab = true
+			}
+		}
+	}
+
+	for i := o.FirstGlobal; i < int64(len(o.ElfSyms)); i++ {
+		sym := o.Symbols[i]
+		if sym.File != o || !isAlive(sym) {
+			continue
+		}
+
+		o.StrtabSize += int64(len(sym.Name)) + 1
+		if sym.IsLocal() {
+			o.NumLocalSymtab++
+		} else {
+			o.NumGlobalSymtab++
+		}
+		sym.WriteToSymtab = true
+	}
+}
+
+func (o *ObjectFile) PopulateSymtab(ctx *Context) {
+	symtabBase := ctx.Buf[ctx.Symtab.Shdr.Offset:]
+	strtabBase := ctx.Buf[ctx.Strtab.Shdr.Offset:]
+	strtabOffset := o.StrtabOffset
+
+	write := func(sym *Symbol, idx int64) {
+		esym := toOutputEsym(ctx, sym, uint32(strtabOffset))
+		strtabOffset += writeString(strtabBase[strtabOffset:], sym.Name)
+		utils.Write[Sym](symtabBase[idx*int64(unsafe.Sizeof(Sym{})):], esym)
+	}
+
+	localIdx := o.LocalSymtabIdx
+	for i := int64(1); i < o.FirstGlobal; i++ {
+		if sym := o.Symbols[i]; sym.WriteToSymtab {
+			write(sym, localIdx)
+			localIdx++
+		}
+	}
+
+	globalIdx := o.GlobalSymtabIdx
+	for i := o.FirstGlobal; i < int64(len(o.ElfSyms)); i++ {
+		sym := o.Symbols[i]
+		if sym.File != o || !sym.WriteToSymtab {
+			continue
+		}
+
+		if sym.IsLocal() {
+			write(sym, localIdx)
+			localIdx++
+		} else {
+			write(sym, globalIdx)
+			globalIdx++
+		}
+	}
+}
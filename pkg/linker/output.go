@@ -8,7 +8,7 @@ import (
 var prefixes = []string{
 	".text.", ".data.rel.ro.", ".data.", ".rodata.", ".bss.rel.ro.", ".bss.",
 	".init_array.", ".fini_array.", ".tbss.", ".tdata.", ".gcc_except_table.",
-	".ctors.", ".dtors.",
+	".ctors.", ".dtors.", ".sdata.", ".sbss.",
 }
 
 func GetOutputName(name string, flags uint64) string {
@@ -21,6 +21,12 @@ func GetOutputName(name string, flags uint64) string {
 		}
 	}
 
+	// Small read-only data is folded into .sdata, as GNU ld does, so that
+	// it is within reach of __global_pointer$.
+	if name == ".srodata" || strings.HasPrefix(name, ".srodata.") {
+		return ".sdata"
+	}
+
 	for _, prefix := range prefixes {
 		stem := prefix[:len(prefix)-1]
 		if name == stem || strings.HasPrefix(name, prefix) {
@@ -41,3 +47,13 @@ func CanonicalizeType(name string, typ uint64) uint64 {
 	}
 	return typ
 }
+
+// CanonicalizeFlags returns the flags of the output section of the given
+// name. .sdata is writable even if some of its members, such as .srodata,
+// are not.
+func CanonicalizeFlags(name string, flags uint64) uint64 {
+	if name == ".sdata" {
+		return flags | uint64(elf.SHF_WRITE)
+	}
+	return flags
+}
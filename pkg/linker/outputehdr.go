@@ -1,9 +1,8 @@
 package linker
 
 import (
-	"bytes"
 	"debug/elf"
-	"encoding/binary"
+	"fmt"
 	"github.com/ksco/rvld/pkg/utils"
 	"unsafe"
 )
@@ -29,6 +28,17 @@ func (o *OutputEhdr) Kind() int {
 }
 
 func GetEntryAddr(ctx *Context) uint64 {
+	if sym, ok := ctx.SymbolMap[ctx.Arg.Entry]; ok &&
+		sym.File != nil && !sym.File.IsDso {
+		return sym.GetAddr(ctx)
+	}
+
+	if ctx.Arg.Shared {
+		return 0
+	}
+
+	utils.Warn(fmt.Sprintf("cannot find entry symbol %s; defaulting to .text",
+		ctx.Arg.Entry))
 	for _, osec := range ctx.OutputSections {
 		if osec.Name == ".text" {
 			return osec.Shdr.Addr
@@ -60,7 +70,6 @@ func GetFlags(ctx *Context) uint32 {
 }
 
 func (o *OutputEhdr) CopyBuf(ctx *Context) {
-	var err error
 	ehdr := &Ehdr{}
 	WriteMagic(ehdr.Ident[:])
 	ehdr.Ident[elf.EI_CLASS] = uint8(elf.ELFCLASS64)
@@ -68,21 +77,30 @@ func (o *OutputEhdr) CopyBuf(ctx *Context) {
 	ehdr.Ident[elf.EI_VERSION] = uint8(elf.EV_CURRENT)
 	ehdr.Ident[elf.EI_OSABI] = 0
 	ehdr.Ident[elf.EI_ABIVERSION] = 0
-	ehdr.Type = uint16(elf.ET_EXEC)
+	switch {
+	case ctx.Arg.Relocatable:
+		ehdr.Type = uint16(elf.ET_REL)
+	case ctx.Arg.Pic:
+		ehdr.Type = uint16(elf.ET_DYN)
+	default:
+		ehdr.Type = uint16(elf.ET_EXEC)
+	}
 	ehdr.Machine = uint16(elf.EM_RISCV)
 	ehdr.Version = uint32(elf.EV_CURRENT)
-	ehdr.Entry = GetEntryAddr(ctx)
-	ehdr.PhOff = ctx.Phdr.Shdr.Offset
 	ehdr.ShOff = ctx.Shdr.Shdr.Offset
 	ehdr.Flags = GetFlags(ctx)
 	ehdr.EhSize = uint16(unsafe.Sizeof(Ehdr{}))
-	ehdr.PhEntSize = uint16(unsafe.Sizeof(Phdr{}))
-	ehdr.PhNum = uint16(ctx.Phdr.Shdr.Size) / uint16(unsafe.Sizeof(Phdr{}))
+
+	// Relocatable output has neither an entry point nor program headers.
+	if !ctx.Arg.Relocatable {
+		ehdr.Entry = GetEntryAddr(ctx)
+		ehdr.PhOff = ctx.Phdr.Shdr.Offset
+		ehdr.PhEntSize = uint16(unsafe.Sizeof(Phdr{}))
+		ehdr.PhNum = uint16(ctx.Phdr.Shdr.Size) / uint16(unsafe.Sizeof(Phdr{}))
+	}
 	ehdr.ShEntSize = uint16(unsafe.Sizeof(Shdr{}))
 	ehdr.ShNum = uint16(ctx.Shdr.Shdr.Size) / uint16(unsafe.Sizeof(Shdr{}))
+	ehdr.ShStrndx = uint16(ctx.Shstrtab.Shndx)
 
-	buf := &bytes.Buffer{}
-	err = binary.Write(buf, binary.LittleEndian, ehdr)
-	utils.MustNo(err)
-	copy(ctx.Buf[o.Shdr.Offset:], buf.Bytes())
+	utils.Write[Ehdr](ctx.Buf[o.Shdr.Offset:], *ehdr)
 }
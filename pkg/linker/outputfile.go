@@ -0,0 +1,90 @@
+package linker
+
+import (
+	"fmt"
+	"github.com/ksco/rvld/pkg/utils"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// OutputFile is the file being written. Chunks are written directly to
+// a memory-mapped temporary file in the same directory as the output,
+// which replaces the output atomically once it is complete.
+type OutputFile struct {
+	Path    string
+	TmpPath string
+	File    *os.File
+	Buf     []byte
+
+	IsMapped bool
+}
+
+// OpenOutputFile creates the output file of the given size and makes
+// ctx.Buf refer to its contents.
+func OpenOutputFile(ctx *Context, size uint64) *OutputFile {
+	o := &OutputFile{Path: ctx.Arg.Output}
+
+	// Special files such as /dev/null can't be replaced, so they are
+	// written in the usual way.
+	if st, err := os.Stat(o.Path); err == nil && !st.Mode().IsRegular() {
+		o.Buf = make([]byte, size)
+		ctx.Buf = o.Buf
+		return o
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(o.Path), ".rvld-")
+	if err != nil {
+		utils.Fatal(fmt.Sprintf("cannot open %s: %s", o.Path, err))
+	}
+	o.File = file
+	o.TmpPath = file.Name()
+	utils.OnFatal(func() { os.Remove(o.TmpPath) })
+
+	if err := file.Truncate(int64(size)); err != nil {
+		utils.Fatal(fmt.Sprintf("%s: cannot resize: %s", o.TmpPath, err))
+	}
+
+	if size > 0 {
+		o.Buf, err = syscall.Mmap(int(file.Fd()), 0, int(size),
+			syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+		o.IsMapped = err == nil
+	}
+	if !o.IsMapped {
+		o.Buf = make([]byte, size)
+	}
+
+	ctx.Buf = o.Buf
+	return o
+}
+
+// Close writes the output file out and renames it to the output path.
+// The file is given the permissions in mode that the umask allows.
+func (o *OutputFile) Close(mode os.FileMode) {
+	if o.File == nil {
+		file, err := os.OpenFile(o.Path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+		utils.MustNo(err)
+		_, err = file.Write(o.Buf)
+		utils.MustNo(err)
+		utils.MustNo(file.Close())
+		return
+	}
+
+	if o.IsMapped {
+		utils.MustNo(syscall.Munmap(o.Buf))
+	} else {
+		_, err := o.File.Write(o.Buf)
+		utils.MustNo(err)
+	}
+
+	// A temporary file is created with mode 0600, so the permissions
+	// have to be set explicitly.
+	umask := syscall.Umask(0)
+	syscall.Umask(umask)
+	utils.MustNo(o.File.Chmod(mode &^ os.FileMode(umask)))
+
+	utils.MustNo(o.File.Close())
+	if err := os.Rename(o.TmpPath, o.Path); err != nil {
+		utils.Fatal(fmt.Sprintf("cannot rename %s to %s: %s", o.TmpPath, o.Path, err))
+	}
+}
@@ -1,9 +1,7 @@
 package linker
 
 import (
-	"bytes"
 	"debug/elf"
-	"encoding/binary"
 	"github.com/ksco/rvld/pkg/utils"
 	"math"
 	"unsafe"
@@ -34,6 +32,13 @@ func toPhdrFlags(chunk Chunker) uint32 {
 	return ret
 }
 
+func getLoadAddr(ctx *Context, chunk Chunker) uint64 {
+	if ctx.Script.HasSections() {
+		return ctx.Script.GetLoadAddr(chunk)
+	}
+	return chunk.GetShdr().Addr
+}
+
 func createPhdr(ctx *Context) []Phdr {
 	vec := make([]Phdr, 0)
 	define := func(typ, flags uint64, minAlign int64, chunk Chunker) {
@@ -49,7 +54,7 @@ func createPhdr(ctx *Context) []Phdr {
 			phdr.FileSize = chunk.GetShdr().Size
 		}
 		phdr.VAddr = chunk.GetShdr().Addr
-		phdr.PAddr = chunk.GetShdr().Addr
+		phdr.PAddr = getLoadAddr(ctx, chunk)
 		phdr.MemSize = chunk.GetShdr().Size
 	}
 
@@ -76,7 +81,68 @@ func createPhdr(ctx *Context) []Phdr {
 		chunk.SetExtraAddrAlign(1)
 	}
 
-	define(uint64(elf.PT_PHDR), uint64(elf.PF_R), 8, ctx.Phdr)
+	// If the linker script has a PHDRS command, we create exactly the
+	// segments it declares. A segment contains the sections assigned to
+	// it with `:phdr`.
+	if ctx.Script.HasSections() && len(ctx.Script.Phdrs) > 0 {
+		for _, pd := range ctx.Script.Phdrs {
+			members := make([]Chunker, 0)
+			for _, chunk := range ctx.Chunks {
+				for _, name := range ctx.Script.GetPhdrs(chunk) {
+					if name == pd.Name {
+						members = append(members, chunk)
+						break
+					}
+				}
+			}
+
+			switch {
+			case pd.Type == uint32(elf.PT_PHDR):
+				define(uint64(pd.Type), uint64(elf.PF_R), 8, ctx.Phdr)
+			case len(members) == 0:
+				vec = append(vec, Phdr{Type: pd.Type, Align: 1})
+			default:
+				flags := uint32(0)
+				for _, chunk := range members {
+					flags |= toPhdrFlags(chunk)
+				}
+
+				minAlign := int64(1)
+				if pd.Type == uint32(elf.PT_LOAD) {
+					minAlign = PageSize
+				}
+
+				define(uint64(pd.Type), uint64(flags), minAlign, members[0])
+				for _, chunk := range members[1:] {
+					push(chunk)
+				}
+
+				if pd.Type == uint32(elf.PT_LOAD) {
+					members[0].SetExtraAddrAlign(int64(vec[len(vec)-1].Align))
+				}
+				if pd.Type == uint32(elf.PT_TLS) {
+					ctx.TpAddr = vec[len(vec)-1].VAddr
+				}
+			}
+
+			phdr := &vec[len(vec)-1]
+			if pd.Flags != nil {
+				phdr.Flags = uint32(ctx.Script.Eval(ctx, pd.Flags, 0))
+			}
+			if pd.At != nil {
+				phdr.PAddr = ctx.Script.Eval(ctx, pd.At, 0)
+			}
+		}
+		return vec
+	}
+
+	if ctx.Phdr.Shdr.Flags&uint64(elf.SHF_ALLOC) != 0 {
+		define(uint64(elf.PT_PHDR), uint64(elf.PF_R), 8, ctx.Phdr)
+	}
+
+	if ctx.Interp != nil {
+		define(uint64(elf.PT_INTERP), uint64(elf.PF_R), 1, ctx.Interp)
+	}
 
 	end := len(ctx.Chunks)
 	for i := 0; i < end; {
@@ -102,9 +168,17 @@ func createPhdr(ctx *Context) []Phdr {
 			chunks = append(chunks, chunk)
 		}
 		chunks = utils.RemoveIf[Chunker](chunks, func(chunk Chunker) bool {
-			return isTbss(chunk)
+			return isTbss(chunk) || (chunk.Kind() == ChunkKindHeader &&
+				chunk.GetShdr().Flags&uint64(elf.SHF_ALLOC) == 0)
 		})
 
+		// Sections loaded from a different place than where they run
+		// need a segment of their own.
+		isContiguous := func(first, chunk Chunker) bool {
+			return getLoadAddr(ctx, chunk)-getLoadAddr(ctx, first) ==
+				chunk.GetShdr().Addr-first.GetShdr().Addr
+		}
+
 		end := len(chunks)
 		for i := 0; i < end; {
 			first := chunks[i]
@@ -119,6 +193,7 @@ func createPhdr(ctx *Context) []Phdr {
 			if !isBss(first) {
 				for i < end && !isBss(chunks[i]) &&
 					toPhdrFlags(chunks[i]) == flags &&
+					isContiguous(first, chunks[i]) &&
 					chunks[i].GetShdr().Offset-first.GetShdr().Offset == chunks[i].GetShdr().Addr-first.GetShdr().Addr {
 					push(chunks[i])
 					i++
@@ -126,7 +201,8 @@ func createPhdr(ctx *Context) []Phdr {
 			}
 
 			for i < end && isBss(chunks[i]) &&
-				toPhdrFlags(chunks[i]) == flags {
+				toPhdrFlags(chunks[i]) == flags &&
+				chunks[i].GetShdr().Addr >= first.GetShdr().Addr {
 				push(chunks[i])
 				i++
 			}
@@ -152,11 +228,26 @@ func createPhdr(ctx *Context) []Phdr {
 		ctx.TpAddr = phdr.VAddr
 	}
 
+	if ctx.Dynamic != nil && ctx.Dynamic.Shdr.Size > 0 {
+		define(uint64(elf.PT_DYNAMIC), uint64(toPhdrFlags(ctx.Dynamic)), 1, ctx.Dynamic)
+	}
+
+	if ctx.EhFrameHdr != nil && ctx.EhFrameHdr.Shdr.Size > 0 {
+		define(uint64(elf.PT_GNU_EH_FRAME), uint64(toPhdrFlags(ctx.EhFrameHdr)),
+			1, ctx.EhFrameHdr)
+	}
+
 	vec = append(vec, Phdr{})
 	phdr := &vec[len(vec)-1]
 	phdr.Type = uint32(elf.PT_GNU_STACK)
 	phdr.Flags = uint32(elf.PF_R) | uint32(elf.PF_W)
 
+	// A linker script decides the addresses, so RELRO can't be page
+	// aligned.
+	if ctx.Script.HasSections() {
+		return vec
+	}
+
 	for i := 0; i < len(ctx.Chunks); i++ {
 		if !isRelro(ctx, ctx.Chunks[i]) {
 			continue
@@ -190,8 +281,9 @@ func (o *OutputPhdr) Kind() int {
 }
 
 func (o *OutputPhdr) CopyBuf(ctx *Context) {
-	buf := &bytes.Buffer{}
-	err := binary.Write(buf, binary.LittleEndian, o.Phdrs)
-	utils.MustNo(err)
-	copy(ctx.Buf[o.Shdr.Offset:], buf.Bytes())
+	buf := ctx.Buf[o.Shdr.Offset:]
+	for _, phdr := range o.Phdrs {
+		utils.Write[Phdr](buf, phdr)
+		buf = buf[unsafe.Sizeof(Phdr{}):]
+	}
 }
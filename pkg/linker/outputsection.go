@@ -6,8 +6,9 @@ import (
 
 type OutputSection struct {
 	Chunk
-	Members []*InputSection
-	Idx     uint32
+	Members    []*InputSection
+	Idx        uint32
+	ScriptDesc *OutputSectionDesc
 }
 
 func NewOutputSection(name string, typ uint32, flags uint64, idx uint32) *OutputSection {
@@ -23,13 +24,23 @@ func GetOutputSectionInstance(
 	ctx *Context, name string, typ uint64, flags uint64) *OutputSection {
 	name = GetOutputName(name, flags)
 	typ = CanonicalizeType(name, typ)
+	flags = CanonicalizeFlags(name, flags)
 	flags = flags & ^uint64(elf.SHF_GROUP) & ^uint64(elf.SHF_COMPRESSED) &
-		^uint64(elf.SHF_LINK_ORDER)
+		^uint64(elf.SHF_LINK_ORDER) & ^uint64(SHF_GNU_RETAIN)
 
 	if typ == uint64(elf.SHT_INIT_ARRAY) || typ == uint64(elf.SHT_FINI_ARRAY) {
 		flags |= uint64(elf.SHF_WRITE)
 	}
 
+	// Orphan sections go to the output section of the same name in the
+	// linker script, if any.
+	if desc := ctx.Script.FindDesc(name); desc != nil {
+		return desc.GetOutputSection(ctx, uint32(typ), flags)
+	}
+
+	ctx.outputSectionsMu.Lock()
+	defer ctx.outputSectionsMu.Unlock()
+
 	find := func() *OutputSection {
 		for _, os := range ctx.OutputSections {
 			if name == os.Name && typ == uint64(os.Shdr.Type) &&
@@ -74,4 +85,14 @@ func (o *OutputSection) CopyBuf(ctx *Context) {
 			buf[j] = 0
 		}
 	}
+
+	if o.ScriptDesc != nil {
+		for _, cmd := range o.ScriptDesc.Commands {
+			if data := cmd.Data; data != nil {
+				for i := 0; i < data.Size; i++ {
+					buf[data.Offset+uint64(i)] = byte(data.Value >> (8 * i))
+				}
+			}
+		}
+	}
 }
@@ -2,10 +2,12 @@ package linker
 
 import (
 	"debug/elf"
+	"fmt"
 	"github.com/ksco/rvld/pkg/utils"
 	"math"
 	"sort"
 	"strings"
+	"sync/atomic"
 )
 
 func CreateInternalFile(ctx *Context) {
@@ -26,9 +28,16 @@ func ResolveSymbols(ctx *Context) {
 	for _, file := range ctx.Objs {
 		file.ResolveSymbols(ctx)
 	}
+	for _, file := range ctx.Dsos {
+		file.ResolveSymbols(ctx)
+	}
 
 	MarkLiveObjects(ctx)
 
+	if ctx.Arg.WarnBackrefs {
+		checkBackrefs(ctx)
+	}
+
 	for _, file := range ctx.Objs {
 		if !file.IsAlive {
 			file.ClearSymbols()
@@ -40,10 +49,42 @@ func ResolveSymbols(ctx *Context) {
 			file.ResolveSymbols(ctx)
 		}
 	}
+	for _, file := range ctx.Dsos {
+		file.ResolveSymbols(ctx)
+	}
 
 	ctx.Objs = utils.RemoveIf[*ObjectFile](ctx.Objs, func(file *ObjectFile) bool {
 		return !file.IsAlive
 	})
+
+	// Archive members loaded on demand are appended to ctx.Objs as they
+	// are needed. Put them back in the command line order.
+	getOrder := func(file *ObjectFile) uint32 {
+		if file == ctx.InternalObj {
+			return math.MaxUint32
+		}
+		return file.Priority
+	}
+	sort.SliceStable(ctx.Objs, func(i, j int) bool {
+		return getOrder(ctx.Objs[i]) < getOrder(ctx.Objs[j])
+	})
+}
+
+func EliminateComdats(ctx *Context) {
+	for _, file := range ctx.Objs {
+		file.ResolveComdatGroups()
+	}
+
+	for _, file := range ctx.Objs {
+		file.EliminateDuplicateComdatGroups()
+	}
+}
+
+func CheckDuplicateSymbols(ctx *Context) {
+	for _, file := range ctx.Objs {
+		file.CheckDuplicateSymbols(ctx)
+	}
+	utils.CheckErrors()
 }
 
 func MarkLiveObjects(ctx *Context) {
@@ -56,6 +97,12 @@ func MarkLiveObjects(ctx *Context) {
 
 	utils.Assert(len(roots) > 0)
 
+	for _, file := range ctx.Dsos {
+		file.MarkLiveObjects(ctx, func(o *ObjectFile) {
+			roots = append(roots, o)
+		})
+	}
+
 	for len(roots) > 0 {
 		file := roots[0]
 		if !file.IsAlive {
@@ -69,13 +116,68 @@ func MarkLiveObjects(ctx *Context) {
 	}
 }
 
-func RegisterSectionPieces(ctx *Context) {
+// checkBackrefs warns about archive members that are needed only by
+// files that come after the archive on the command line. A traditional
+// linker, which visits each archive once, would fail to link them.
+func checkBackrefs(ctx *Context) {
+	type backref struct {
+		file *ObjectFile
+		sym  *Symbol
+	}
+
+	backrefs := make(map[*ObjectFile]backref)
+	satisfied := make(map[*ObjectFile]bool)
+
 	for _, file := range ctx.Objs {
-		file.RegisterSectionPieces()
+		if !file.IsAlive {
+			continue
+		}
+
+		for i := file.FirstGlobal; i < int64(len(file.ElfSyms)); i++ {
+			esym := &file.ElfSyms[i]
+			sym := file.Symbols[i]
+			if !esym.IsUndef() || esym.IsWeak() || sym.File == nil ||
+				sym.File.IsDso || !sym.File.InLib {
+				continue
+			}
+
+			member := sym.File
+			if file.Priority < member.Priority ||
+				(file.Group != 0 && file.Group == member.Group) {
+				satisfied[member] = true
+			} else if _, ok := backrefs[member]; !ok {
+				backrefs[member] = backref{file, sym}
+			}
+		}
+	}
+
+	for _, member := range ctx.Objs {
+		ref, ok := backrefs[member]
+		if !ok || satisfied[member] {
+			continue
+		}
+		utils.Warn(fmt.Sprintf("backward reference detected: %s in %s refers to %s",
+			ref.sym.Name, ref.file.File.FullName(), member.File.FullName()))
 	}
 }
 
+func RegisterSectionPieces(ctx *Context) {
+	utils.ParallelForEach(ctx.Objs, ctx.Arg.Threads, func(file *ObjectFile) {
+		file.RegisterSectionPieces()
+	})
+}
+
 func ComputeImportExport(ctx *Context) {
+	// Symbols referenced by DSOs have to be visible to them at runtime.
+	for _, file := range ctx.Dsos {
+		for _, sym := range file.GetGlobalSyms() {
+			if sym.File != nil && !sym.File.IsDso &&
+				sym.Visibility != uint8(elf.STV_HIDDEN) {
+				sym.IsExported = true
+			}
+		}
+	}
+
 	for _, file := range ctx.Objs {
 		file.ComputeImportExport()
 	}
@@ -87,6 +189,11 @@ func ComputeMergedSectionSizes(ctx *Context) {
 			if m == nil {
 				continue
 			}
+			// With --gc-sections, GcSections has already marked the
+			// fragments that are in use.
+			if ctx.Arg.GcSections {
+				continue
+			}
 			for _, frag := range m.Fragments {
 				frag.IsAlive = true
 			}
@@ -108,7 +215,53 @@ func CreateSyntheticSections(ctx *Context) {
 	ctx.Phdr = push(NewOutputPhdr()).(*OutputPhdr)
 	ctx.Shdr = push(NewOutputShdr()).(*OutputShdr)
 
+	// When a linker script lays out the sections, the ELF headers are
+	// not part of any segment.
+	if ctx.Script.HasSections() {
+		ctx.Ehdr.Shdr.Flags = 0
+		ctx.Phdr.Shdr.Flags = 0
+	}
+
 	ctx.Got = push(NewGotSection()).(*GotSection)
+	ctx.EhFrame = push(NewEhFrameSection()).(*EhFrameSection)
+	if ctx.Arg.EhFrameHdr {
+		ctx.EhFrameHdr = push(NewEhFrameHdrSection()).(*EhFrameHdrSection)
+	}
+	if ctx.Arg.BuildId.Kind != BuildIdNone {
+		ctx.BuildId = push(NewBuildIdSection()).(*BuildIdSection)
+	}
+
+	// Dynamic sections are needed only if the output is position
+	// independent or links against shared objects.
+	if len(ctx.Dsos) > 0 || ctx.Arg.Pic || ctx.Arg.Shared {
+		if !ctx.Arg.IsStatic && !ctx.Arg.Shared && ctx.Arg.DynamicLinker != "" {
+			ctx.Interp = push(NewInterpSection()).(*InterpSection)
+		}
+
+		ctx.Dynamic = push(NewDynamicSection()).(*DynamicSection)
+		ctx.Dynsym = push(NewDynsymSection()).(*DynsymSection)
+		ctx.Dynstr = push(NewDynstrSection()).(*DynstrSection)
+		ctx.Hash = push(NewHashSection()).(*HashSection)
+		ctx.RelaDyn = push(NewRelaDynSection()).(*RelaDynSection)
+		ctx.RelaPlt = push(NewRelaPltSection()).(*RelaPltSection)
+		ctx.Plt = push(NewPltSection()).(*PltSection)
+		ctx.GotPlt = push(NewGotPltSection()).(*GotPltSection)
+		ctx.Copyrel = push(NewCopyrelSection()).(*CopyrelSection)
+
+		if ctx.Arg.Soname != "" {
+			ctx.Dynstr.AddString(ctx.Arg.Soname)
+		}
+		for _, file := range ctx.Dsos {
+			ctx.Dynstr.AddString(file.Soname)
+		}
+	}
+
+	if !ctx.Arg.StripAll {
+		ctx.Symtab = push(NewSymtabSection()).(*SymtabSection)
+		ctx.Strtab = push(NewStrtabSection()).(*StrtabSection)
+	}
+
+	ctx.Shstrtab = push(NewShstrtabSection()).(*ShstrtabSection)
 }
 
 func BinSections(ctx *Context) {
@@ -126,13 +279,21 @@ func BinSections(ctx *Context) {
 
 	for i, osec := range ctx.OutputSections {
 		osec.Members = group[i]
+		if osec.ScriptDesc != nil {
+			ctx.Script.SortMembers(osec)
+		}
 	}
 }
 
 func CollectOutputSections(ctx *Context) []Chunker {
+	if ctx.Script.HasSections() {
+		ctx.Script.CreateOutputSections(ctx)
+	}
+
 	osecs := make([]Chunker, 0)
 	for _, osec := range ctx.OutputSections {
-		if len(osec.Members) != 0 {
+		if len(osec.Members) != 0 ||
+			(osec.ScriptDesc != nil && osec.ScriptDesc.NeedsOutputSection()) {
 			osecs = append(osecs, osec)
 		}
 	}
@@ -151,19 +312,27 @@ func CollectOutputSections(ctx *Context) []Chunker {
 func AddSyntheticSymbols(ctx *Context) {
 	obj := ctx.InternalObj
 
-	add := func(name string) *Symbol {
+	addWithVisibility := func(name string, visibility elf.SymVis) *Symbol {
 		esym := Sym{
-			Info:  uint8(elf.STT_NOTYPE)<<4 | uint8(elf.STB_GLOBAL)&0xf,
+			Info:  uint8(elf.STB_GLOBAL)<<4 | uint8(elf.STT_NOTYPE),
 			Shndx: uint16(elf.SHN_ABS),
-			Other: uint8(elf.STV_HIDDEN) << 6,
+			Other: uint8(visibility),
 		}
 		ctx.InternalEsyms = append(ctx.InternalEsyms, esym)
 		sym := GetSymbolByName(ctx, name)
 		sym.Value = 0xdeadbeef
 		obj.Symbols = append(obj.Symbols, sym)
+
+		// Visibilities are merged by MarkLiveObjects, which has run
+		// before these symbols are created.
+		obj.MergeVisibility(ctx, sym, uint8(visibility))
 		return sym
 	}
 
+	add := func(name string) *Symbol {
+		return addWithVisibility(name, elf.STV_HIDDEN)
+	}
+
 	ctx.__InitArrayStart = add("__init_array_start")
 	ctx.__InitArrayEnd = add("__init_array_end")
 	ctx.__FiniArrayStart = add("__fini_array_start")
@@ -171,7 +340,28 @@ func AddSyntheticSymbols(ctx *Context) {
 	ctx.__PreinitArrayStart = add("__preinit_array_start")
 	ctx.__PreinitArrayEnd = add("__preinit_array_end")
 
-	ctx.__GlobalPointer = add("__global_pointer$")
+	if !isDefsym(ctx, "__global_pointer$") &&
+		!ctx.Script.Defines("__global_pointer$") {
+		ctx.__GlobalPointer = add("__global_pointer$")
+	}
+
+	if ctx.Dynamic != nil {
+		ctx._Dynamic = add("_DYNAMIC")
+	}
+
+	ctx.Script.AddSymbols(ctx, addWithVisibility)
+	if sym, ok := ctx.SymbolMap["__global_pointer$"]; ok &&
+		ctx.Script.Defines(sym.Name) {
+		ctx.__GlobalPointer = sym
+	}
+
+	for _, def := range ctx.Arg.Defsyms {
+		sym := addWithVisibility(def.Name, elf.STV_DEFAULT)
+		ctx.Defsyms = append(ctx.Defsyms, sym)
+		if def.Name == "__global_pointer$" {
+			ctx.__GlobalPointer = sym
+		}
+	}
 
 	obj.ElfSyms = ctx.InternalEsyms
 
@@ -179,52 +369,104 @@ func AddSyntheticSymbols(ctx *Context) {
 }
 
 func ClaimUnresolvedSymbols(ctx *Context) {
+	strongRefs := utils.NewMapSet[*Symbol]()
+	for _, file := range ctx.Objs {
+		for i := file.FirstGlobal; i < int64(len(file.ElfSyms)); i++ {
+			esym := &file.ElfSyms[i]
+			if esym.IsUndef() && !esym.IsWeak() {
+				strongRefs.Add(file.Symbols[i])
+			}
+		}
+	}
+
 	for _, file := range ctx.Objs {
-		file.ClaimUnresolvedSymbols(ctx)
+		file.ClaimUnresolvedSymbols(ctx, strongRefs)
 	}
 }
 
 func ScanRels(ctx *Context) {
-	for _, file := range ctx.Objs {
+	utils.ParallelForEach(ctx.Objs, ctx.Arg.Threads, func(file *ObjectFile) {
 		file.ScanRelocations(ctx)
+	})
+	utils.CheckErrors()
+
+	needsAux := func(sym *Symbol) bool {
+		return sym.Flags != 0 || sym.IsImported || sym.IsExported
 	}
 
 	syms := make([]*Symbol, 0)
 	for _, file := range ctx.Objs {
 		for _, sym := range file.Symbols {
-			if sym.File == file {
-				if sym.Flags != 0 || sym.IsExported {
-					syms = append(syms, sym)
-				}
+			if sym.File == file && needsAux(sym) {
+				syms = append(syms, sym)
 			}
 		}
 	}
-
-	ctx.SymbolsAux = make([]SymbolAux, 0, len(syms))
-
-	addAux := func(sym *Symbol) {
-		if sym.AuxIdx == -1 {
-			size := int32(len(ctx.SymbolsAux))
-			sym.AuxIdx = size
-			ctx.SymbolsAux = append(ctx.SymbolsAux, NewSymbolAux())
+	for _, file := range ctx.Dsos {
+		for _, sym := range file.Symbols {
+			if sym.File == &file.ObjectFile && needsAux(sym) {
+				syms = append(syms, sym)
+			}
 		}
 	}
 
+	ctx.SymbolsAux = make([]SymbolAux, 0, len(syms))
+
 	for _, sym := range syms {
-		addAux(sym)
+		addSymbolAux(ctx, sym)
+
+		if sym.IsImported || sym.IsExported {
+			ctx.Dynsym.AddSymbol(ctx, sym)
+		}
 
 		if sym.Flags&NEEDS_GOT != 0 {
 			ctx.Got.AddGotSymbol(ctx, sym)
 		}
 
+		if sym.Flags&NEEDS_CPLT != 0 {
+			// A canonical PLT entry serves as the address of the function,
+			// so DSOs must resolve the symbol to it as well.
+			sym.IsCanonical = true
+			ctx.Dynsym.AddSymbol(ctx, sym)
+		}
+
+		if sym.Flags&(NEEDS_PLT|NEEDS_CPLT) != 0 {
+			ctx.Plt.AddSymbol(ctx, sym)
+		}
+
 		if sym.Flags&NEEDS_GOTTP != 0 {
 			ctx.Got.AddGotTpSymbol(ctx, sym)
 		}
 
+		if sym.Flags&NEEDS_TLSGD != 0 {
+			ctx.Got.AddTlsGdSymbol(ctx, sym)
+		}
+
+		if sym.Flags&NEEDS_COPYREL != 0 {
+			ctx.Copyrel.AddSymbol(ctx, sym)
+		}
+
 		sym.Flags = 0
 	}
 }
 
+func addSymbolAux(ctx *Context, sym *Symbol) {
+	if sym.AuxIdx == -1 {
+		sym.AuxIdx = int32(len(ctx.SymbolsAux))
+		ctx.SymbolsAux = append(ctx.SymbolsAux, NewSymbolAux())
+	}
+}
+
+func ComputeSymtabSize(ctx *Context) {
+	if ctx.Symtab == nil {
+		return
+	}
+
+	for _, file := range ctx.Objs {
+		file.ComputeSymtabSize(ctx)
+	}
+}
+
 func ComputeSectionSizes(ctx *Context) {
 	for _, osec := range ctx.OutputSections {
 		offset := uint64(0)
@@ -260,6 +502,9 @@ func SortOutputSections(ctx *Context) {
 		if chunk == ctx.Phdr {
 			return 1
 		}
+		if chunk == ctx.Interp {
+			return 2
+		}
 		if typ == uint32(elf.SHT_NOTE) {
 			return 3
 		}
@@ -284,12 +529,20 @@ func SortOutputSections(ctx *Context) {
 			return -int32(chunk.GetShdr().AddrAlign)
 		}
 
+		// Small data sections are kept next to each other, between .got
+		// and .bss, so that __global_pointer$ can reach both.
+		if chunk.GetName() == ".sdata" {
+			return 3
+		}
 		if chunk.GetName() == ".toc" {
 			return 2
 		}
 		if chunk == ctx.Got {
 			return 1
 		}
+		if chunk.GetName() == ".sbss" {
+			return -1
+		}
 		return 0
 	}
 
@@ -302,15 +555,19 @@ func SortOutputSections(ctx *Context) {
 
 		return getRank2(ctx.Chunks[i]) < getRank2(ctx.Chunks[j])
 	})
-}
 
-func doSetOsecOffsets(ctx *Context) uint64 {
-	alignment := func(chunk Chunker) uint64 {
-		return uint64(math.Max(float64(chunk.GetExtraAddrAlign()),
-			float64(chunk.GetShdr().AddrAlign)))
+	if ctx.Script.HasSections() {
+		ctx.Script.SortChunks(ctx)
 	}
+}
 
-	addr := ImageBase
+func alignment(chunk Chunker) uint64 {
+	return uint64(math.Max(float64(chunk.GetExtraAddrAlign()),
+		float64(chunk.GetShdr().AddrAlign)))
+}
+
+func setOsecAddrs(ctx *Context) {
+	addr := ctx.Arg.ImageBase
 	for _, chunk := range ctx.Chunks {
 		if chunk.GetShdr().Flags&uint64(elf.SHF_ALLOC) == 0 {
 			continue
@@ -339,14 +596,38 @@ func doSetOsecOffsets(ctx *Context) uint64 {
 			i++
 		}
 	}
+}
+
+func doSetOsecOffsets(ctx *Context) uint64 {
+	if ctx.Script.HasSections() {
+		ctx.Script.AssignAddresses(ctx)
+	} else {
+		setOsecAddrs(ctx)
+	}
 
 	fileoff := uint64(0)
 	i := 0
+
+	// Headers that are not loaded are at the beginning of the file.
+	for ; i < len(ctx.Chunks) && ctx.Chunks[i].Kind() == ChunkKindHeader &&
+		ctx.Chunks[i].GetShdr().Flags&uint64(elf.SHF_ALLOC) == 0; i++ {
+		fileoff = utils.AlignTo(fileoff, ctx.Chunks[i].GetShdr().AddrAlign)
+		ctx.Chunks[i].GetShdr().Offset = fileoff
+		fileoff += ctx.Chunks[i].GetShdr().Size
+	}
+
 	for i < len(ctx.Chunks) && ctx.Chunks[i].GetShdr().Flags&uint64(elf.SHF_ALLOC) != 0 {
 		first := ctx.Chunks[i]
-		utils.Assert(first.GetShdr().Type != uint32(elf.SHT_NOBITS))
+		if first.GetShdr().Type == uint32(elf.SHT_NOBITS) {
+			first.GetShdr().Offset = fileoff
+			i++
+			continue
+		}
 
-		fileoff = utils.AlignTo(fileoff, alignment(first))
+		// The file offset of a segment has to be congruent to its address
+		// modulo the alignment.
+		fileoff = utils.AlignTo(fileoff, alignment(first)) +
+			first.GetShdr().Addr%alignment(first)
 
 		for {
 			ctx.Chunks[i].GetShdr().Offset = fileoff + ctx.Chunks[i].GetShdr().Addr - first.GetShdr().Addr
@@ -403,65 +684,218 @@ func SetOsecOffsets(ctx *Context) uint64 {
 	}
 }
 
-func shrinkSection(isec *InputSection) {
+// isRelaxable reports whether the relocation at rels[i] is paired with an
+// R_RISCV_RELAX, which permits the linker to rewrite the instructions.
+func isRelaxable(ctx *Context, rels []Rela, i int) bool {
+	return ctx.Arg.Relax && i+1 < len(rels) &&
+		rels[i+1].Type == uint32(elf.R_RISCV_RELAX) &&
+		rels[i+1].Offset == rels[i].Offset
+}
+
+func isInt(val uint64, bits int) bool {
+	return utils.SignExtend(val, bits-1) == val
+}
+
+// getCallTarget returns the address an R_RISCV_CALL(_PLT) jumps to.
+func getCallTarget(ctx *Context, sym *Symbol, rel *Rela) uint64 {
+	if sym.GetPltIdx(ctx) != -1 {
+		return sym.GetPltAddr(ctx) + uint64(rel.Addend)
+	}
+	return sym.GetAddr(ctx) + uint64(rel.Addend)
+}
+
+// relaxCall returns the number of bytes that can be removed from an
+// auipc+jalr pair. The pair becomes a c.j or a jal if the target is close
+// enough.
+func relaxCall(ctx *Context, isec *InputSection, rel *Rela, loc uint64) int32 {
+	sym := isec.File.Symbols[rel.Sym]
+	if sym.ElfSym().IsUndefWeak() && !sym.IsImported {
+		return 0
+	}
+
+	rd := utils.Bits(utils.Read[uint32](isec.Contents[rel.Offset+4:]), 11, 7)
+	dist := getCallTarget(ctx, sym, rel) - loc
+
+	if rd == 0 && isInt(dist, 12) && isec.File.IsRvc() {
+		return 6
+	}
+	if isInt(dist, 21) {
+		return 4
+	}
+	return 0
+}
+
+// relaxHi20 returns the number of bytes that can be removed from a lui
+// instruction. The lui is deleted if the paired lo12 instruction can
+// address the symbol relative to zero or to the global pointer, and it is
+// turned into a c.lui if the upper immediate is small.
+func relaxHi20(ctx *Context, isec *InputSection, rel *Rela) int32 {
+	sym := isec.File.Symbols[rel.Sym]
+	val := sym.GetAddr(ctx) + uint64(rel.Addend)
+
+	if isInt(val, 12) {
+		return 4
+	}
+	if canUseGp(ctx) && isInt(val-ctx.__GlobalPointer.GetAddr(ctx), 12) {
+		return 4
+	}
+
+	rd := utils.Bits(utils.Read[uint32](isec.Contents[rel.Offset:]), 11, 7)
+	imm := utils.SignExtend((val+0x800)>>12, 19)
+	if isec.File.IsRvc() && rd != 0 && rd != 2 && imm != 0 && isInt(imm, 6) {
+		return 2
+	}
+	return 0
+}
+
+// canUseGp reports whether lo12 instructions may be rewritten to address
+// data relative to __global_pointer$, which only the executable owns.
+func canUseGp(ctx *Context) bool {
+	if ctx.Arg.Shared {
+		return false
+	}
+	gp := ctx.__GlobalPointer
+	return gp != nil && gp.File != nil && gp.GetAddr(ctx) != 0
+}
+
+func shrinkSection(ctx *Context, isec *InputSection) {
 	rels := isec.GetRels()
 	isec.Deltas = make([]int32, len(rels)+1)
 
 	delta := int32(0)
-	times := 0
 	for i := 0; i < len(rels); i++ {
 		r := rels[i]
 		isec.Deltas[i] = delta
+		loc := isec.GetAddr() + r.Offset - uint64(delta)
 
-		if r.Type == uint32(elf.R_RISCV_ALIGN) {
-			times++
-			loc := isec.GetAddr() + r.Offset - uint64(delta)
+		switch elf.R_RISCV(r.Type) {
+		case elf.R_RISCV_ALIGN:
 			nextLoc := loc + uint64(r.Addend)
 			alignment := utils.BitCeil(uint64(r.Addend + 1))
 			delta += int32(nextLoc - utils.AlignTo(loc, alignment))
+		case elf.R_RISCV_CALL, elf.R_RISCV_CALL_PLT:
+			if isRelaxable(ctx, rels, i) {
+				delta += relaxCall(ctx, isec, &r, loc)
+			}
+		case elf.R_RISCV_HI20:
+			if isRelaxable(ctx, rels, i) {
+				delta += relaxHi20(ctx, isec, &r)
+			}
+		case elf.R_RISCV_TPREL_HI20, elf.R_RISCV_TPREL_ADD:
+			// If the offset from the thread pointer fits in 12 bits, the
+			// lo12 instruction can use tp directly as its base register.
+			sym := isec.File.Symbols[r.Sym]
+			if isRelaxable(ctx, rels, i) &&
+				isInt(sym.GetAddr(ctx)+uint64(r.Addend)-ctx.TpAddr, 12) {
+				delta += 4
+			}
 		}
 	}
 
 	isec.Deltas[len(rels)] = delta
-	isec.ShSize -= uint32(delta)
+	isec.ShSize = uint32(isec.Shdr().Size) - uint32(delta)
 }
 
+// ResizeSections removes the bytes freed by relaxation. Since shrinking a
+// section moves the code after it, which may in turn make more
+// relaxations possible, it repeats until the layout no longer changes.
 func ResizeSections(ctx *Context) uint64 {
 	isResizeable := func(isec *InputSection) bool {
 		return isec != nil && isec.IsAlive &&
 			isec.Shdr().Flags&uint64(elf.SHF_ALLOC) != 0 &&
 			isec.Shdr().Flags&uint64(elf.SHF_EXECINSTR) != 0
 	}
-	for _, file := range ctx.Objs {
-		for _, isec := range file.Sections {
-			if isResizeable(isec) {
-				shrinkSection(isec)
-			}
-		}
+
+	// Symbol values and sizes are always recomputed from those in the
+	// input file, as each pass may undo a relaxation of the previous one.
+	type extent struct {
+		value uint64
+		size  uint64
 	}
 
+	extents := make(map[*Symbol]extent)
 	for _, file := range ctx.Objs {
 		for _, sym := range file.Symbols {
-			if sym.File != file {
-				continue
+			if sym.File == file && isResizeable(sym.InputSection) {
+				extents[sym] = extent{sym.Value, sym.ElfSym().Size}
 			}
+		}
+	}
 
-			isec := sym.InputSection
-			if isec == nil || len(isec.Deltas) == 0 {
-				continue
+	const maxPasses = 32
+	fileoff := uint64(0)
+
+	// Linker script expressions may refer to sections and symbols that
+	// come later in the script, which are evaluated with their values
+	// from the previous layout. The layout is final only once those
+	// values stop changing too.
+	layout := ctx.Script.Snapshot(ctx)
+	scriptChanged := false
+
+	for pass := 0; ; pass++ {
+		if pass == maxPasses {
+			utils.Fatal("relaxation did not converge")
+		}
+
+		FixSyntheticSymbols(ctx)
+
+		// A section only changes its own deltas, so sections can be
+		// shrunk in parallel.
+		changed := atomic.Bool{}
+		utils.ParallelForEach(ctx.Objs, ctx.Arg.Threads, func(file *ObjectFile) {
+			for _, isec := range file.Sections {
+				if isResizeable(isec) {
+					deltas := isec.Deltas
+					shrinkSection(ctx, isec)
+					if !utils.IsEqual(deltas, isec.Deltas) {
+						changed.Store(true)
+					}
+				}
 			}
+		})
+
+		if pass > 0 && !changed.Load() && !scriptChanged {
+			return fileoff
+		}
 
+		// Returns the offset that an offset in isec is moved to.
+		getNewOffset := func(isec *InputSection, offset uint64) uint64 {
 			rels := isec.GetRels()
 			idx := sort.Search(len(rels), func(i int) bool {
-				return rels[i].Offset >= sym.Value
+				return rels[i].Offset >= offset
 			})
+			return offset - uint64(isec.Deltas[idx])
+		}
 
-			sym.Value -= uint64(isec.Deltas[idx])
+		for sym, e := range extents {
+			sym.Value = getNewOffset(sym.InputSection, e.value)
+			// The size is updated in the input file's symbol table,
+			// from which the output symbol tables are written.
+			if e.size > 0 {
+				end := getNewOffset(sym.InputSection, e.value+e.size)
+				sym.ElfSym().Size = end - sym.Value
+			}
 		}
+
+		ComputeSectionSizes(ctx)
+		fileoff = SetOsecOffsets(ctx)
+
+		snapshot := ctx.Script.Snapshot(ctx)
+		scriptChanged = !utils.IsEqual(layout, snapshot)
+		layout = snapshot
 	}
+}
 
-	ComputeSectionSizes(ctx)
-	return SetOsecOffsets(ctx)
+// CopyBuf writes the contents of all chunks to ctx.Buf. Chunks occupy
+// disjoint parts of the file, so they are written in parallel.
+func CopyBuf(ctx *Context) {
+	utils.ParallelForEach(ctx.Chunks, ctx.Arg.Threads, func(chunk Chunker) {
+		chunk.CopyBuf(ctx)
+	})
+}
+
+func CheckLinkerScript(ctx *Context) {
+	ctx.Script.Check()
 }
 
 func FixSyntheticSymbols(ctx *Context) {
@@ -500,8 +934,64 @@ func FixSyntheticSymbols(ctx *Context) {
 		}
 	}
 
-	ctx.__GlobalPointer.SetOutputSection(outputSections[0])
-	ctx.__GlobalPointer.Value = 0
+	// __global_pointer$ is placed 0x800 bytes past the beginning of
+	// .sdata, so that a signed 12-bit offset from gp covers as much of
+	// the small data as possible.
+	if !isDefsym(ctx, "__global_pointer$") &&
+		!ctx.Script.Defines("__global_pointer$") {
+		var sdata Chunker
+		for _, chunk := range outputSections {
+			if chunk.GetName() == ".sdata" {
+				sdata = chunk
+				break
+			}
+		}
+
+		if sdata != nil {
+			start(ctx.__GlobalPointer, sdata)
+			ctx.__GlobalPointer.Value += 0x800
+		} else {
+			// Without .sdata, gp is defined where an empty .sdata would
+			// be, which is after the last section with contents.
+			var last Chunker
+			for _, chunk := range ctx.Chunks {
+				shdr := chunk.GetShdr()
+				if shdr.Flags&uint64(elf.SHF_ALLOC) != 0 &&
+					shdr.Flags&uint64(elf.SHF_TLS) == 0 &&
+					shdr.Type != uint32(elf.SHT_NOBITS) {
+					last = chunk
+				}
+			}
+			if last != nil {
+				stop(ctx.__GlobalPointer, last)
+				ctx.__GlobalPointer.Value += 0x800
+			}
+		}
+	}
+
+	if ctx._Dynamic != nil {
+		start(ctx._Dynamic, ctx.Dynamic)
+	}
+
+	ctx.Script.FixSymbols()
+
+	for i, def := range ctx.Arg.Defsyms {
+		sym := ctx.Defsyms[i]
+		if val, ok := def.GetAddr(); ok {
+			sym.SetOutputSection(nil)
+			sym.Value = val
+			continue
+		}
+
+		// Undefined targets are reported by CheckDefsyms.
+		target, ok := ctx.SymbolMap[def.Expr]
+		if !ok || target.File == nil {
+			continue
+		}
+
+		sym.SetOutputSection(target.GetOutputSection(ctx))
+		sym.Value = target.GetAddr(ctx)
+	}
 }
 
 func isRelro(ctx *Context, chunk Chunker) bool {
@@ -512,6 +1002,7 @@ func isRelro(ctx *Context, chunk Chunker) bool {
 		return (flags&uint64(elf.SHF_TLS) != 0) || typ == uint32(elf.SHT_INIT_ARRAY) ||
 			typ == uint32(elf.SHT_FINI_ARRAY) || typ == uint32(elf.SHT_PREINIT_ARRAY) ||
 			chunk == ctx.Got || chunk.GetName() == ".toc" ||
+			chunk == ctx.Dynamic ||
 			strings.HasSuffix(chunk.GetName(), "rel.ro")
 	}
 	return false
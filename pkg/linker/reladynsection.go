@@ -0,0 +1,35 @@
+package linker
+
+import (
+	"debug/elf"
+	"unsafe"
+)
+
+type RelaDynSection struct {
+	Chunk
+}
+
+func NewRelaDynSection() *RelaDynSection {
+	r := &RelaDynSection{Chunk: NewChunk()}
+	r.Name = ".rela.dyn"
+	r.Shdr.Type = uint32(elf.SHT_RELA)
+	r.Shdr.Flags = uint64(elf.SHF_ALLOC)
+	r.Shdr.EntSize = uint64(unsafe.Sizeof(Rela{}))
+	r.Shdr.AddrAlign = 8
+	return r
+}
+
+func (r *RelaDynSection) UpdateShdr(ctx *Context) {
+	offset := ctx.Got.GetRelaDynSize(ctx)
+	if ctx.Copyrel != nil {
+		offset += uint64(len(ctx.Copyrel.Symbols)) * uint64(unsafe.Sizeof(Rela{}))
+	}
+
+	for _, file := range ctx.Objs {
+		file.ReldynOffset = offset
+		offset += file.NumDynrel * uint64(unsafe.Sizeof(Rela{}))
+	}
+
+	r.Shdr.Link = uint32(ctx.Dynsym.Shndx)
+	r.Shdr.Size = offset
+}
@@ -0,0 +1,38 @@
+package linker
+
+import (
+	"debug/elf"
+	"github.com/ksco/rvld/pkg/utils"
+	"unsafe"
+)
+
+type RelaPltSection struct {
+	Chunk
+}
+
+func NewRelaPltSection() *RelaPltSection {
+	r := &RelaPltSection{Chunk: NewChunk()}
+	r.Name = ".rela.plt"
+	r.Shdr.Type = uint32(elf.SHT_RELA)
+	r.Shdr.Flags = uint64(elf.SHF_ALLOC | elf.SHF_INFO_LINK)
+	r.Shdr.EntSize = uint64(unsafe.Sizeof(Rela{}))
+	r.Shdr.AddrAlign = 8
+	return r
+}
+
+func (r *RelaPltSection) UpdateShdr(ctx *Context) {
+	r.Shdr.Link = uint32(ctx.Dynsym.Shndx)
+	r.Shdr.Info = uint32(ctx.GotPlt.Shndx)
+	r.Shdr.Size = uint64(len(ctx.Plt.Symbols)) * uint64(unsafe.Sizeof(Rela{}))
+}
+
+func (r *RelaPltSection) CopyBuf(ctx *Context) {
+	base := ctx.Buf[r.Shdr.Offset:]
+	for i, sym := range ctx.Plt.Symbols {
+		utils.Write[Rela](base[i*int(unsafe.Sizeof(Rela{})):], Rela{
+			Offset: sym.GetGotPltAddr(ctx),
+			Type:   uint32(elf.R_RISCV_JUMP_SLOT),
+			Sym:    uint32(sym.GetDynsymIdx(ctx)),
+		})
+	}
+}
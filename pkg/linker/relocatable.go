@@ -0,0 +1,612 @@
+package linker
+
+import (
+	"debug/elf"
+	"fmt"
+	"github.com/ksco/rvld/pkg/utils"
+	"unsafe"
+)
+
+// This file implements -r, which combines object files into a single
+// relocatable object file instead of an executable. Input sections are
+// concatenated into output sections of the same name, relocations are
+// rewritten to refer to the new sections and symbol table, and COMDAT
+// groups are kept so that the final link can still deduplicate them.
+// Nothing is relocated or relaxed; R_RISCV_ALIGN and R_RISCV_RELAX are
+// copied like any other relocation.
+
+// ROutputSection is an output section of a relocatable output file.
+type ROutputSection struct {
+	Chunk
+	Members []*InputSection
+	SymIdx  uint32
+	Rela    *RRelaSection
+}
+
+func (o *ROutputSection) CopyBuf(ctx *Context) {
+	if o.Shdr.Type == uint32(elf.SHT_NOBITS) {
+		return
+	}
+
+	buf := ctx.Buf[o.Shdr.Offset:]
+	for _, isec := range o.Members {
+		copy(buf[isec.Offset:], isec.Contents)
+	}
+}
+
+// RRelaSection holds the relocations for an output section. Those for
+// .eh_frame are written by REhFrameSection.
+type RRelaSection struct {
+	Chunk
+	Target Chunker
+	r      *relocatableLinker
+}
+
+func (s *RRelaSection) UpdateShdr(ctx *Context) {
+	s.Shdr.Link = uint32(s.r.symtab.Shndx)
+	s.Shdr.Info = uint32(s.Target.GetShndx())
+}
+
+func (s *RRelaSection) CopyBuf(ctx *Context) {
+	osec, ok := s.Target.(*ROutputSection)
+	if !ok {
+		return
+	}
+
+	buf := ctx.Buf[s.Shdr.Offset:]
+	for _, isec := range osec.Members {
+		for _, rel := range isec.GetRels() {
+			utils.Write[Rela](buf, s.r.getRela(isec.File, rel, uint64(isec.Offset)))
+			buf = buf[unsafe.Sizeof(Rela{}):]
+		}
+	}
+}
+
+// RGroupSection is a COMDAT group kept in the output.
+type RGroupSection struct {
+	Chunk
+	File *ObjectFile
+	Ref  *ComdatGroupRef
+	r    *relocatableLinker
+}
+
+func (s *RGroupSection) members() []*ROutputSection {
+	osecs := make([]*ROutputSection, 0)
+	for _, idx := range s.Ref.Members {
+		if isec := s.File.Sections[idx]; isec != nil {
+			if osec := s.r.osecs[isec]; osec != nil {
+				osecs = append(osecs, osec)
+			}
+		}
+	}
+	return osecs
+}
+
+func (s *RGroupSection) UpdateShdr(ctx *Context) {
+	s.Shdr.Link = uint32(s.r.symtab.Shndx)
+	s.Shdr.Info, _ = s.r.getSymIdx(s.File, s.Ref.SymIdx)
+
+	n := 1
+	for _, osec := range s.members() {
+		n++
+		if osec.Rela != nil {
+			n++
+		}
+	}
+	s.Shdr.Size = uint64(n) * 4
+}
+
+func (s *RGroupSection) CopyBuf(ctx *Context) {
+	buf := ctx.Buf[s.Shdr.Offset:]
+	utils.Write[uint32](buf, GRP_COMDAT)
+	buf = buf[4:]
+
+	for _, osec := range s.members() {
+		utils.Write[uint32](buf, uint32(osec.Shndx))
+		buf = buf[4:]
+		if osec.Rela != nil {
+			utils.Write[uint32](buf, uint32(osec.Rela.Shndx))
+			buf = buf[4:]
+		}
+	}
+}
+
+// REhFrameSection is the concatenation of the CIEs and the FDEs of live
+// sections. It is rebuilt rather than copied, as FDEs for sections in
+// discarded COMDAT groups must be dropped.
+type REhFrameSection struct {
+	Chunk
+	Rela *RRelaSection
+	r    *relocatableLinker
+}
+
+func (e *REhFrameSection) getFdes(file *ObjectFile) []*FdeRecord {
+	fdes := make([]*FdeRecord, 0)
+	for _, isec := range file.Sections {
+		if isec != nil && isec.IsAlive {
+			for i := range isec.GetFdes() {
+				fdes = append(fdes, &isec.GetFdes()[i])
+			}
+		}
+	}
+	return fdes
+}
+
+func (e *REhFrameSection) computeSize(ctx *Context) (size uint64, numRels uint64) {
+	offset := uint32(0)
+	for _, file := range ctx.Objs {
+		fdes := e.getFdes(file)
+		if len(fdes) == 0 {
+			continue
+		}
+
+		for i := range file.Cies {
+			cie := &file.Cies[i]
+			cie.OutputOffset = offset
+			offset += cie.Size()
+			numRels += uint64(len(cie.GetRels()))
+		}
+		for _, fde := range fdes {
+			fde.OutputOffset = offset
+			offset += fde.Size()
+			numRels += uint64(len(fde.GetRels()))
+		}
+	}
+	return uint64(offset), numRels
+}
+
+func (e *REhFrameSection) CopyBuf(ctx *Context) {
+	base := ctx.Buf[e.Shdr.Offset:]
+	rels := ctx.Buf[e.Rela.Shdr.Offset:]
+
+	writeRels := func(file *ObjectFile, rs []Rela, offset uint32, inputOffset uint32) {
+		for _, rel := range rs {
+			utils.Write[Rela](rels,
+				e.r.getRela(file, rel, uint64(offset)-uint64(inputOffset)))
+			rels = rels[unsafe.Sizeof(Rela{}):]
+		}
+	}
+
+	for _, file := range ctx.Objs {
+		fdes := e.getFdes(file)
+		if len(fdes) == 0 {
+			continue
+		}
+
+		for i := range file.Cies {
+			cie := &file.Cies[i]
+			copy(base[cie.OutputOffset:], cie.GetContents())
+			writeRels(file, cie.GetRels(), cie.OutputOffset, cie.InputOffset)
+		}
+
+		for _, fde := range fdes {
+			copy(base[fde.OutputOffset:], fde.GetContents())
+
+			// The second word of an FDE is the distance back to its CIE.
+			cie := &file.Cies[fde.CieIdx]
+			utils.Write[uint32](base[fde.OutputOffset+4:],
+				fde.OutputOffset+4-cie.OutputOffset)
+			writeRels(file, fde.GetRels(), fde.OutputOffset, fde.InputOffset)
+		}
+	}
+}
+
+// RSymtabSection is the symbol table of a relocatable output file. Its
+// contents are built by relocatableLinker.createSymtab.
+type RSymtabSection struct {
+	Chunk
+	Syms   []Sym
+	Strtab *RStrtabSection
+}
+
+func (s *RSymtabSection) UpdateShdr(ctx *Context) {
+	s.Shdr.Link = uint32(s.Strtab.Shndx)
+	s.Shdr.Size = uint64(len(s.Syms)) * uint64(unsafe.Sizeof(Sym{}))
+}
+
+func (s *RSymtabSection) CopyBuf(ctx *Context) {
+	utils.WriteSlice[Sym](ctx.Buf[s.Shdr.Offset:], s.Syms)
+}
+
+type RStrtabSection struct {
+	Chunk
+	Contents []byte
+}
+
+func (s *RStrtabSection) Add(name string) uint32 {
+	if name == "" {
+		return 0
+	}
+	offset := uint32(len(s.Contents))
+	s.Contents = append(append(s.Contents, name...), 0)
+	return offset
+}
+
+func (s *RStrtabSection) UpdateShdr(ctx *Context) {
+	s.Shdr.Size = uint64(len(s.Contents))
+}
+
+func (s *RStrtabSection) CopyBuf(ctx *Context) {
+	copy(ctx.Buf[s.Shdr.Offset:], s.Contents)
+}
+
+// relocatableLinker holds the mapping from input sections and symbols to
+// the output sections and the output symbol table.
+type relocatableLinker struct {
+	ctx *Context
+
+	osecs     map[*InputSection]*ROutputSection
+	osecList  []*ROutputSection
+	groups    []*RGroupSection
+	ehFrame   *REhFrameSection
+	symtab    *RSymtabSection
+	localIdx  map[*ObjectFile][]int32
+	globalIdx map[*Symbol]uint32
+}
+
+// CombineObjects writes the live input files as a single relocatable
+// object file.
+func CombineObjects(ctx *Context) {
+	if len(ctx.Dsos) > 0 {
+		utils.Fatal(fmt.Sprintf("%s: cannot link a shared library with -r",
+			ctx.Dsos[0].File.Name))
+	}
+
+	r := &relocatableLinker{
+		ctx:       ctx,
+		osecs:     make(map[*InputSection]*ROutputSection),
+		localIdx:  make(map[*ObjectFile][]int32),
+		globalIdx: make(map[*Symbol]uint32),
+	}
+
+	r.createOutputSections()
+
+	ctx.Ehdr = NewOutputEhdr()
+	ctx.Shdr = NewOutputShdr()
+	ctx.Shstrtab = NewShstrtabSection()
+	strtab := &RStrtabSection{Chunk: NewChunk(), Contents: []byte{0}}
+	strtab.Name = ".strtab"
+	strtab.Shdr.Type = uint32(elf.SHT_STRTAB)
+	r.symtab = &RSymtabSection{Chunk: NewChunk(), Strtab: strtab}
+	r.symtab.Name = ".symtab"
+	r.symtab.Shdr.Type = uint32(elf.SHT_SYMTAB)
+	r.symtab.Shdr.EntSize = uint64(unsafe.Sizeof(Sym{}))
+	r.symtab.Shdr.AddrAlign = 8
+
+	ctx.Chunks = append(ctx.Chunks, ctx.Ehdr)
+	for _, group := range r.groups {
+		ctx.Chunks = append(ctx.Chunks, group)
+	}
+	for _, osec := range r.osecList {
+		ctx.Chunks = append(ctx.Chunks, osec)
+		if osec.Rela != nil {
+			ctx.Chunks = append(ctx.Chunks, osec.Rela)
+		}
+	}
+	if r.ehFrame != nil {
+		ctx.Chunks = append(ctx.Chunks, r.ehFrame, r.ehFrame.Rela)
+	}
+
+	// The output never needs an executable stack.
+	stack := NewChunk()
+	stack.Name = ".note.GNU-stack"
+	stack.Shdr.Type = uint32(elf.SHT_PROGBITS)
+	ctx.Chunks = append(ctx.Chunks, &stack)
+
+	ctx.Chunks = append(ctx.Chunks, r.symtab, strtab, ctx.Shstrtab, ctx.Shdr)
+
+	shndx := int64(1)
+	for _, chunk := range ctx.Chunks {
+		if chunk.Kind() != ChunkKindHeader {
+			chunk.SetShndx(shndx)
+			shndx++
+		}
+	}
+	if shndx >= int64(elf.SHN_LORESERVE) {
+		utils.Fatal("-r: too many output sections")
+	}
+
+	r.createSymtab()
+
+	for _, chunk := range ctx.Chunks {
+		chunk.UpdateShdr(ctx)
+	}
+
+	fileoff := uint64(0)
+	for _, chunk := range ctx.Chunks {
+		shdr := chunk.GetShdr()
+		fileoff = utils.AlignTo(fileoff, shdr.AddrAlign)
+		shdr.Offset = fileoff
+		if shdr.Type != uint32(elf.SHT_NOBITS) {
+			fileoff += shdr.Size
+		}
+	}
+
+	file := OpenOutputFile(ctx, fileoff)
+	CopyBuf(ctx)
+	utils.CheckErrors()
+	// As with ld and lld, relocatable objects are not executable.
+	file.Close(0666)
+}
+
+func (r *relocatableLinker) createOutputSections() {
+	type key struct {
+		name  string
+		typ   uint32
+		flags uint64
+	}
+	keys := make(map[key]*ROutputSection)
+
+	newSection := func(name string, typ uint32, flags uint64) *ROutputSection {
+		osec := &ROutputSection{Chunk: NewChunk()}
+		osec.Name = name
+		osec.Shdr.Type = typ
+		osec.Shdr.Flags = flags
+		r.osecList = append(r.osecList, osec)
+		return osec
+	}
+
+	hasAttributes := false
+	for _, file := range r.ctx.Objs {
+		// Members of COMDAT groups get output sections of their own, so
+		// that the groups can be emitted as they are.
+		inGroup := make(map[uint32]bool)
+		for i := range file.ComdatGroups {
+			ref := &file.ComdatGroups[i]
+			if ref.Group.Owner != file.Priority {
+				continue
+			}
+			r.groups = append(r.groups, &RGroupSection{
+				Chunk: Chunk{Name: ".group", Shdr: Shdr{
+					Type:      uint32(elf.SHT_GROUP),
+					EntSize:   4,
+					AddrAlign: 4,
+				}},
+				File: file,
+				Ref:  ref,
+				r:    r,
+			})
+			for _, idx := range ref.Members {
+				inGroup[idx] = true
+			}
+		}
+
+		for i, isec := range file.Sections {
+			if isec == nil || !isec.IsAlive {
+				continue
+			}
+
+			shdr := isec.Shdr()
+			if shdr.Flags&uint64(elf.SHF_COMPRESSED) != 0 {
+				utils.Fatal(fmt.Sprintf("%s: compressed sections are not supported with -r",
+					isec))
+			}
+
+			switch shdr.Type {
+			case SHT_LLVM_ADDRSIG:
+				// It refers to the input symbol table.
+				continue
+			case SHT_RISCV_ATTRIBUTES:
+				if hasAttributes {
+					continue
+				}
+				hasAttributes = true
+			}
+
+			var osec *ROutputSection
+			if inGroup[uint32(i)] {
+				osec = newSection(isec.Name(), shdr.Type, shdr.Flags)
+			} else {
+				k := key{isec.Name(), shdr.Type, shdr.Flags &^ uint64(elf.SHF_GROUP)}
+				if osec = keys[k]; osec == nil {
+					osec = newSection(k.name, k.typ, k.flags)
+					keys[k] = osec
+				}
+			}
+
+			osec.Members = append(osec.Members, isec)
+			r.osecs[isec] = osec
+		}
+	}
+
+	for _, osec := range r.osecList {
+		offset := uint64(0)
+		numRels := uint64(0)
+		for _, isec := range osec.Members {
+			align := uint64(1) << isec.P2Align
+			offset = utils.AlignTo(offset, align)
+			isec.Offset = uint32(offset)
+			offset += uint64(isec.ShSize)
+			if align > osec.Shdr.AddrAlign {
+				osec.Shdr.AddrAlign = align
+			}
+			numRels += uint64(len(isec.GetRels()))
+		}
+		osec.Shdr.Size = offset
+		osec.Shdr.EntSize = osec.Members[0].Shdr().EntSize
+		for _, isec := range osec.Members {
+			if isec.Shdr().EntSize != osec.Shdr.EntSize {
+				osec.Shdr.EntSize = 0
+			}
+		}
+
+		if numRels > 0 {
+			osec.Rela = r.newRelaSection(osec, numRels)
+			osec.Rela.Shdr.Flags |= osec.Shdr.Flags & uint64(elf.SHF_GROUP)
+		}
+	}
+
+	ehFrame := &REhFrameSection{Chunk: NewChunk(), r: r}
+	ehFrame.Name = ".eh_frame"
+	ehFrame.Shdr.Type = uint32(elf.SHT_PROGBITS)
+	ehFrame.Shdr.Flags = uint64(elf.SHF_ALLOC)
+	ehFrame.Shdr.AddrAlign = 8
+
+	size, numRels := ehFrame.computeSize(r.ctx)
+	if size > 0 {
+		ehFrame.Shdr.Size = size
+		ehFrame.Rela = r.newRelaSection(ehFrame, numRels)
+		r.ehFrame = ehFrame
+	}
+}
+
+func (r *relocatableLinker) newRelaSection(target Chunker, numRels uint64) *RRelaSection {
+	s := &RRelaSection{Chunk: NewChunk(), Target: target, r: r}
+	s.Name = ".rela" + target.GetName()
+	s.Shdr.Type = uint32(elf.SHT_RELA)
+	s.Shdr.Flags = uint64(elf.SHF_INFO_LINK)
+	s.Shdr.EntSize = uint64(unsafe.Sizeof(Rela{}))
+	s.Shdr.AddrAlign = 8
+	s.Shdr.Size = numRels * uint64(unsafe.Sizeof(Rela{}))
+	return s
+}
+
+// createSymtab creates a section symbol for each output section, followed
+// by the local symbols of each file and then by the global symbols.
+func (r *relocatableLinker) createSymtab() {
+	symtab := r.symtab
+	symtab.Syms = append(symtab.Syms, Sym{})
+
+	for _, osec := range r.osecList {
+		osec.SymIdx = uint32(len(symtab.Syms))
+		symtab.Syms = append(symtab.Syms, Sym{
+			Info:  uint8(elf.STT_SECTION),
+			Shndx: uint16(osec.Shndx),
+		})
+	}
+
+	for _, file := range r.ctx.Objs {
+		indices := make([]int32, file.FirstGlobal)
+		r.localIdx[file] = indices
+
+		for i := int64(1); i < file.FirstGlobal; i++ {
+			indices[i] = -1
+			esym := file.ElfSyms[i]
+			if esym.Type() == uint8(elf.STT_SECTION) {
+				continue
+			}
+
+			if !esym.IsAbs() {
+				osec, offset, ok := r.getOutputSection(file, &esym, i)
+				if !ok {
+					continue
+				}
+				esym.Shndx = uint16(osec.Shndx)
+				esym.Val += offset
+			}
+
+			indices[i] = int32(len(symtab.Syms))
+			esym.Name = symtab.Strtab.Add(getName(file.SymbolStrtab, esym.Name))
+			symtab.Syms = append(symtab.Syms, esym)
+		}
+	}
+
+	symtab.Shdr.Info = uint32(len(symtab.Syms))
+
+	for _, file := range r.ctx.Objs {
+		for i := file.FirstGlobal; i < int64(len(file.ElfSyms)); i++ {
+			sym := file.Symbols[i]
+			idx, ok := r.globalIdx[sym]
+			if !ok {
+				r.globalIdx[sym] = uint32(len(symtab.Syms))
+				symtab.Syms = append(symtab.Syms, r.getGlobalSym(file, i))
+				continue
+			}
+
+			// An undefined symbol is weak only if all references are.
+			if out := &symtab.Syms[idx]; out.IsUndef() && !file.ElfSyms[i].IsWeak() {
+				out.SetBind(uint8(elf.STB_GLOBAL))
+			}
+		}
+	}
+}
+
+func (r *relocatableLinker) getGlobalSym(file *ObjectFile, idx int64) Sym {
+	sym := file.Symbols[idx]
+	esym := file.ElfSyms[idx]
+	if sym.File != nil && sym.File != r.ctx.InternalObj {
+		esym = *sym.ElfSym()
+	}
+	esym.Name = r.symtab.Strtab.Add(sym.Name)
+	esym.SetVisibility(sym.Visibility)
+
+	if sym.File == nil || esym.IsUndef() {
+		esym.Shndx = uint16(elf.SHN_UNDEF)
+		esym.Val = 0
+		esym.Size = 0
+		return esym
+	}
+
+	if esym.IsAbs() || esym.IsCommon() {
+		return esym
+	}
+
+	osec, offset, ok := r.getOutputSection(sym.File, &esym, int64(sym.SymIdx))
+	if !ok {
+		esym.Shndx = uint16(elf.SHN_UNDEF)
+		esym.Val = 0
+		esym.Size = 0
+		return esym
+	}
+	esym.Shndx = uint16(osec.Shndx)
+	esym.Val += offset
+	return esym
+}
+
+// getOutputSection returns the output section of the section that esym
+// is defined in, and the offset of that section in it.
+func (r *relocatableLinker) getOutputSection(
+	file *ObjectFile, esym *Sym, idx int64) (*ROutputSection, uint64, bool) {
+	isec := file.GetSection(esym, idx)
+	if isec == nil {
+		return nil, 0, false
+	}
+	osec, ok := r.osecs[isec]
+	if !ok {
+		return nil, 0, false
+	}
+	return osec, uint64(isec.Offset), true
+}
+
+// getSymIdx returns the output symbol index for a symbol of file, along
+// with the value to be added to the addend of relocations against it,
+// which is nonzero for section symbols. It returns 0 if the symbol is in
+// a discarded section.
+func (r *relocatableLinker) getSymIdx(file *ObjectFile, idx uint32) (uint32, uint64) {
+	if idx == 0 {
+		return 0, 0
+	}
+
+	if int64(idx) >= file.FirstGlobal {
+		return r.globalIdx[file.Symbols[idx]], 0
+	}
+
+	esym := &file.ElfSyms[idx]
+	if esym.Type() == uint8(elf.STT_SECTION) {
+		if osec, offset, ok := r.getOutputSection(file, esym, int64(idx)); ok {
+			return osec.SymIdx, offset
+		}
+		return 0, 0
+	}
+
+	if out := r.localIdx[file][idx]; out >= 0 {
+		return uint32(out), 0
+	}
+	return 0, 0
+}
+
+// getRela returns rel of file rewritten for the output, where its section
+// is at the given offset. Relocations against symbols in discarded
+// sections become R_RISCV_NONE.
+func (r *relocatableLinker) getRela(file *ObjectFile, rel Rela, offset uint64) Rela {
+	out := Rela{Offset: rel.Offset + offset}
+	symIdx, addend := r.getSymIdx(file, rel.Sym)
+	if symIdx == 0 && rel.Sym != 0 {
+		return out
+	}
+
+	out.Type = rel.Type
+	out.Sym = symIdx
+	out.Addend = rel.Addend + int64(addend)
+	return out
+}
@@ -0,0 +1,159 @@
+package linker
+
+import "debug/elf"
+
+// ScriptCommand is a single command in a SECTIONS command or in an output
+// section description. Exactly one of its fields is set.
+type ScriptCommand struct {
+	Assign *ScriptAssignment
+	Desc   *OutputSectionDesc
+	Input  *InputSectionDesc
+	Data   *ScriptData
+	Assert *ScriptAssert
+}
+
+// ScriptAssignment assigns a value to a symbol or to the location
+// counter, e.g. `_etext = .;` or `. = ALIGN(8);`.
+type ScriptAssignment struct {
+	Name    string
+	Op      string
+	Expr    *ScriptExpr
+	Provide bool
+	Hidden  bool
+
+	// The symbol defined by the assignment, or nil if it is a PROVIDE
+	// of a symbol that is defined elsewhere.
+	Sym *Symbol
+
+	Value   uint64
+	Section Chunker
+}
+
+// OutputSectionDesc is an output section description in SECTIONS.
+type OutputSectionDesc struct {
+	Name      string
+	Idx       int
+	Addr      *ScriptExpr
+	Align     *ScriptExpr
+	Lma       *ScriptExpr
+	Region    string
+	LmaRegion string
+	Phdrs     []string
+	NoLoad    bool
+	Commands  []*ScriptCommand
+
+	Osec *OutputSection
+}
+
+func (d *OutputSectionDesc) IsDiscard() bool {
+	return d.Name == "/DISCARD/"
+}
+
+// NeedsOutputSection reports whether the description creates an output
+// section even if no input section is assigned to it, which is the case
+// if it defines symbols or data.
+func (d *OutputSectionDesc) NeedsOutputSection() bool {
+	for _, cmd := range d.Commands {
+		if cmd.Input == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *OutputSectionDesc) GetOutputSection(
+	ctx *Context, typ uint32, flags uint64) *OutputSection {
+	flags = flags & ^uint64(elf.SHF_GROUP) & ^uint64(elf.SHF_COMPRESSED) &
+		^uint64(elf.SHF_LINK_ORDER) & ^uint64(SHF_GNU_RETAIN) &
+		^uint64(elf.SHF_MERGE) & ^uint64(elf.SHF_STRINGS)
+	if d.NoLoad {
+		typ = uint32(elf.SHT_NOBITS)
+	}
+
+	ctx.outputSectionsMu.Lock()
+	defer ctx.outputSectionsMu.Unlock()
+
+	if d.Osec == nil {
+		d.Osec = NewOutputSection(
+			d.Name, typ, flags, uint32(len(ctx.OutputSections)))
+		d.Osec.ScriptDesc = d
+		ctx.OutputSections = append(ctx.OutputSections, d.Osec)
+		return d.Osec
+	}
+
+	// Sections of different types are combined into PROGBITS, as
+	// NOBITS sections can only be at the end of a section.
+	if d.Osec.Shdr.Type != typ {
+		if d.Osec.Shdr.Type == uint32(elf.SHT_NOBITS) {
+			d.Osec.Shdr.Type = typ
+		} else if typ != uint32(elf.SHT_NOBITS) {
+			d.Osec.Shdr.Type = uint32(elf.SHT_PROGBITS)
+		}
+	}
+	d.Osec.Shdr.Flags |= flags
+	return d.Osec
+}
+
+const (
+	SortNone = iota
+	SortByName
+	SortByAlignment
+	SortByInitPriority
+)
+
+// InputSectionDesc selects input sections by file and section name
+// patterns, e.g. `KEEP(*crt0.o(.text .text.*))`.
+type InputSectionDesc struct {
+	Parent       *OutputSectionDesc
+	Idx          int
+	File         string
+	ExcludeFiles []string
+	Sections     []string
+	Keep         bool
+	Sort         int
+}
+
+func (d *InputSectionDesc) Matches(file *ObjectFile, name string) bool {
+	filename := file.File.Name
+	if !globMatch(d.File, filename) {
+		return false
+	}
+	for _, pat := range d.ExcludeFiles {
+		if globMatch(pat, filename) {
+			return false
+		}
+	}
+
+	if len(d.Sections) == 0 {
+		return true
+	}
+	for _, pat := range d.Sections {
+		if globMatch(pat, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// ScriptData is a BYTE, SHORT, LONG or QUAD command, which stores a value
+// in the output section.
+type ScriptData struct {
+	Size   int
+	Expr   *ScriptExpr
+	Offset uint64
+	Value  uint64
+}
+
+type ScriptAssert struct {
+	Expr   *ScriptExpr
+	Msg    string
+	Failed bool
+}
+
+// PhdrDesc is a program header declared in the PHDRS command.
+type PhdrDesc struct {
+	Name  string
+	Type  uint32
+	Flags *ScriptExpr
+	At    *ScriptExpr
+}
@@ -0,0 +1,234 @@
+package linker
+
+import (
+	"fmt"
+	"github.com/ksco/rvld/pkg/utils"
+	"math/bits"
+)
+
+// ScriptExpr is an expression in a linker script. Leaves are numbers
+// ("num"), symbols ("sym") and the location counter ("."). Other nodes
+// are operators applied to Args, or calls ("call") of builtin functions
+// such as ALIGN, in which case Name is the function name.
+type ScriptExpr struct {
+	Op   string
+	Num  uint64
+	Name string
+	Args []*ScriptExpr
+}
+
+// IsConstant reports whether the value of the expression does not
+// depend on any address.
+func (e *ScriptExpr) IsConstant() bool {
+	switch e.Op {
+	case "num":
+		return true
+	case "sym", ".", "call":
+		return false
+	}
+
+	for _, arg := range e.Args {
+		if !arg.IsConstant() {
+			return false
+		}
+	}
+	return true
+}
+
+func b2u(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (s *LinkerScript) getSymbolValue(ctx *Context, name string) (uint64, bool) {
+	if val, ok := s.values[name]; ok {
+		return val, true
+	}
+	if sym, ok := ctx.SymbolMap[name]; ok && sym.File != nil {
+		return sym.GetAddr(ctx), true
+	}
+	return 0, false
+}
+
+func (s *LinkerScript) findChunk(ctx *Context, name string) Chunker {
+	for _, chunk := range ctx.Chunks {
+		if chunk.GetName() == name {
+			return chunk
+		}
+	}
+	utils.Fatal(fmt.Sprintf("linker script: undefined section %s", name))
+	return nil
+}
+
+func (s *LinkerScript) findRegion(name string) *MemoryRegion {
+	for _, r := range s.Regions {
+		if r.Name == name {
+			return r
+		}
+	}
+	utils.Fatal(fmt.Sprintf("linker script: undefined memory region %s", name))
+	return nil
+}
+
+// Eval evaluates an expression, where dot is the current value of the
+// location counter.
+func (s *LinkerScript) Eval(ctx *Context, e *ScriptExpr, dot uint64) uint64 {
+	eval := func(i int) uint64 {
+		return s.Eval(ctx, e.Args[i], dot)
+	}
+
+	switch e.Op {
+	case "num":
+		return e.Num
+	case ".":
+		return dot
+	case "sym":
+		if e.Name == "SIZEOF_HEADERS" {
+			return ctx.Ehdr.Shdr.Size + ctx.Phdr.Shdr.Size
+		}
+		val, ok := s.getSymbolValue(ctx, e.Name)
+		if !ok {
+			utils.Fatal(fmt.Sprintf(
+				"linker script: undefined symbol %s in expression", e.Name))
+		}
+		return val
+	case "call":
+		return s.call(ctx, e, dot)
+	case "neg":
+		return -eval(0)
+	case "~":
+		return ^eval(0)
+	case "!":
+		return b2u(eval(0) == 0)
+	case "?:":
+		if eval(0) != 0 {
+			return eval(1)
+		}
+		return eval(2)
+	}
+
+	x, y := eval(0), eval(1)
+	switch e.Op {
+	case "+":
+		return x + y
+	case "-":
+		return x - y
+	case "*":
+		return x * y
+	case "/", "%":
+		if y == 0 {
+			utils.Fatal("linker script: division by zero")
+		}
+		if e.Op == "/" {
+			return x / y
+		}
+		return x % y
+	case "&":
+		return x & y
+	case "|":
+		return x | y
+	case "<<":
+		return x << y
+	case ">>":
+		return x >> y
+	case "==":
+		return b2u(x == y)
+	case "!=":
+		return b2u(x != y)
+	case "<":
+		return b2u(x < y)
+	case ">":
+		return b2u(x > y)
+	case "<=":
+		return b2u(x <= y)
+	case ">=":
+		return b2u(x >= y)
+	case "&&":
+		return b2u(x != 0 && y != 0)
+	case "||":
+		return b2u(x != 0 || y != 0)
+	}
+
+	utils.Fatal(fmt.Sprintf("linker script: unknown operator %s", e.Op))
+	return 0
+}
+
+func (s *LinkerScript) call(ctx *Context, e *ScriptExpr, dot uint64) uint64 {
+	nargs := func(n int) {
+		if len(e.Args) != n {
+			utils.Fatal(fmt.Sprintf(
+				"linker script: %s takes %d arguments", e.Name, n))
+		}
+	}
+	eval := func(i int) uint64 {
+		return s.Eval(ctx, e.Args[i], dot)
+	}
+
+	switch e.Name {
+	case "ALIGN", "NEXT":
+		if len(e.Args) == 2 {
+			return utils.AlignTo(eval(0), eval(1))
+		}
+		nargs(1)
+		return utils.AlignTo(dot, eval(0))
+	case "ABSOLUTE":
+		nargs(1)
+		return eval(0)
+	case "MAX", "MIN":
+		nargs(2)
+		x, y := eval(0), eval(1)
+		if (e.Name == "MAX") == (x > y) {
+			return x
+		}
+		return y
+	case "LOG2CEIL":
+		nargs(1)
+		if x := eval(0); x > 1 {
+			return uint64(64 - bits.LeadingZeros64(x-1))
+		}
+		return 0
+	case "DATA_SEGMENT_ALIGN":
+		nargs(2)
+		maxPageSize := eval(0)
+		return utils.AlignTo(dot, maxPageSize) + dot&(maxPageSize-1)
+	case "DATA_SEGMENT_END":
+		nargs(1)
+		return eval(0)
+	case "DATA_SEGMENT_RELRO_END":
+		nargs(2)
+		return eval(1)
+	}
+
+	// The remaining functions take a name rather than an expression.
+	nargs(1)
+	name := e.Args[0].Name
+
+	switch e.Name {
+	case "DEFINED":
+		_, ok := s.getSymbolValue(ctx, name)
+		return b2u(ok)
+	case "ADDR":
+		return s.findChunk(ctx, name).GetShdr().Addr
+	case "LOADADDR":
+		return s.GetLoadAddr(s.findChunk(ctx, name))
+	case "SIZEOF":
+		return s.findChunk(ctx, name).GetShdr().Size
+	case "ALIGNOF":
+		return s.findChunk(ctx, name).GetShdr().AddrAlign
+	case "ORIGIN":
+		return s.findRegion(name).Origin
+	case "LENGTH":
+		return s.findRegion(name).Length
+	case "CONSTANT":
+		switch name {
+		case "MAXPAGESIZE", "COMMONPAGESIZE":
+			return PageSize
+		}
+		utils.Fatal(fmt.Sprintf("linker script: unknown constant %s", name))
+	}
+
+	utils.Fatal(fmt.Sprintf("linker script: unknown function %s", e.Name))
+	return 0
+}
@@ -0,0 +1,732 @@
+package linker
+
+import (
+	"debug/elf"
+	"fmt"
+	"github.com/ksco/rvld/pkg/utils"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var scriptOperators = []string{
+	"<<=", ">>=", "<<", ">>", "<=", ">=", "==", "!=", "&&", "||",
+	"+=", "-=", "*=", "/=", "&=", "|=",
+}
+
+func isScriptWordChar(c byte) bool {
+	return c < unicode.MaxASCII &&
+		(unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c)) ||
+			strings.IndexByte("_.$/\\~*?[]!^-", c) >= 0)
+}
+
+// tokenizeScript splits a linker script into tokens. Since file and
+// section name patterns may contain characters such as `*` and `-`, they
+// are read as part of words here, and split again by the parser where
+// an expression is expected.
+func tokenizeScript(name string, contents string) []string {
+	toks := make([]string, 0)
+
+	for len(contents) > 0 {
+		c := contents[0]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			contents = contents[1:]
+			continue
+		case strings.HasPrefix(contents, "/*"):
+			end := strings.Index(contents[2:], "*/")
+			if end == -1 {
+				utils.Fatal(fmt.Sprintf("%s: unclosed comment", name))
+			}
+			contents = contents[end+4:]
+			continue
+		case c == '"':
+			end := strings.IndexByte(contents[1:], '"')
+			if end == -1 {
+				utils.Fatal(fmt.Sprintf("%s: unclosed string literal", name))
+			}
+			toks = append(toks, contents[1:end+1])
+			contents = contents[end+2:]
+			continue
+		}
+
+		n := 0
+		for _, op := range scriptOperators {
+			if strings.HasPrefix(contents, op) {
+				n = len(op)
+				break
+			}
+		}
+
+		if n == 0 {
+			for n < len(contents) && isScriptWordChar(contents[n]) {
+				n++
+			}
+			if n == 0 {
+				n = 1
+			}
+		}
+
+		toks = append(toks, contents[:n])
+		contents = contents[n:]
+	}
+	return toks
+}
+
+type scriptParser struct {
+	ctx    *Context
+	script *LinkerScript
+	name   string
+	toks   []string
+}
+
+// openScriptFile opens a file named in a linker script, searching the
+// library paths if it is not found relative to the current directory.
+func openScriptFile(ctx *Context, path string) *File {
+	if _, err := os.Stat(path); err == nil || filepath.IsAbs(path) {
+		return MustNewFile(path)
+	}
+
+	for _, dir := range ctx.Arg.LibraryPaths {
+		if _, err := os.Stat(filepath.Join(dir, path)); err == nil {
+			return MustNewFile(filepath.Join(dir, path))
+		}
+	}
+
+	utils.Fatal(fmt.Sprintf("cannot open linker script %s", path))
+	return nil
+}
+
+// ParseLinkerScript reads a linker script given with -T or as an input
+// file. Commands of all scripts are added to ctx.Script in the order they
+// are read.
+func ParseLinkerScript(ctx *Context, file *File) {
+	if ctx.Script == nil {
+		ctx.Script = NewLinkerScript()
+	}
+
+	p := &scriptParser{
+		ctx:    ctx,
+		script: ctx.Script,
+		name:   file.Name,
+		toks:   tokenizeScript(file.Name, string(file.Contents)),
+	}
+
+	for len(p.toks) > 0 {
+		p.parseCommand()
+	}
+}
+
+func (p *scriptParser) fatal(msg string) {
+	if len(p.toks) > 0 {
+		utils.Fatal(fmt.Sprintf("%s: %s near `%s'", p.name, msg, p.toks[0]))
+	}
+	utils.Fatal(fmt.Sprintf("%s: %s at end of file", p.name, msg))
+}
+
+func (p *scriptParser) peek() string {
+	if len(p.toks) == 0 {
+		return ""
+	}
+	return p.toks[0]
+}
+
+func (p *scriptParser) peek2() string {
+	if len(p.toks) < 2 {
+		return ""
+	}
+	return p.toks[1]
+}
+
+func (p *scriptParser) next() string {
+	if len(p.toks) == 0 {
+		p.fatal("unexpected end of file")
+	}
+	tok := p.toks[0]
+	p.toks = p.toks[1:]
+	return tok
+}
+
+func (p *scriptParser) consume(tok string) bool {
+	if p.peek() == tok {
+		p.toks = p.toks[1:]
+		return true
+	}
+	return false
+}
+
+func (p *scriptParser) expect(tok string) {
+	if !p.consume(tok) {
+		p.fatal(fmt.Sprintf("expected `%s'", tok))
+	}
+}
+
+// skipParens skips a parenthesized list of arguments of a command that
+// has no effect on us, such as OUTPUT_ARCH.
+func (p *scriptParser) skipParens() {
+	p.expect("(")
+	for depth := 1; depth > 0; {
+		switch p.next() {
+		case "(":
+			depth++
+		case ")":
+			depth--
+		}
+	}
+}
+
+func isAssignOp(tok string) bool {
+	switch tok {
+	case "=", "+=", "-=", "*=", "/=", "&=", "|=", "<<=", ">>=":
+		return true
+	}
+	return false
+}
+
+func (p *scriptParser) parseCommand() {
+	s := p.script
+
+	switch tok := p.next(); tok {
+	case ";":
+	case "ENTRY":
+		p.expect("(")
+		s.Entry = p.next()
+		p.expect(")")
+	case "MEMORY":
+		p.parseMemory()
+	case "PHDRS":
+		p.parsePhdrs()
+	case "SECTIONS":
+		s.HasSectionsCmd = true
+		p.expect("{")
+		for !p.consume("}") {
+			if cmd := p.parseSectionsCommand(); cmd != nil {
+				s.Commands = append(s.Commands, cmd)
+			}
+		}
+	case "OUTPUT_ARCH", "OUTPUT_FORMAT", "TARGET", "EXTERN", "FORCE_COMMON_ALLOCATION":
+		if p.peek() == "(" {
+			p.skipParens()
+		}
+	case "GROUP":
+		if p.ctx.FileGroup != 0 {
+			p.parseInputFiles()
+			break
+		}
+		StartGroup(p.ctx)
+		p.parseInputFiles()
+		p.ctx.FileGroup = 0
+	case "INPUT":
+		p.parseInputFiles()
+	case "SEARCH_DIR":
+		p.expect("(")
+		dir := filepath.Clean(ResolveSysroot(p.ctx, p.next()))
+		p.ctx.Arg.LibraryPaths = append(p.ctx.Arg.LibraryPaths, dir)
+		p.expect(")")
+	case "INCLUDE":
+		file := openScriptFile(p.ctx, p.next())
+		p.toks = append(tokenizeScript(file.Name, string(file.Contents)), p.toks...)
+	case "ASSERT":
+		s.Commands = append(s.Commands, p.parseAssert())
+	case "PROVIDE", "PROVIDE_HIDDEN", "HIDDEN":
+		s.Commands = append(s.Commands, p.parseProvide(tok))
+	default:
+		if isAssignOp(p.peek()) {
+			s.Commands = append(s.Commands, p.parseAssignment(tok))
+			return
+		}
+		p.toks = append([]string{tok}, p.toks...)
+		p.fatal("unknown linker script command")
+	}
+}
+
+// parseInputFiles reads the files listed in GROUP or INPUT. Libraries in
+// AS_NEEDED are always linked.
+func (p *scriptParser) parseInputFiles() {
+	p.expect("(")
+	for !p.consume(")") {
+		switch tok := p.next(); tok {
+		case ",":
+		case "AS_NEEDED":
+			p.expect("(")
+			for !p.consume(")") {
+				if !p.consume(",") {
+					p.readInputFile(p.nextPath(p.next()))
+				}
+			}
+		default:
+			p.readInputFile(p.nextPath(tok))
+		}
+	}
+}
+
+// nextPath rejoins a sysroot-relative path, whose leading `=` is read as
+// a separate token.
+func (p *scriptParser) nextPath(tok string) string {
+	if tok == "=" {
+		return tok + p.next()
+	}
+	return tok
+}
+
+func (p *scriptParser) readInputFile(path string) {
+	ctx := p.ctx
+	if name, ok := utils.RemovePrefix(path, "-l"); ok {
+		ReadFile(ctx, FindLibrary(ctx, name))
+		return
+	}
+
+	if resolved := ResolveSysroot(ctx, path); resolved != path {
+		ReadFile(ctx, MustNewFile(resolved))
+		return
+	}
+
+	// An absolute path in a script under the sysroot refers to a file
+	// in the sysroot.
+	if filepath.IsAbs(path) && isInSysroot(ctx, p.name) {
+		resolved := filepath.Join(ctx.Arg.Sysroot, path)
+		if _, err := os.Stat(resolved); err == nil {
+			ReadFile(ctx, MustNewFile(resolved))
+			return
+		}
+	}
+
+	if _, err := os.Stat(path); err == nil || filepath.IsAbs(path) {
+		ReadFile(ctx, MustNewFile(path))
+		return
+	}
+
+	for _, dir := range ctx.Arg.LibraryPaths {
+		if _, err := os.Stat(filepath.Join(dir, path)); err == nil {
+			ReadFile(ctx, MustNewFile(filepath.Join(dir, path)))
+			return
+		}
+	}
+
+	utils.Fatal(fmt.Sprintf("%s: cannot find %s", p.name, path))
+}
+
+func (p *scriptParser) parseMemory() {
+	p.expect("{")
+	for !p.consume("}") {
+		r := &MemoryRegion{Name: p.next()}
+		if p.consume("(") {
+			for !p.consume(")") {
+				r.Attrs += p.next()
+			}
+		}
+		p.expect(":")
+
+		for i := 0; i < 2; i++ {
+			switch key := p.next(); key {
+			case "ORIGIN", "org", "o":
+				p.expect("=")
+				r.Origin = p.script.Eval(p.ctx, p.parseExpr(), 0)
+			case "LENGTH", "len", "l":
+				p.expect("=")
+				r.Length = p.script.Eval(p.ctx, p.parseExpr(), 0)
+			default:
+				p.toks = append([]string{key}, p.toks...)
+				p.fatal("expected ORIGIN or LENGTH")
+			}
+			p.consume(",")
+		}
+		p.script.Regions = append(p.script.Regions, r)
+	}
+}
+
+var phdrTypes = map[string]elf.ProgType{
+	"PT_NULL":         elf.PT_NULL,
+	"PT_LOAD":         elf.PT_LOAD,
+	"PT_DYNAMIC":      elf.PT_DYNAMIC,
+	"PT_INTERP":       elf.PT_INTERP,
+	"PT_NOTE":         elf.PT_NOTE,
+	"PT_SHLIB":        elf.PT_SHLIB,
+	"PT_PHDR":         elf.PT_PHDR,
+	"PT_TLS":          elf.PT_TLS,
+	"PT_GNU_EH_FRAME": elf.PT_GNU_EH_FRAME,
+	"PT_GNU_STACK":    elf.PT_GNU_STACK,
+	"PT_GNU_RELRO":    elf.PT_GNU_RELRO,
+}
+
+func (p *scriptParser) parsePhdrs() {
+	p.expect("{")
+	for !p.consume("}") {
+		pd := &PhdrDesc{Name: p.next()}
+
+		if typ, ok := phdrTypes[p.peek()]; ok {
+			p.next()
+			pd.Type = uint32(typ)
+		} else {
+			pd.Type = uint32(p.script.Eval(p.ctx, p.parseExpr(), 0))
+		}
+
+		for !p.consume(";") {
+			switch tok := p.next(); tok {
+			case "FILEHDR", "PHDRS":
+				// The ELF headers are not loaded when a linker script
+				// lays out the sections.
+			case "AT":
+				p.expect("(")
+				pd.At = p.parseExpr()
+				p.expect(")")
+			case "FLAGS":
+				p.expect("(")
+				pd.Flags = p.parseExpr()
+				p.expect(")")
+			default:
+				p.toks = append([]string{tok}, p.toks...)
+				p.fatal("unknown program header attribute")
+			}
+		}
+		p.script.Phdrs = append(p.script.Phdrs, pd)
+	}
+}
+
+// parseSectionsCommand parses a command in SECTIONS. It returns nil for
+// commands that have no effect on the layout.
+func (p *scriptParser) parseSectionsCommand() *ScriptCommand {
+	switch tok := p.next(); tok {
+	case ";":
+		return nil
+	case "ENTRY":
+		p.expect("(")
+		p.script.Entry = p.next()
+		p.expect(")")
+		return nil
+	case "ASSERT":
+		return p.parseAssert()
+	case "PROVIDE", "PROVIDE_HIDDEN", "HIDDEN":
+		return p.parseProvide(tok)
+	default:
+		if isAssignOp(p.peek()) {
+			return p.parseAssignment(tok)
+		}
+		return &ScriptCommand{Desc: p.parseOutputSectionDesc(tok)}
+	}
+}
+
+func (p *scriptParser) parseAssignment(name string) *ScriptCommand {
+	a := &ScriptAssignment{Name: name, Op: p.next()}
+	a.Expr = p.parseExpr()
+	p.consume(";")
+	p.script.Assignments = append(p.script.Assignments, a)
+	return &ScriptCommand{Assign: a}
+}
+
+// parseProvide parses PROVIDE(sym = expr) and its variants.
+func (p *scriptParser) parseProvide(cmd string) *ScriptCommand {
+	p.expect("(")
+	name := p.next()
+	if !isAssignOp(p.peek()) {
+		p.fatal("expected assignment")
+	}
+	ret := p.parseAssignment(name)
+	p.expect(")")
+	p.consume(";")
+
+	ret.Assign.Provide = cmd != "HIDDEN"
+	ret.Assign.Hidden = cmd != "PROVIDE"
+	return ret
+}
+
+func (p *scriptParser) parseAssert() *ScriptCommand {
+	p.expect("(")
+	a := &ScriptAssert{Expr: p.parseExpr()}
+	p.expect(",")
+	a.Msg = p.next()
+	p.expect(")")
+	p.consume(";")
+	return &ScriptCommand{Assert: a}
+}
+
+func (p *scriptParser) parseOutputSectionDesc(name string) *OutputSectionDesc {
+	desc := &OutputSectionDesc{Name: name, Idx: len(p.script.Descs)}
+	p.script.Descs = append(p.script.Descs, desc)
+
+	for !p.consume(":") {
+		if p.peek() == "(" {
+			switch p.peek2() {
+			case "NOLOAD":
+				desc.NoLoad = true
+				fallthrough
+			case "COPY", "INFO", "OVERLAY", "DSECT", "READONLY":
+				p.skipParens()
+				continue
+			}
+		}
+		if desc.Addr != nil {
+			p.fatal("expected `:'")
+		}
+		desc.Addr = p.parseExpr()
+	}
+
+	for !p.consume("{") {
+		switch tok := p.next(); tok {
+		case "AT":
+			p.expect("(")
+			desc.Lma = p.parseExpr()
+			p.expect(")")
+		case "ALIGN":
+			p.expect("(")
+			desc.Align = p.parseExpr()
+			p.expect(")")
+		case "SUBALIGN":
+			p.skipParens()
+		case "ONLY_IF_RO", "ONLY_IF_RW", "ALIGN_WITH_INPUT":
+		default:
+			p.toks = append([]string{tok}, p.toks...)
+			p.fatal("expected `{'")
+		}
+	}
+
+	for !p.consume("}") {
+		if cmd := p.parseOutputSectionCommand(desc); cmd != nil {
+			desc.Commands = append(desc.Commands, cmd)
+		}
+	}
+
+	for {
+		switch {
+		case p.peek() == ">":
+			p.next()
+			desc.Region = p.next()
+		case p.peek() == "AT" && p.peek2() == ">":
+			p.next()
+			p.next()
+			desc.LmaRegion = p.next()
+		case p.peek() == ":" && p.peek2() != "":
+			p.next()
+			desc.Phdrs = append(desc.Phdrs, p.next())
+		case p.peek() == "=":
+			// Fill patterns are not supported; gaps are zero-filled.
+			p.next()
+			p.parseExpr()
+		case p.peek() == ",":
+			p.next()
+		default:
+			return desc
+		}
+	}
+}
+
+func (p *scriptParser) parseOutputSectionCommand(desc *OutputSectionDesc) *ScriptCommand {
+	switch tok := p.next(); tok {
+	case ";", "CREATE_OBJECT_SYMBOLS", "CONSTRUCTORS":
+		return nil
+	case "FILL":
+		p.skipParens()
+		return nil
+	case "ASSERT":
+		return p.parseAssert()
+	case "PROVIDE", "PROVIDE_HIDDEN", "HIDDEN":
+		return p.parseProvide(tok)
+	case "BYTE", "SHORT", "LONG", "QUAD", "SQUAD":
+		size := map[string]int{
+			"BYTE": 1, "SHORT": 2, "LONG": 4, "QUAD": 8, "SQUAD": 8,
+		}[tok]
+		p.expect("(")
+		data := &ScriptData{Size: size, Expr: p.parseExpr()}
+		p.expect(")")
+		p.consume(";")
+		return &ScriptCommand{Data: data}
+	case "KEEP":
+		p.expect("(")
+		input := p.parseInputSectionDesc(desc, p.next())
+		input.Keep = true
+		p.expect(")")
+		return &ScriptCommand{Input: input}
+	default:
+		if isAssignOp(p.peek()) {
+			return p.parseAssignment(tok)
+		}
+		return &ScriptCommand{Input: p.parseInputSectionDesc(desc, tok)}
+	}
+}
+
+var scriptSortKinds = map[string]int{
+	"SORT":                  SortByName,
+	"SORT_BY_NAME":          SortByName,
+	"SORT_BY_ALIGNMENT":     SortByAlignment,
+	"SORT_BY_INIT_PRIORITY": SortByInitPriority,
+	"SORT_NONE":             SortNone,
+}
+
+// parseInputSectionDesc parses an input section description, such as
+// `*(.text .text.*)` or `*(EXCLUDE_FILE(*crtend.o) SORT(.ctors.*))`.
+func (p *scriptParser) parseInputSectionDesc(
+	desc *OutputSectionDesc, file string) *InputSectionDesc {
+	input := &InputSectionDesc{
+		Parent: desc,
+		Idx:    len(p.script.Inputs),
+		File:   file,
+	}
+	p.script.Inputs = append(p.script.Inputs, input)
+
+	if !p.consume("(") {
+		return input
+	}
+
+	depth := 0
+	for {
+		tok := p.next()
+		switch {
+		case tok == ")":
+			if depth == 0 {
+				return input
+			}
+			depth--
+		case tok == "EXCLUDE_FILE":
+			p.expect("(")
+			for !p.consume(")") {
+				input.ExcludeFiles = append(input.ExcludeFiles, p.next())
+			}
+		case scriptSortKinds[tok] != 0 || tok == "SORT_NONE":
+			if depth == 0 {
+				input.Sort = scriptSortKinds[tok]
+			}
+			p.expect("(")
+			depth++
+		case tok == ",":
+		default:
+			input.Sections = append(input.Sections, tok)
+		}
+	}
+}
+
+// splitExprToken splits the next token at the operator characters that
+// the tokenizer reads as part of words, so that `0x100-4` is read as
+// three tokens in an expression.
+func (p *scriptParser) splitExprToken() {
+	tok := p.peek()
+	if len(tok) <= 1 || strings.IndexAny(tok, "-*/~!") == -1 {
+		return
+	}
+
+	pieces := make([]string, 0)
+	start := 0
+	for i := 0; i < len(tok); i++ {
+		if strings.IndexByte("-*/~!", tok[i]) >= 0 {
+			if start < i {
+				pieces = append(pieces, tok[start:i])
+			}
+			pieces = append(pieces, tok[i:i+1])
+			start = i + 1
+		}
+	}
+	if start < len(tok) {
+		pieces = append(pieces, tok[start:])
+	}
+	p.toks = append(pieces, p.toks[1:]...)
+}
+
+var scriptBinaryOps = map[string]int{
+	"||": 1, "&&": 2, "|": 3, "&": 4,
+	"==": 5, "!=": 5,
+	"<": 6, ">": 6, "<=": 6, ">=": 6,
+	"<<": 7, ">>": 7,
+	"+": 8, "-": 8,
+	"*": 9, "/": 9, "%": 9,
+}
+
+func (p *scriptParser) parseExpr() *ScriptExpr {
+	cond := p.parseBinary(1)
+	if !p.consume("?") {
+		return cond
+	}
+
+	then := p.parseExpr()
+	p.expect(":")
+	return &ScriptExpr{Op: "?:", Args: []*ScriptExpr{cond, then, p.parseExpr()}}
+}
+
+func (p *scriptParser) parseBinary(minPrec int) *ScriptExpr {
+	lhs := p.parseUnary()
+	for {
+		p.splitExprToken()
+		op := p.peek()
+		prec, ok := scriptBinaryOps[op]
+		if !ok || prec < minPrec {
+			return lhs
+		}
+		p.next()
+		rhs := p.parseBinary(prec + 1)
+		lhs = &ScriptExpr{Op: op, Args: []*ScriptExpr{lhs, rhs}}
+	}
+}
+
+func (p *scriptParser) parseUnary() *ScriptExpr {
+	p.splitExprToken()
+	switch p.peek() {
+	case "-":
+		p.next()
+		return &ScriptExpr{Op: "neg", Args: []*ScriptExpr{p.parseUnary()}}
+	case "~", "!":
+		return &ScriptExpr{Op: p.next(), Args: []*ScriptExpr{p.parseUnary()}}
+	case "+":
+		p.next()
+		return p.parseUnary()
+	}
+	return p.parsePrimary()
+}
+
+// parseNumber parses an integer constant, which may have a K or M suffix.
+func parseNumber(tok string) (uint64, bool) {
+	mul := uint64(1)
+	switch {
+	case strings.HasSuffix(tok, "K") || strings.HasSuffix(tok, "k"):
+		mul = 1 << 10
+	case strings.HasSuffix(tok, "M") || strings.HasSuffix(tok, "m"):
+		mul = 1 << 20
+	}
+	if mul != 1 {
+		tok = tok[:len(tok)-1]
+	}
+
+	val, err := strconv.ParseUint(tok, 0, 64)
+	if err != nil {
+		return 0, false
+	}
+	return val * mul, true
+}
+
+func (p *scriptParser) parsePrimary() *ScriptExpr {
+	tok := p.next()
+
+	if tok == "(" {
+		e := p.parseExpr()
+		p.expect(")")
+		return e
+	}
+	if tok == "." {
+		return &ScriptExpr{Op: "."}
+	}
+	if val, ok := parseNumber(tok); ok {
+		return &ScriptExpr{Op: "num", Num: val}
+	}
+	if !isScriptWordChar(tok[0]) {
+		p.toks = append([]string{tok}, p.toks...)
+		p.fatal("expected expression")
+	}
+
+	if !p.consume("(") {
+		return &ScriptExpr{Op: "sym", Name: tok}
+	}
+
+	e := &ScriptExpr{Op: "call", Name: tok}
+	switch tok {
+	case "DEFINED", "ADDR", "LOADADDR", "SIZEOF", "ALIGNOF", "ORIGIN",
+		"LENGTH", "CONSTANT":
+		e.Args = append(e.Args, &ScriptExpr{Op: "sym", Name: p.next()})
+		p.expect(")")
+		return e
+	}
+
+	for !p.consume(")") {
+		e.Args = append(e.Args, p.parseExpr())
+		p.consume(",")
+	}
+	return e
+}
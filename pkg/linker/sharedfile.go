@@ -0,0 +1,194 @@
+package linker
+
+import (
+	"debug/elf"
+	"github.com/ksco/rvld/pkg/utils"
+	"path/filepath"
+	"unsafe"
+)
+
+type SharedFile struct {
+	ObjectFile
+	Soname  string
+	Needed  []string
+	VerSyms []uint16
+}
+
+func NewSharedFile(file *File) *SharedFile {
+	s := &SharedFile{ObjectFile: ObjectFile{InputFile: *NewInputFile(file)}}
+	s.IsDso = true
+	s.IsAlive = true
+	return s
+}
+
+func (s *SharedFile) parse(ctx *Context) {
+	s.readDynamic()
+	s.ElfSyms = make([]Sym, 1)
+	s.Symbols = []*Symbol{NewSymbol("")}
+	s.VerSyms = make([]uint16, 1)
+	s.FirstGlobal = 1
+
+	dynsym := s.FindSection(uint32(elf.SHT_DYNSYM))
+	if dynsym == nil {
+		return
+	}
+
+	strtab := s.GetBytesFromIdx(int64(dynsym.Link))
+
+	var versyms []uint16
+	if sec := s.FindSection(uint32(elf.SHT_GNU_VERSYM)); sec != nil {
+		bs := s.GetBytesFromShdr(sec)
+		versyms = make([]uint16, 0, len(bs)/2)
+		for len(bs) >= 2 {
+			versyms = append(versyms, utils.Read[uint16](bs))
+			bs = bs[2:]
+		}
+	}
+
+	bs := s.GetBytesFromShdr(dynsym)
+	nums := len(bs) / int(unsafe.Sizeof(Sym{}))
+	for i := 0; i < nums; i++ {
+		esym := utils.Read[Sym](bs[i*int(unsafe.Sizeof(Sym{})):])
+		if i < int(dynsym.Info) {
+			continue
+		}
+
+		ver := VER_NDX_GLOBAL
+		if versyms != nil {
+			ver = versyms[i] & ^VERSYM_HIDDEN
+			if ver == VER_NDX_LOCAL {
+				continue
+			}
+
+			// A symbol with a non-default version can only be referred to
+			// by a versioned reference, which we do not support.
+			if !esym.IsUndef() && versyms[i]&VERSYM_HIDDEN != 0 {
+				continue
+			}
+		}
+
+		s.ElfSyms = append(s.ElfSyms, esym)
+		s.VerSyms = append(s.VerSyms, ver)
+		s.Symbols = append(s.Symbols,
+			GetSymbolByName(ctx, getName(strtab, esym.Name)))
+	}
+}
+
+// readDynamic reads the soname and the DT_NEEDED entries. The soname
+// defaults to the file name.
+func (s *SharedFile) readDynamic() {
+	s.Soname = filepath.Base(s.File.Name)
+
+	sec := s.FindSection(uint32(elf.SHT_DYNAMIC))
+	if sec == nil {
+		return
+	}
+
+	strtab := s.GetBytesFromIdx(int64(sec.Link))
+	bs := s.GetBytesFromShdr(sec)
+	for len(bs) >= int(unsafe.Sizeof(Dyn{})) {
+		dyn := utils.Read[Dyn](bs)
+		switch dyn.Tag {
+		case int64(elf.DT_NULL):
+			return
+		case int64(elf.DT_SONAME):
+			s.Soname = getName(strtab, uint32(dyn.Val))
+		case int64(elf.DT_NEEDED):
+			s.Needed = append(s.Needed, getName(strtab, uint32(dyn.Val)))
+		}
+		bs = bs[unsafe.Sizeof(Dyn{}):]
+	}
+}
+
+func (s *SharedFile) ResolveSymbols(ctx *Context) {
+	for i := s.FirstGlobal; i < int64(len(s.ElfSyms)); i++ {
+		sym := s.Symbols[i]
+		esym := &s.ElfSyms[i]
+
+		if esym.IsUndef() {
+			continue
+		}
+
+		if GetRank(&s.ObjectFile, esym, false) < sym.GetRank() {
+			sym.File = &s.ObjectFile
+			sym.SetInputSection(nil)
+			sym.Value = esym.Val
+			sym.SymIdx = int32(i)
+			sym.VerIdx = s.VerSyms[i]
+			sym.IsWeak = esym.IsWeak()
+			sym.IsExported = false
+		}
+	}
+}
+
+func (s *SharedFile) MarkLiveObjects(ctx *Context, feeder func(*ObjectFile)) {
+	for i := s.FirstGlobal; i < int64(len(s.ElfSyms)); i++ {
+		esym := &s.ElfSyms[i]
+		sym := s.Symbols[i]
+
+		if !esym.IsUndef() || esym.IsWeak() {
+			continue
+		}
+
+		if sym.File == nil && sym.Lazy != nil {
+			if file := sym.Lazy.Load(ctx); file != nil {
+				file.ExtractedBy = sym
+				file.ExtractedFrom = &s.InputFile
+				feeder(file)
+			}
+			continue
+		}
+
+		if sym.File == nil || sym.File.IsDso {
+			continue
+		}
+
+		if !sym.File.SwapIsAlive(true) {
+			sym.File.ExtractedBy = sym
+			sym.File.ExtractedFrom = &s.InputFile
+			feeder(sym.File)
+		}
+	}
+}
+
+// GetAlignment returns the alignment a copy of the given symbol needs,
+// which is bounded by both its section and its address in the DSO.
+func (s *SharedFile) GetAlignment(sym *Symbol) uint64 {
+	esym := sym.ElfSym()
+	align := s.ElfSections[esym.Shndx].AddrAlign
+	if align == 0 {
+		align = 1
+	}
+	if esym.Val != 0 {
+		if a := uint64(1) << utils.CountrZero(esym.Val); a < align {
+			return a
+		}
+	}
+	return align
+}
+
+// FindAliases returns data symbols in the same DSO that share an
+// address with sym, so that a copy relocation covers all of them.
+func (s *SharedFile) FindAliases(sym *Symbol) []*Symbol {
+	utils.Assert(sym.File == &s.ObjectFile)
+
+	aliases := make([]*Symbol, 0)
+	for i := s.FirstGlobal; i < int64(len(s.ElfSyms)); i++ {
+		esym := &s.ElfSyms[i]
+		alias := s.Symbols[i]
+		if alias != sym && alias.File == &s.ObjectFile && !esym.IsUndef() &&
+			esym.Type() == uint8(elf.STT_OBJECT) && esym.Val == sym.ElfSym().Val {
+			aliases = append(aliases, alias)
+		}
+	}
+	return aliases
+}
+
+func GetSharedFile(ctx *Context, file *ObjectFile) *SharedFile {
+	for _, dso := range ctx.Dsos {
+		if &dso.ObjectFile == file {
+			return dso
+		}
+	}
+	return nil
+}
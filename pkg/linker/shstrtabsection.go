@@ -0,0 +1,36 @@
+package linker
+
+import "debug/elf"
+
+type ShstrtabSection struct {
+	Chunk
+}
+
+func NewShstrtabSection() *ShstrtabSection {
+	s := &ShstrtabSection{Chunk: NewChunk()}
+	s.Name = ".shstrtab"
+	s.Shdr.Type = uint32(elf.SHT_STRTAB)
+	return s
+}
+
+func (s *ShstrtabSection) UpdateShdr(ctx *Context) {
+	offset := uint32(1)
+	for _, chunk := range ctx.Chunks {
+		if chunk.Kind() != ChunkKindHeader && chunk.GetName() != "" {
+			chunk.GetShdr().Name = offset
+			offset += uint32(len(chunk.GetName())) + 1
+		}
+	}
+	s.Shdr.Size = uint64(offset)
+}
+
+func (s *ShstrtabSection) CopyBuf(ctx *Context) {
+	base := ctx.Buf[s.Shdr.Offset:]
+	base[0] = 0
+
+	for _, chunk := range ctx.Chunks {
+		if chunk.Kind() != ChunkKindHeader && chunk.GetName() != "" {
+			writeString(base[chunk.GetShdr().Name:], chunk.GetName())
+		}
+	}
+}
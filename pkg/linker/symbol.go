@@ -2,11 +2,16 @@ package linker
 
 import (
 	"debug/elf"
+	"sync/atomic"
 )
 
 const (
-	NEEDS_GOT   uint32 = 1 << 0
-	NEEDS_GOTTP uint32 = 1 << 3
+	NEEDS_GOT     uint32 = 1 << 0
+	NEEDS_PLT     uint32 = 1 << 1
+	NEEDS_CPLT    uint32 = 1 << 2
+	NEEDS_GOTTP   uint32 = 1 << 3
+	NEEDS_TLSGD   uint32 = 1 << 4
+	NEEDS_COPYREL uint32 = 1 << 5
 )
 
 type Symbol struct {
@@ -16,6 +21,10 @@ type Symbol struct {
 	OutputSection   Chunker
 	SectionFragment *SectionFragment
 
+	// Lazy is the archive member that defines the symbol according to
+	// the archive index, if any.
+	Lazy *LazyObject
+
 	Value uint64
 	Name  string
 
@@ -26,8 +35,12 @@ type Symbol struct {
 	Flags      uint32
 	Visibility uint8
 
-	IsWeak     bool
-	IsExported bool
+	IsWeak        bool
+	IsImported    bool
+	IsExported    bool
+	IsCanonical   bool
+	HasCopyrel    bool
+	WriteToSymtab bool
 }
 
 func NewSymbol(name string) *Symbol {
@@ -41,6 +54,9 @@ func NewSymbol(name string) *Symbol {
 }
 
 func GetSymbolByName(ctx *Context, name string) *Symbol {
+	ctx.symbolMapMu.Lock()
+	defer ctx.symbolMapMu.Unlock()
+
 	if sym, ok := ctx.SymbolMap[name]; ok {
 		return sym
 	}
@@ -48,6 +64,18 @@ func GetSymbolByName(ctx *Context, name string) *Symbol {
 	return ctx.SymbolMap[name]
 }
 
+// SetFlags adds NEEDS_* flags to a symbol. Relocations are scanned in
+// parallel, so the flags are updated atomically.
+func (s *Symbol) SetFlags(flags uint32) {
+	for {
+		old := atomic.LoadUint32(&s.Flags)
+		if old&flags == flags ||
+			atomic.CompareAndSwapUint32(&s.Flags, old, old|flags) {
+			return
+		}
+	}
+}
+
 func (s *Symbol) SetInputSection(isec *InputSection) {
 	s.InputSection = isec
 	s.OutputSection = nil
@@ -78,6 +106,27 @@ func (s *Symbol) GetGotTpIdx(ctx *Context) int32 {
 	return ctx.SymbolsAux[s.AuxIdx].GotTpIdx
 }
 
+func (s *Symbol) GetTlsGdIdx(ctx *Context) int32 {
+	if s.AuxIdx == -1 {
+		return -1
+	}
+	return ctx.SymbolsAux[s.AuxIdx].TlsGdIdx
+}
+
+func (s *Symbol) GetPltIdx(ctx *Context) int32 {
+	if s.AuxIdx == -1 {
+		return -1
+	}
+	return ctx.SymbolsAux[s.AuxIdx].PltIdx
+}
+
+func (s *Symbol) GetDynsymIdx(ctx *Context) int32 {
+	if s.AuxIdx == -1 {
+		return -1
+	}
+	return ctx.SymbolsAux[s.AuxIdx].DynsymIdx
+}
+
 func (s *Symbol) SetGotIdx(ctx *Context, idx int32) {
 	ctx.SymbolsAux[s.AuxIdx].GotIdx = idx
 }
@@ -86,6 +135,18 @@ func (s *Symbol) SetGotTpIdx(ctx *Context, idx int32) {
 	ctx.SymbolsAux[s.AuxIdx].GotTpIdx = idx
 }
 
+func (s *Symbol) SetTlsGdIdx(ctx *Context, idx int32) {
+	ctx.SymbolsAux[s.AuxIdx].TlsGdIdx = idx
+}
+
+func (s *Symbol) SetPltIdx(ctx *Context, idx int32) {
+	ctx.SymbolsAux[s.AuxIdx].PltIdx = idx
+}
+
+func (s *Symbol) SetDynsymIdx(ctx *Context, idx int32) {
+	ctx.SymbolsAux[s.AuxIdx].DynsymIdx = idx
+}
+
 func (s *Symbol) ElfSym() *Sym {
 	return &s.File.ElfSyms[s.SymIdx]
 }
@@ -98,21 +159,65 @@ func (s *Symbol) GetAddr(ctx *Context) uint64 {
 		return s.SectionFragment.GetAddr() + s.Value
 	}
 
+	if s.HasCopyrel {
+		return ctx.Copyrel.Shdr.Addr + s.Value
+	}
+
+	if s.IsImported {
+		if s.GetPltIdx(ctx) != -1 {
+			return s.GetPltAddr(ctx)
+		}
+		return 0
+	}
+
 	if s.InputSection == nil {
 		return s.Value
 	}
 
 	if !s.InputSection.IsAlive {
+		// .eh_frame sections are not copied as-is, but rewritten by
+		// EhFrameSection.
+		if ctx.EhFrame != nil && s.InputSection.Name() == ".eh_frame" {
+			return ctx.EhFrame.GetSymbolAddr(ctx, s)
+		}
 		return 0
 	}
 
 	return s.InputSection.GetAddr() + s.Value
 }
 
+// GetOutputSection returns the output chunk the symbol's address belongs
+// to, or nil if the symbol is absolute.
+func (s *Symbol) GetOutputSection(ctx *Context) Chunker {
+	switch {
+	case s.SectionFragment != nil:
+		return s.SectionFragment.OutputSection
+	case s.HasCopyrel:
+		return ctx.Copyrel
+	case s.IsImported:
+		return nil
+	case s.InputSection != nil && s.InputSection.IsAlive:
+		return s.InputSection.OutputSection
+	}
+	return s.OutputSection
+}
+
 func (s *Symbol) GetGotTpAddr(ctx *Context) uint64 {
 	return ctx.Got.Shdr.Addr + uint64(s.GetGotTpIdx(ctx))*8
 }
 
+func (s *Symbol) GetTlsGdAddr(ctx *Context) uint64 {
+	return ctx.Got.Shdr.Addr + uint64(s.GetTlsGdIdx(ctx))*8
+}
+
+func (s *Symbol) GetPltAddr(ctx *Context) uint64 {
+	return ctx.Plt.Shdr.Addr + PltHdrSize + uint64(s.GetPltIdx(ctx))*PltEntrySize
+}
+
+func (s *Symbol) GetGotPltAddr(ctx *Context) uint64 {
+	return ctx.GotPlt.Shdr.Addr + GotPltHdrSize + uint64(s.GetPltIdx(ctx))*8
+}
+
 func (s *Symbol) Clear() {
 	s.File = nil
 	s.SectionFragment = nil
@@ -124,6 +229,26 @@ func (s *Symbol) Clear() {
 	s.IsExported = false
 }
 
+func (s *Symbol) IsLocal() bool {
+	return s.Visibility == uint8(elf.STV_HIDDEN)
+}
+
+// IsPreemptible reports whether references to the symbol have to be
+// resolved by the dynamic linker, because it is either defined in another
+// module or may be interposed by one.
+func (s *Symbol) IsPreemptible(ctx *Context) bool {
+	if s.IsImported {
+		return true
+	}
+	return ctx.Arg.Shared && s.IsExported &&
+		s.Visibility != uint8(elf.STV_PROTECTED)
+}
+
+func (s *Symbol) IsAbsolute() bool {
+	return s.InputSection == nil && s.SectionFragment == nil &&
+		s.OutputSection == nil
+}
+
 func (s *Symbol) GetRank() uint64 {
 	if s.File == nil {
 		return 7 << 24
@@ -1,13 +1,19 @@
 package linker
 
 type SymbolAux struct {
-	GotIdx   int32
-	GotTpIdx int32
+	GotIdx    int32
+	GotTpIdx  int32
+	TlsGdIdx  int32
+	PltIdx    int32
+	DynsymIdx int32
 }
 
 func NewSymbolAux() SymbolAux {
 	return SymbolAux{
-		GotIdx:   -1,
-		GotTpIdx: -1,
+		GotIdx:    -1,
+		GotTpIdx:  -1,
+		TlsGdIdx:  -1,
+		PltIdx:    -1,
+		DynsymIdx: -1,
 	}
 }
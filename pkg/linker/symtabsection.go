@@ -0,0 +1,119 @@
+package linker
+
+import (
+	"debug/elf"
+	"github.com/ksco/rvld/pkg/utils"
+	"unsafe"
+)
+
+type SymtabSection struct {
+	Chunk
+}
+
+func NewSymtabSection() *SymtabSection {
+	s := &SymtabSection{Chunk: NewChunk()}
+	s.Name = ".symtab"
+	s.Shdr.Type = uint32(elf.SHT_SYMTAB)
+	s.Shdr.EntSize = uint64(unsafe.Sizeof(Sym{}))
+	s.Shdr.AddrAlign = 8
+	return s
+}
+
+func (s *SymtabSection) UpdateShdr(ctx *Context) {
+	nsyms := int64(1)
+
+	for _, file := range ctx.Objs {
+		file.LocalSymtabIdx = nsyms
+		nsyms += file.NumLocalSymtab
+	}
+
+	for _, file := range ctx.Objs {
+		file.GlobalSymtabIdx = nsyms
+		nsyms += file.NumGlobalSymtab
+	}
+
+	s.Shdr.Info = uint32(ctx.Objs[0].GlobalSymtabIdx)
+	if ctx.Strtab != nil {
+		s.Shdr.Link = uint32(ctx.Strtab.Shndx)
+	}
+
+	if nsyms == 1 {
+		s.Shdr.Size = 0
+	} else {
+		s.Shdr.Size = uint64(nsyms) * uint64(unsafe.Sizeof(Sym{}))
+	}
+}
+
+func (s *SymtabSection) CopyBuf(ctx *Context) {
+	utils.Write[Sym](ctx.Buf[s.Shdr.Offset:], Sym{})
+
+	for _, file := range ctx.Objs {
+		file.PopulateSymtab(ctx)
+	}
+}
+
+type StrtabSection struct {
+	Chunk
+}
+
+func NewStrtabSection() *StrtabSection {
+	s := &StrtabSection{Chunk: NewChunk()}
+	s.Name = ".strtab"
+	s.Shdr.Type = uint32(elf.SHT_STRTAB)
+	return s
+}
+
+func (s *StrtabSection) UpdateShdr(ctx *Context) {
+	offset := int64(1)
+	for _, file := range ctx.Objs {
+		file.StrtabOffset = offset
+		offset += file.StrtabSize
+	}
+
+	if offset == 1 {
+		s.Shdr.Size = 0
+	} else {
+		s.Shdr.Size = uint64(offset)
+	}
+}
+
+func (s *StrtabSection) CopyBuf(ctx *Context) {
+	ctx.Buf[s.Shdr.Offset] = 0
+}
+
+func toOutputEsym(ctx *Context, sym *Symbol, name uint32) Sym {
+	esym := sym.ElfSym()
+	ret := Sym{Name: name, Info: esym.Info, Size: esym.Size}
+	ret.SetVisibility(sym.Visibility)
+
+	if esym.Bind() != uint8(elf.STB_LOCAL) {
+		switch {
+		case sym.IsLocal():
+			ret.SetBind(uint8(elf.STB_LOCAL))
+		case sym.IsWeak || esym.IsUndefWeak():
+			ret.SetBind(uint8(elf.STB_WEAK))
+		default:
+			ret.SetBind(uint8(elf.STB_GLOBAL))
+		}
+	}
+
+	switch {
+	case esym.IsUndef():
+		ret.Shndx = uint16(elf.SHN_UNDEF)
+		return ret
+	case sym.SectionFragment != nil:
+		ret.Shndx = uint16(sym.SectionFragment.OutputSection.Shndx)
+	case sym.InputSection != nil:
+		ret.Shndx = uint16(sym.InputSection.OutputSection.Shndx)
+	case sym.OutputSection != nil:
+		ret.Shndx = uint16(sym.OutputSection.GetShndx())
+	default:
+		ret.Shndx = uint16(elf.SHN_ABS)
+	}
+
+	ret.Val = sym.GetAddr(ctx)
+	if esym.Type() == uint8(elf.STT_TLS) {
+		ret.Val -= ctx.TpAddr
+	}
+	return ret
+}
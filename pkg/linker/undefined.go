@@ -0,0 +1,240 @@
+package linker
+
+import (
+	"debug/elf"
+	"fmt"
+	"github.com/ksco/rvld/pkg/utils"
+	"strings"
+)
+
+// Values of --unresolved-symbols.
+const (
+	UnresolvedReportAll = iota
+	UnresolvedIgnoreAll
+	UnresolvedIgnoreInObjectFiles
+	UnresolvedIgnoreInSharedLibs
+)
+
+// ignoreUndefinedInObjs reports whether undefined symbols referred to by
+// object files are allowed. They are by default when creating a shared
+// object, in which case they are resolved at load time.
+func ignoreUndefinedInObjs(ctx *Context) bool {
+	switch ctx.Arg.UnresolvedSymbols {
+	case UnresolvedIgnoreAll, UnresolvedIgnoreInObjectFiles:
+		return true
+	}
+	return ctx.Arg.Shared && !ctx.Arg.ZDefs
+}
+
+func ignoreUndefinedInDsos(ctx *Context) bool {
+	switch ctx.Arg.UnresolvedSymbols {
+	case UnresolvedIgnoreAll, UnresolvedIgnoreInSharedLibs:
+		return true
+	}
+	return ctx.Arg.AllowShlibUndefined
+}
+
+// maxUndefinedRefs is the number of references shown for each undefined
+// symbol. The rest are only counted.
+const maxUndefinedRefs = 3
+
+// ReportUndefinedSymbols reports every reference to a symbol that is
+// left undefined after ClaimUnresolvedSymbols, grouped by symbol.
+func ReportUndefinedSymbols(ctx *Context) {
+	names := make([]string, 0)
+	refs := make(map[string][]string)
+
+	for _, file := range ctx.Objs {
+		for _, isec := range file.Sections {
+			if isec == nil || !isec.IsAlive ||
+				isec.Shdr().Flags&uint64(elf.SHF_ALLOC) == 0 {
+				continue
+			}
+
+			for _, rel := range isec.GetRels() {
+				if rel.Type == uint32(elf.R_RISCV_NONE) {
+					continue
+				}
+
+				// Weak references may be left undefined, even if the
+				// symbol is also referred to with a strong reference.
+				sym := file.Symbols[rel.Sym]
+				if file.ElfSyms[rel.Sym].IsUndefWeak() || sym.File != nil {
+					continue
+				}
+
+				if _, ok := refs[sym.Name]; !ok {
+					names = append(names, sym.Name)
+				}
+				refs[sym.Name] = append(refs[sym.Name],
+					isec.Describe("referenced by", rel.Offset))
+			}
+		}
+	}
+
+	s := newSuggester(ctx)
+	for _, name := range names {
+		var b strings.Builder
+		fmt.Fprintf(&b, "undefined symbol: %s", name)
+		for i, ref := range refs[name] {
+			if i == maxUndefinedRefs {
+				fmt.Fprintf(&b, "\n>>> referenced %d more times",
+					len(refs[name])-maxUndefinedRefs)
+				break
+			}
+			b.WriteString(ref)
+		}
+		b.WriteString(s.suggest(name))
+		utils.Error(b.String())
+	}
+
+	if !ignoreUndefinedInDsos(ctx) {
+		reportDsoUndefinedSymbols(ctx)
+	}
+
+	utils.CheckErrors()
+}
+
+// reportDsoUndefinedSymbols reports symbols that shared objects need but
+// that nothing defines. Only shared objects whose dependencies are all
+// part of the link are checked, as the dependencies may define them.
+func reportDsoUndefinedSymbols(ctx *Context) {
+	sonames := utils.NewMapSet[string]()
+	for _, dso := range ctx.Dsos {
+		sonames.Add(dso.Soname)
+	}
+
+	for _, dso := range ctx.Dsos {
+		complete := true
+		for _, needed := range dso.Needed {
+			if !sonames.Contains(needed) {
+				complete = false
+				break
+			}
+		}
+		if !complete {
+			continue
+		}
+
+		for i := dso.FirstGlobal; i < int64(len(dso.ElfSyms)); i++ {
+			esym := &dso.ElfSyms[i]
+			if esym.IsUndef() && !esym.IsWeak() && dso.Symbols[i].File == nil {
+				utils.Error(fmt.Sprintf("undefined symbol: %s\n>>> referenced by %s",
+					dso.Symbols[i].Name, dso))
+			}
+		}
+	}
+}
+
+// suggester finds defined symbols whose names are close to an undefined
+// one, which is usually the result of a typo or of a mismatch between C
+// and C++ linkage.
+type suggester struct {
+	ctx *Context
+
+	// Defined symbols by lowercased name and by demangled name. They are
+	// built when first needed.
+	lower     map[string]*Symbol
+	demangled map[string]*Symbol
+}
+
+func newSuggester(ctx *Context) *suggester {
+	return &suggester{ctx: ctx}
+}
+
+func (s *suggester) lookup(name string) *Symbol {
+	if sym, ok := s.ctx.SymbolMap[name]; ok && sym.File != nil {
+		return sym
+	}
+	return nil
+}
+
+// setIfFirst stores sym in m under key, keeping the smallest name if
+// several symbols share the key, so that the result does not depend on
+// map iteration order.
+func setIfFirst(m map[string]*Symbol, key string, sym *Symbol) {
+	if old, ok := m[key]; !ok || sym.Name < old.Name {
+		m[key] = sym
+	}
+}
+
+func (s *suggester) init() {
+	if s.lower != nil {
+		return
+	}
+
+	s.lower = make(map[string]*Symbol)
+	s.demangled = make(map[string]*Symbol)
+	for name, sym := range s.ctx.SymbolMap {
+		if sym.File == nil {
+			continue
+		}
+		setIfFirst(s.lower, strings.ToLower(name), sym)
+		if qualified, _, ok := Demangle(name); ok {
+			setIfFirst(s.demangled, qualified, sym)
+		}
+	}
+}
+
+// suggest returns lines to be appended to the undefined symbol error for
+// name, or an empty string if there is no suggestion.
+func (s *suggester) suggest(name string) string {
+	format := func(spelling string, sym *Symbol) string {
+		return fmt.Sprintf("\n>>> did you mean: %s\n>>> defined in: %s",
+			spelling, sym.File)
+	}
+
+	// A C++ reference to a function defined in C, or the other way
+	// around.
+	if qualified, _, ok := Demangle(name); ok {
+		if sym := s.lookup(qualified); sym != nil {
+			return format(fmt.Sprintf("extern \"C\" %s", qualified), sym)
+		}
+	} else {
+		s.init()
+		if sym, ok := s.demangled[name]; ok {
+			qualified, params, _ := Demangle(sym.Name)
+			return format(qualified+params, sym)
+		}
+	}
+
+	for _, candidate := range editsOf(name) {
+		if sym := s.lookup(candidate); sym != nil {
+			return format(candidate, sym)
+		}
+	}
+
+	s.init()
+	if sym, ok := s.lower[strings.ToLower(name)]; ok {
+		return format(sym.Name, sym)
+	}
+	return ""
+}
+
+const identChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_"
+
+// editsOf returns the strings at edit distance one from name, in a fixed
+// order: transpositions, deletions, substitutions and then insertions.
+func editsOf(name string) []string {
+	edits := make([]string, 0)
+	for i := 0; i+1 < len(name); i++ {
+		edits = append(edits,
+			name[:i]+name[i+1:i+2]+name[i:i+1]+name[i+2:])
+	}
+	for i := 0; i < len(name); i++ {
+		edits = append(edits, name[:i]+name[i+1:])
+	}
+	for i := 0; i < len(name); i++ {
+		for _, c := range identChars {
+			if byte(c) != name[i] {
+				edits = append(edits, name[:i]+string(c)+name[i+1:])
+			}
+		}
+	}
+	for i := 0; i <= len(name); i++ {
+		for _, c := range identChars {
+			edits = append(edits, name[:i]+string(c)+name[i:])
+		}
+	}
+	return edits
+}
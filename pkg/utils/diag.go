@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// ColorDiagnostics and FatalWarnings are set by --color-diagnostics and
+// --fatal-warnings.
+var (
+	ColorDiagnostics bool
+	FatalWarnings    bool
+)
+
+var (
+	fatalHooks   []func()
+	fatalHooksMu sync.Mutex
+
+	diagMu     sync.Mutex
+	errorCount atomic.Int64
+)
+
+// OnFatal registers a function to be called before exiting on a fatal
+// error, such as one removing an incomplete output file.
+func OnFatal(fn func()) {
+	fatalHooksMu.Lock()
+	defer fatalHooksMu.Unlock()
+	fatalHooks = append(fatalHooks, fn)
+}
+
+func printDiag(kind string, color string, v any) {
+	if ColorDiagnostics {
+		kind = "\033[0;1;" + color + "m" + kind + "\033[0m"
+	}
+
+	diagMu.Lock()
+	defer diagMu.Unlock()
+	fmt.Fprintln(os.Stderr, "rvld: "+kind, fmt.Sprintf("%s", v))
+}
+
+func exit() {
+	fatalHooksMu.Lock()
+	for _, fn := range fatalHooks {
+		fn()
+	}
+	os.Exit(1)
+}
+
+// Fatal reports an error and exits immediately.
+func Fatal(v any) {
+	printDiag("fatal:", "31", v)
+	exit()
+}
+
+// Error reports an error without exiting, so that the linker can find
+// more errors before giving up at the next CheckErrors.
+func Error(v any) {
+	printDiag("error:", "31", v)
+	errorCount.Add(1)
+}
+
+// Warn reports a warning, which is counted as an error if
+// --fatal-warnings is given.
+func Warn(v any) {
+	if FatalWarnings {
+		Error(v)
+		return
+	}
+	printDiag("warning:", "35", v)
+}
+
+// Info prints a message that is neither a warning nor an error, such as
+// those requested by --print-gc-sections.
+func Info(v any) {
+	diagMu.Lock()
+	defer diagMu.Unlock()
+	fmt.Fprintln(os.Stderr, "rvld:", fmt.Sprintf("%s", v))
+}
+
+// CheckErrors exits if any error has been reported.
+func CheckErrors() {
+	if errorCount.Load() > 0 {
+		exit()
+	}
+}
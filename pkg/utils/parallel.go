@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// ParallelForEach calls fn for each element using up to the given number
+// of goroutines. It returns after all calls have finished.
+func ParallelForEach[T any](elems []T, threads int, fn func(T)) {
+	if threads > len(elems) {
+		threads = len(elems)
+	}
+
+	if threads <= 1 {
+		for _, elem := range elems {
+			fn(elem)
+		}
+		return
+	}
+
+	next := int64(-1)
+	var wg sync.WaitGroup
+	wg.Add(threads)
+
+	for i := 0; i < threads; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				j := atomic.AddInt64(&next, 1)
+				if j >= int64(len(elems)) {
+					return
+				}
+				fn(elems[j])
+			}
+		}()
+	}
+
+	wg.Wait()
+}
@@ -1,13 +1,9 @@
 package utils
 
 import (
-	"bytes"
-	"encoding/binary"
-	"fmt"
 	"math/bits"
-	"os"
-	"runtime/debug"
 	"strings"
+	"unsafe"
 )
 
 type Uint interface {
@@ -63,12 +59,6 @@ func MustNo(err error) {
 	}
 }
 
-func Fatal(v any) {
-	fmt.Println("rvld: "+"\033[0;1;31mfatal:\033[0m", fmt.Sprintf("%s", v))
-	debug.PrintStack()
-	os.Exit(1)
-}
-
 func Assert(condition bool) {
 	if !condition {
 		Fatal("Assert failed")
@@ -90,18 +80,60 @@ func AllZeros(bs []byte) bool {
 	return b == 0
 }
 
+// The following functions convert between bytes and values of fixed-size
+// types without reflection or allocation. They copy the in-memory
+// representation as is, which matches the ELF data of our little-endian
+// targets only on little-endian hosts. The types must not contain padding.
+
+func init() {
+	one := uint16(1)
+	if *(*byte)(unsafe.Pointer(&one)) != 1 {
+		Fatal("big-endian hosts are not supported")
+	}
+}
+
+func bytesOf[T any](val *T) []byte {
+	return unsafe.Slice((*byte)(unsafe.Pointer(val)), unsafe.Sizeof(*val))
+}
+
 func Read[T any](data []byte) (val T) {
-	reader := bytes.NewReader(data)
-	err := binary.Read(reader, binary.LittleEndian, &val)
-	MustNo(err)
+	if len(data) < int(unsafe.Sizeof(val)) {
+		Fatal("unexpected EOF")
+	}
+	copy(bytesOf(&val), data)
 	return
 }
 
 func Write[T any](data []byte, e T) {
-	buf := &bytes.Buffer{}
-	err := binary.Write(buf, binary.LittleEndian, e)
-	MustNo(err)
-	copy(data, buf.Bytes())
+	copy(data, bytesOf(&e))
+}
+
+func WriteSlice[T any](data []byte, elems []T) {
+	if len(elems) == 0 {
+		return
+	}
+	copy(data, unsafe.Slice((*byte)(unsafe.Pointer(&elems[0])),
+		len(elems)*int(unsafe.Sizeof(elems[0]))))
+}
+
+// ReadSlice returns data as a slice of T. The slice refers to data
+// directly if it is suitably aligned, and to a copy otherwise. It is
+// never nil. Writing to the slice may thus modify data, so callers that
+// write to it must own data.
+func ReadSlice[T any](data []byte) []T {
+	var zero T
+	n := len(data) / int(unsafe.Sizeof(zero))
+	if n == 0 {
+		return make([]T, 0)
+	}
+
+	if uintptr(unsafe.Pointer(&data[0]))%unsafe.Alignof(zero) == 0 {
+		return unsafe.Slice((*T)(unsafe.Pointer(&data[0])), n)
+	}
+
+	vals := make([]T, n)
+	copy(unsafe.Slice((*byte)(unsafe.Pointer(&vals[0])), n*int(unsafe.Sizeof(zero))), data)
+	return vals
 }
 
 func Bit[T Uint](val T, pos int) T {
@@ -129,6 +161,18 @@ func RemoveIf[T any](elems []T, condition func(T) bool) []T {
 	return elems[:i]
 }
 
+func IsEqual[T comparable](x, y []T) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func RemovePrefix(s, prefix string) (string, bool) {
 	if strings.HasPrefix(s, prefix) {
 		s = strings.TrimPrefix(s, prefix)
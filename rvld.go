@@ -1,11 +1,14 @@
 package main
 
 import (
+	"encoding/hex"
 	"fmt"
 	"github.com/ksco/rvld/pkg/linker"
 	"github.com/ksco/rvld/pkg/utils"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 )
 
@@ -35,17 +38,39 @@ func main() {
 	linker.ReadInputFiles(ctx, remaining)
 	linker.CreateInternalFile(ctx)
 	linker.ResolveSymbols(ctx)
+	linker.EliminateComdats(ctx)
+
+	if !ctx.Arg.MulDefs {
+		linker.CheckDuplicateSymbols(ctx)
+	}
+
+	if ctx.Arg.Relocatable {
+		linker.CombineObjects(ctx)
+		if ctx.Arg.PrintMap {
+			linker.PrintMap(ctx)
+		}
+		return
+	}
+
 	linker.RegisterSectionPieces(ctx)
 	linker.ComputeImportExport(ctx)
+
+	if ctx.Arg.GcSections {
+		linker.GcSections(ctx)
+	}
+
 	linker.ComputeMergedSectionSizes(ctx)
 	linker.CreateSyntheticSections(ctx)
 	linker.BinSections(ctx)
 	ctx.Chunks = append(ctx.Chunks, linker.CollectOutputSections(ctx)...)
 	linker.AddSyntheticSymbols(ctx)
 	linker.ClaimUnresolvedSymbols(ctx)
+	linker.ReportUndefinedSymbols(ctx)
+	linker.CheckDefsyms(ctx)
 	linker.ScanRels(ctx)
 	linker.ComputeSectionSizes(ctx)
 	linker.SortOutputSections(ctx)
+	linker.ComputeSymtabSize(ctx)
 
 	for _, chunk := range ctx.Chunks {
 		chunk.UpdateShdr(ctx)
@@ -70,18 +95,20 @@ func main() {
 	linker.SetOsecOffsets(ctx)
 	fileSize := linker.ResizeSections(ctx)
 	linker.FixSyntheticSymbols(ctx)
+	linker.CheckLinkerScript(ctx)
+	utils.CheckErrors()
 
-	ctx.Buf = make([]byte, fileSize)
-
-	file, err := os.OpenFile(ctx.Arg.Output, os.O_RDWR|os.O_CREATE, 0777)
-	utils.MustNo(err)
-
-	for _, chunk := range ctx.Chunks {
-		chunk.CopyBuf(ctx)
+	file := linker.OpenOutputFile(ctx, fileSize)
+	linker.CopyBuf(ctx)
+	if ctx.BuildId != nil {
+		ctx.BuildId.WriteBuildId(ctx)
 	}
+	utils.CheckErrors()
+	file.Close(0777)
 
-	_, err = file.Write(ctx.Buf)
-	utils.MustNo(err)
+	if ctx.Arg.PrintMap {
+		linker.PrintMap(ctx)
+	}
 }
 
 func parseNonpositionalArgs(ctx *linker.Context) []string {
@@ -95,10 +122,16 @@ func parseNonpositionalArgs(ctx *linker.Context) []string {
 		return []string{"-" + name, "--" + name}
 	}
 
+	utils.ColorDiagnostics = isTerminal(os.Stderr)
+
 	args := os.Args[1:]
 	remaining := make([]string, 0)
 	var arg string
 
+	// -1 if neither --allow-shlib-undefined nor
+	// --no-allow-shlib-undefined is given.
+	allowShlibUndefined := -1
+
 	readArg := func(name string) bool {
 		for _, opt := range dashes(name) {
 			if args[0] == opt {
@@ -111,9 +144,15 @@ func parseNonpositionalArgs(ctx *linker.Context) []string {
 				return true
 			}
 
+			// Most single-letter options take their argument only as
+			// the next argument, so that they don't match long options
+			// beginning with the same letter, such as -eh-frame-hdr
+			// for -e.
 			prefix := opt
 			if len(name) > 1 {
 				prefix += "="
+			} else if !strings.Contains("lLmo", name) {
+				continue
 			}
 
 			if strings.HasPrefix(args[0], prefix) {
@@ -125,6 +164,19 @@ func parseNonpositionalArgs(ctx *linker.Context) []string {
 		return false
 	}
 
+	// hasNumber reports whether the option is followed by a number, for
+	// options whose argument is optional.
+	hasNumber := func() bool {
+		if strings.Contains(args[0], "=") {
+			return true
+		}
+		if len(args) < 2 {
+			return false
+		}
+		_, err := strconv.Atoi(args[1])
+		return err == nil
+	}
+
 	readFlag := func(name string) bool {
 		for _, opt := range dashes(name) {
 			if args[0] == opt {
@@ -143,6 +195,8 @@ func parseNonpositionalArgs(ctx *linker.Context) []string {
 
 		if readArg("o") || readArg("output") {
 			ctx.Arg.Output = arg
+		} else if readArg("e") || readArg("entry") {
+			ctx.Arg.Entry = arg
 		} else if readFlag("v") || readFlag("version") {
 			fmt.Printf("rvld %s\n", version)
 			os.Exit(0)
@@ -153,22 +207,154 @@ func parseNonpositionalArgs(ctx *linker.Context) []string {
 				utils.Fatal(fmt.Sprintf("unknown -m argument: %s", arg))
 			}
 		} else if readArg("sysroot") {
-			// Ignored
+			ctx.Arg.Sysroot = arg
 		} else if readArg("L") || readArg("library-path") {
 			ctx.Arg.LibraryPaths = append(ctx.Arg.LibraryPaths, arg)
 		} else if readArg("l") {
 			remaining = append(remaining, "-l"+arg)
 		} else if readFlag("static") {
-			// Do nothing.
+			ctx.Arg.IsStatic = true
+			remaining = append(remaining, "-Bstatic")
+		} else if readFlag("Bstatic") {
+			remaining = append(remaining, "-Bstatic")
+		} else if readFlag("whole-archive") {
+			remaining = append(remaining, "--whole-archive")
+		} else if readFlag("no-whole-archive") {
+			remaining = append(remaining, "--no-whole-archive")
+		} else if readFlag("start-group") || readFlag("(") {
+			remaining = append(remaining, "--start-group")
+		} else if readFlag("end-group") || readFlag(")") {
+			remaining = append(remaining, "--end-group")
+		} else if readArg("thread-count") || (hasNumber() && readArg("threads")) {
+			threads, err := strconv.Atoi(arg)
+			if err != nil || threads < 1 {
+				utils.Fatal(fmt.Sprintf("-threads: invalid number: %s", arg))
+			}
+			ctx.Arg.Threads = threads
+		} else if readFlag("threads") {
+			ctx.Arg.Threads = runtime.NumCPU()
+		} else if readFlag("no-threads") {
+			ctx.Arg.Threads = 1
+		} else if readFlag("fatal-warnings") {
+			utils.FatalWarnings = true
+		} else if readFlag("no-fatal-warnings") {
+			utils.FatalWarnings = false
+		} else if readFlag("color-diagnostics") {
+			utils.ColorDiagnostics = true
+		} else if readFlag("no-color-diagnostics") {
+			utils.ColorDiagnostics = false
+		} else if readArg("color-diagnostics") {
+			switch arg {
+			case "always":
+				utils.ColorDiagnostics = true
+			case "never":
+				utils.ColorDiagnostics = false
+			case "auto":
+				utils.ColorDiagnostics = isTerminal(os.Stderr)
+			default:
+				utils.Fatal(fmt.Sprintf("invalid argument: --color-diagnostics=%s", arg))
+			}
+		} else if readArg("unresolved-symbols") {
+			switch arg {
+			case "report-all":
+				ctx.Arg.UnresolvedSymbols = linker.UnresolvedReportAll
+			case "ignore-all":
+				ctx.Arg.UnresolvedSymbols = linker.UnresolvedIgnoreAll
+			case "ignore-in-object-files":
+				ctx.Arg.UnresolvedSymbols = linker.UnresolvedIgnoreInObjectFiles
+			case "ignore-in-shared-libs":
+				ctx.Arg.UnresolvedSymbols = linker.UnresolvedIgnoreInSharedLibs
+			default:
+				utils.Fatal(fmt.Sprintf("unknown --unresolved-symbols argument: %s", arg))
+			}
+		} else if readFlag("allow-multiple-definition") {
+			ctx.Arg.MulDefs = true
+		} else if readFlag("no-allow-multiple-definition") {
+			ctx.Arg.MulDefs = false
+		} else if readFlag("no-undefined") {
+			ctx.Arg.ZDefs = true
+		} else if readFlag("allow-shlib-undefined") {
+			allowShlibUndefined = 1
+		} else if readFlag("no-allow-shlib-undefined") {
+			allowShlibUndefined = 0
+		} else if readArg("z") {
+			switch arg {
+			case "defs":
+				ctx.Arg.ZDefs = true
+			case "undefs":
+				ctx.Arg.ZDefs = false
+			case "muldefs":
+				ctx.Arg.MulDefs = true
+			default:
+				utils.Warn(fmt.Sprintf("unknown -z option: %s", arg))
+			}
+		} else if readFlag("warn-backrefs") {
+			ctx.Arg.WarnBackrefs = true
+		} else if readFlag("no-warn-backrefs") {
+			ctx.Arg.WarnBackrefs = false
+		} else if readFlag("Bdynamic") {
+			remaining = append(remaining, "-Bdynamic")
+		} else if readArg("Map") {
+			ctx.Arg.Map = arg
+			ctx.Arg.PrintMap = true
+		} else if readFlag("M") || readFlag("print-map") {
+			ctx.Arg.PrintMap = true
+		} else if readFlag("r") || readFlag("relocatable") {
+			ctx.Arg.Relocatable = true
+		} else if readFlag("shared") || readFlag("Bshareable") {
+			ctx.Arg.Shared = true
+		} else if readArg("soname") || readArg("h") {
+			ctx.Arg.Soname = arg
+		} else if readFlag("pie") || readFlag("pic-executable") {
+			ctx.Arg.Pie = true
+		} else if readFlag("no-pie") || readFlag("no-pic-executable") {
+			ctx.Arg.Pie = false
+		} else if readArg("T") || readArg("script") {
+			ctx.Arg.Scripts = append(ctx.Arg.Scripts, arg)
+		} else if readArg("defsym") {
+			name, expr, ok := strings.Cut(arg, "=")
+			if !ok || name == "" || expr == "" {
+				utils.Fatal(fmt.Sprintf("-defsym: syntax error: %s", arg))
+			}
+			ctx.Arg.Defsyms = append(ctx.Arg.Defsyms,
+				linker.Defsym{Name: name, Expr: expr})
+		} else if readArg("dynamic-linker") || readArg("I") {
+			ctx.Arg.DynamicLinker = arg
+		} else if readFlag("gc-sections") {
+			ctx.Arg.GcSections = true
+		} else if readFlag("no-gc-sections") {
+			ctx.Arg.GcSections = false
+		} else if readFlag("print-gc-sections") {
+			ctx.Arg.PrintGcSections = true
+		} else if readFlag("no-print-gc-sections") {
+			ctx.Arg.PrintGcSections = false
+		} else if readFlag("eh-frame-hdr") {
+			ctx.Arg.EhFrameHdr = true
+		} else if readFlag("no-eh-frame-hdr") {
+			ctx.Arg.EhFrameHdr = false
+		} else if readFlag("relax") {
+			ctx.Arg.Relax = true
+		} else if readFlag("no-relax") {
+			ctx.Arg.Relax = false
+		} else if readFlag("build-id") {
+			ctx.Arg.BuildId = linker.BuildId{Kind: linker.BuildIdSha1}
+		} else if readFlag("no-build-id") {
+			ctx.Arg.BuildId = linker.BuildId{Kind: linker.BuildIdNone}
+		} else if readArg("build-id") {
+			ctx.Arg.BuildId = parseBuildId(arg)
+		} else if readFlag("s") || readFlag("strip-all") {
+			ctx.Arg.StripAll = true
+		} else if readFlag("x") || readFlag("discard-all") {
+			ctx.Arg.DiscardAll = true
+		} else if readFlag("X") || readFlag("discard-locals") {
+			ctx.Arg.DiscardLocals = true
 		} else if readArg("plugin") ||
 			readArg("plugin-opt") ||
 			readFlag("as-needed") ||
-			readFlag("start-group") ||
-			readFlag("end-group") ||
-			readArg("hash-style") ||
-			readArg("build-id") ||
-			readFlag("s") ||
-			readFlag("no-relax") {
+			readFlag("no-as-needed") ||
+			readFlag("push-state") ||
+			readFlag("pop-state") ||
+			readArg("hash-style") {
 			// Ignored
 		} else {
 			if args[0][0] == '-' {
@@ -179,9 +365,55 @@ func parseNonpositionalArgs(ctx *linker.Context) []string {
 		}
 	}
 
+	if ctx.Arg.Shared {
+		ctx.Arg.Pie = false
+		ctx.DefaultVersion = linker.VER_NDX_GLOBAL
+	}
+
+	// Undefined symbols in shared objects are allowed by default only if
+	// the output is a shared object.
+	if allowShlibUndefined == -1 {
+		ctx.Arg.AllowShlibUndefined = ctx.Arg.Shared
+	} else {
+		ctx.Arg.AllowShlibUndefined = allowShlibUndefined == 1
+	}
+
+	ctx.Arg.Pic = ctx.Arg.Pie || ctx.Arg.Shared
+	if ctx.Arg.Pic {
+		ctx.Arg.ImageBase = 0
+	}
+
 	for i, path := range ctx.Arg.LibraryPaths {
-		ctx.Arg.LibraryPaths[i] = filepath.Clean(path)
+		ctx.Arg.LibraryPaths[i] = filepath.Clean(linker.ResolveSysroot(ctx, path))
 	}
 
 	return remaining
 }
+
+func parseBuildId(arg string) linker.BuildId {
+	switch arg {
+	case "none":
+		return linker.BuildId{Kind: linker.BuildIdNone}
+	case "md5":
+		return linker.BuildId{Kind: linker.BuildIdMd5}
+	case "sha1":
+		return linker.BuildId{Kind: linker.BuildIdSha1}
+	case "uuid":
+		return linker.BuildId{Kind: linker.BuildIdUuid}
+	}
+
+	if strings.HasPrefix(arg, "0x") || strings.HasPrefix(arg, "0X") {
+		value, err := hex.DecodeString(arg[2:])
+		if err == nil && len(value) > 0 {
+			return linker.BuildId{Kind: linker.BuildIdHex, Value: value}
+		}
+	}
+
+	utils.Fatal(fmt.Sprintf("invalid --build-id argument: %s", arg))
+	return linker.BuildId{}
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
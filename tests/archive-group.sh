@@ -0,0 +1,62 @@
+#!/bin/bash
+
+set -e
+
+test_name=$(basename "$0" .sh)
+t=out/tests/$test_name
+
+rm -rf "$t"
+mkdir -p "$t"
+
+cat <<EOF | $CC -o "$t"/a.o -c -xassembler -
+  .globl _start
+_start:
+  call foo
+  ret
+EOF
+
+cat <<EOF | $CC -o "$t"/foo.o -c -xassembler -
+  .globl foo
+foo:
+  ret
+EOF
+
+cat <<EOF | $CC -o "$t"/unused.o -c -xassembler -
+  .globl unused
+unused:
+  ret
+EOF
+
+ar rcs "$t"/libx.a "$t"/foo.o "$t"/unused.o
+
+# Only the needed members are linked, unless --whole-archive is given.
+./rvld -static "$t"/a.o "$t"/libx.a -o "$t"/out
+readelf -sW "$t"/out | grep -q ' foo$'
+readelf -sW "$t"/out | grep -q ' unused$' && exit 1
+
+./rvld -static "$t"/a.o --whole-archive "$t"/libx.a --no-whole-archive \
+  -o "$t"/out
+readelf -sW "$t"/out | grep -q ' unused$'
+
+# A member needed only by a later file is a backward reference, unless
+# both are in the same group.
+./rvld -static --warn-backrefs "$t"/a.o "$t"/libx.a -o "$t"/out 2> "$t"/log
+[ ! -s "$t"/log ]
+
+./rvld -static --warn-backrefs "$t"/libx.a "$t"/a.o -o "$t"/out 2> "$t"/log
+grep -q 'backward reference detected: foo in .*a.o refers to .*libx.a(.*foo.o)' "$t"/log
+
+./rvld -static --warn-backrefs --start-group "$t"/libx.a "$t"/a.o --end-group \
+  -o "$t"/out 2> "$t"/log
+[ ! -s "$t"/log ]
+
+# Groups must be balanced and cannot be nested.
+./rvld -static --start-group "$t"/a.o -o "$t"/out 2> "$t"/log && exit 1
+grep -q 'missing --end-group' "$t"/log
+
+./rvld -static --start-group --start-group "$t"/a.o --end-group --end-group \
+  -o "$t"/out 2> "$t"/log && exit 1
+grep -q 'nested --start-group' "$t"/log
+
+./rvld -static "$t"/a.o --end-group -o "$t"/out 2> "$t"/log && exit 1
+grep -q 'stray --end-group' "$t"/log
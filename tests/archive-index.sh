@@ -0,0 +1,43 @@
+#!/bin/bash
+
+set -e
+
+test_name=$(basename "$0" .sh)
+t=out/tests/$test_name
+
+mkdir -p "$t"
+
+cat <<EOF | $CC -o "$t"/a.o -c -xassembler -
+  .globl _start
+_start:
+  call foo
+  ret
+EOF
+
+cat <<EOF | $CC -o "$t"/b.o -c -xassembler -
+  .globl foo
+foo:
+  ret
+EOF
+
+rm -f "$t"/libx.a
+ar rcs "$t"/libx.a "$t"/b.o
+
+# Members of an archive read without --whole-archive are library members,
+# even if --whole-archive is given after the archive.
+./rvld -static --warn-backrefs "$t"/libx.a "$t"/a.o --whole-archive \
+  -o "$t"/out 2> "$t"/log
+grep -q 'backward reference detected: foo in .*a.o refers to .*libx.a(b.o)' "$t"/log
+
+# A corrupted symbol table is reported rather than crashing. The first is
+# a member count larger than the table, and the second is a member offset
+# past the end of the archive.
+cp "$t"/libx.a "$t"/bad1.a
+printf '\x00\xff\xff\xff' | dd of="$t"/bad1.a bs=1 seek=68 conv=notrunc 2> /dev/null
+./rvld -static "$t"/bad1.a "$t"/a.o -o "$t"/out 2> "$t"/log && exit 1
+grep -q 'bad1.a: corrupted archive symbol table' "$t"/log
+
+cp "$t"/libx.a "$t"/bad2.a
+printf '\x00\x00\x10\x00' | dd of="$t"/bad2.a bs=1 seek=72 conv=notrunc 2> /dev/null
+./rvld -static "$t"/bad2.a "$t"/a.o -o "$t"/out 2> "$t"/log && exit 1
+grep -q 'bad2.a: corrupted archive symbol table' "$t"/log
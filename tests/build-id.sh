@@ -0,0 +1,48 @@
+#!/bin/bash
+
+set -e
+
+test_name=$(basename "$0" .sh)
+t=out/tests/$test_name
+
+mkdir -p "$t"
+
+cat <<EOF | $CC -o "$t"/a.o -c -xassembler -
+  .globl _start
+_start:
+  ret
+EOF
+
+get_id() {
+  readelf -n "$1" | awk '/Build ID:/ { print $3 }'
+}
+
+# Hash IDs are computed over the output with the ID itself zeroed, so
+# they can be checked by recomputing them.
+for kind in md5 sha1; do
+  ./rvld -static --build-id=$kind "$t"/a.o -o "$t"/$kind
+  readelf -lW "$t"/$kind | grep -q NOTE
+
+  off=$(readelf -SW "$t"/$kind | sed 's/^.*\]//' | \
+    awk '$1 == ".note.gnu.build-id" { print $4 }')
+  id=$(get_id "$t"/$kind)
+  cp "$t"/$kind "$t"/$kind.zero
+  dd if=/dev/zero of="$t"/$kind.zero bs=1 seek=$((0x$off + 16)) \
+    count=$((${#id} / 2)) conv=notrunc 2> /dev/null
+  [ "$id" = "$(${kind}sum "$t"/$kind.zero | cut -d' ' -f1)" ]
+done
+
+# --build-id alone is sha1.
+./rvld -static --build-id "$t"/a.o -o "$t"/out
+[ "$(get_id "$t"/out)" = "$(get_id "$t"/sha1)" ]
+
+./rvld -static --build-id=0xdeadbeef "$t"/a.o -o "$t"/out
+[ "$(get_id "$t"/out)" = deadbeef ]
+
+./rvld -static --build-id=uuid "$t"/a.o -o "$t"/out
+get_id "$t"/out | grep -Eq '^[0-9a-f]{12}4[0-9a-f]{3}[89ab][0-9a-f]{15}$'
+
+./rvld -static --build-id=none "$t"/a.o -o "$t"/out
+readelf -SW "$t"/out | grep -q build-id && exit 1
+
+exit 0
@@ -0,0 +1,50 @@
+#!/bin/bash
+
+set -e
+
+test_name=$(basename "$0" .sh)
+t=out/tests/$test_name
+
+mkdir -p "$t"
+
+cat <<EOF | $CC -o "$t"/a.o -c -xassembler -
+  .globl _start
+_start:
+  call inl
+  call f1
+  call f2
+  ret
+EOF
+
+# b1.o and b2.o define the same COMDAT group, which the first file wins.
+for i in 1 2; do
+  cat <<EOF | $CC -o "$t"/b$i.o -c -xassembler -
+  .section .text.inl,"axG",@progbits,inl,comdat
+  .globl inl
+  .type inl, @function
+inl:
+  li a0, 10$i
+  ret
+
+  .section .rodata.inl,"aG",@progbits,inl,comdat
+  .word 20$i
+
+  .text
+  .globl f$i
+f$i:
+  ret
+EOF
+done
+
+./rvld -static "$t"/a.o "$t"/b2.o "$t"/b1.o -o "$t"/out
+
+# Only the code and data of b2.o's group are linked, and inl isn't a
+# duplicate symbol.
+$OBJDUMP -d -M no-aliases "$t"/out > "$t"/log
+grep -Eq 'addi\s+a0, ?zero, ?102$' "$t"/log
+grep -Eq 'addi\s+a0, ?zero, ?101$' "$t"/log && exit 1
+readelf -x .rodata "$t"/out > "$t"/log
+grep -q ' ca000000' "$t"/log
+grep -q ' c9000000' "$t"/log && exit 1
+
+exit 0
@@ -0,0 +1,59 @@
+#!/bin/bash
+
+set -e
+
+test_name=$(basename "$0" .sh)
+t=out/tests/$test_name
+
+rm -rf "$t"
+mkdir -p "$t"
+
+cat <<EOF | $CC -o "$t"/a.o -c -xassembler -
+  .globl _start
+_start:
+  call u1
+  call u2
+  ret
+EOF
+
+cat <<EOF | $CC -o "$t"/b.o -c -xassembler -
+  .globl _start
+_start:
+  call foo
+  ret
+EOF
+
+cat <<EOF | $CC -o "$t"/foo.o -c -xassembler -
+  .globl foo
+foo:
+  ret
+EOF
+
+rm -f "$t"/libfoo.a
+ar rcs "$t"/libfoo.a "$t"/foo.o
+
+# All undefined symbols are reported with their locations before exiting,
+# and no output file is left behind.
+./rvld -static "$t"/a.o -o "$t"/out 2> "$t"/log && exit 1
+grep -q '^rvld: error: undefined symbol: u1$' "$t"/log
+grep -q '^>>> referenced by .*a.o:(.text+0x0)$' "$t"/log
+grep -q '^rvld: error: undefined symbol: u2$' "$t"/log
+grep -q '^>>> referenced by .*a.o:(.text+0x8)$' "$t"/log
+grep -q goroutine "$t"/log && exit 1
+[ ! -e "$t"/out ]
+
+# Fatal errors name the file.
+./rvld -static "$t"/a.o "$t"/libfoo.a "$t"/a.o.missing -o "$t"/out 2> "$t"/log && exit 1
+grep -q '^rvld: fatal: .*a.o.missing' "$t"/log
+
+# Warnings don't fail the link unless --fatal-warnings is given.
+./rvld -static --warn-backrefs "$t"/libfoo.a "$t"/b.o -o "$t"/out 2> "$t"/log
+grep -q '^rvld: warning: backward reference detected: foo' "$t"/log
+
+./rvld -static --warn-backrefs --fatal-warnings "$t"/libfoo.a "$t"/b.o \
+  -o "$t"/out 2> "$t"/log && exit 1
+grep -q '^rvld: error: backward reference detected: foo' "$t"/log
+
+# --color-diagnostics highlights the kind of the message.
+./rvld -static --color-diagnostics "$t"/a.o -o "$t"/out 2> "$t"/log && exit 1
+grep -q $'^rvld: \033\\[0;1;31merror:\033\\[0m undefined symbol: u1$' "$t"/log
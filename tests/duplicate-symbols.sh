@@ -0,0 +1,64 @@
+#!/bin/bash
+
+set -e
+
+test_name=$(basename "$0" .sh)
+t=out/tests/$test_name
+
+rm -rf "$t"
+mkdir -p "$t"
+
+cat <<EOF | $CC -o "$t"/a.o -c -xassembler -
+  .globl _start
+_start:
+  call init_hw
+  ret
+EOF
+
+cat <<EOF | $CC -o "$t"/b.o -c -xassembler -
+  .globl init_hw
+init_hw:
+  li a0, 1
+  ret
+EOF
+
+cat <<EOF | $CC -o "$t"/c.o -c -xassembler -
+  .text
+  nop
+  .globl init_hw
+init_hw:
+  li a0, 2
+  ret
+EOF
+
+cat <<EOF | $CC -o "$t"/weak.o -c -xassembler -
+  .weak init_hw
+init_hw:
+  ret
+EOF
+
+cat <<EOF | $CC -o "$t"/common.o -c -xassembler -
+  .comm init_hw, 8, 8
+EOF
+
+rm -f "$t"/libc.a
+ar rcs "$t"/libc.a "$t"/c.o
+
+# Two strong definitions are an error, which lists both of them.
+./rvld -static "$t"/a.o "$t"/b.o "$t"/c.o -o "$t"/out 2> "$t"/log && exit 1
+grep -q '^rvld: error: duplicate symbol: init_hw$' "$t"/log
+grep -q '^>>> defined at .*b.o:(.text+0x0)$' "$t"/log
+grep -q '^>>> defined at .*c.o:(.text+0x2)$' "$t"/log
+
+# Weak and common definitions, and archive members that are not loaded,
+# do not conflict with a strong definition.
+./rvld -static "$t"/a.o "$t"/b.o "$t"/weak.o -o "$t"/out
+./rvld -static "$t"/a.o "$t"/b.o "$t"/common.o -o "$t"/out
+./rvld -static "$t"/a.o "$t"/b.o "$t"/libc.a -o "$t"/out
+
+# The first definition wins if multiple definitions are allowed.
+for opt in --allow-multiple-definition '-z muldefs'; do
+  ./rvld -static $opt "$t"/a.o "$t"/b.o "$t"/c.o -o "$t"/out
+  $OBJDUMP -d -M no-aliases "$t"/out | grep -A1 '<init_hw>:' > "$t"/log
+  grep -Eq 'c\.li\s+a0, ?1$' "$t"/log
+done
@@ -0,0 +1,72 @@
+#!/bin/bash
+
+set -e
+
+test_name=$(basename "$0" .sh)
+t=out/tests/$test_name
+
+mkdir -p "$t"
+
+cat <<EOF | $CC -o "$t"/a.o -c -xassembler -
+  .globl _start
+_start:
+  call foo
+  lui a0, %hi(var)
+  ld a0, %lo(var)(a0)
+  ret
+EOF
+
+cat <<EOF | $CC -o "$t"/b.o -c -xassembler -
+  .text
+  .globl foo
+  .type foo, @function
+foo:
+  ret
+
+  .data
+  .globl var
+  .type var, @object
+  .size var, 8
+var:
+  .dword 3
+EOF
+
+cat <<EOF | $CC -o "$t"/c.o -c -xassembler -
+  .globl _start
+_start:
+  lla a0, ptr
+  ret
+
+  .data
+ptr:
+  .dword _start
+EOF
+
+# A shared object is named by its soname.
+./rvld -shared -soname libfoo.so "$t"/b.o -o "$t"/libfoo.so
+readelf -h "$t"/libfoo.so | grep -q 'DYN (Shared object file)'
+readelf -d "$t"/libfoo.so | grep -q 'Library soname: \[libfoo.so\]'
+
+# Functions in a shared object are called through the PLT, and data in
+# it is copied into the executable.
+./rvld -dynamic-linker /lib/ld.so "$t"/a.o "$t"/libfoo.so -o "$t"/exe
+readelf -d "$t"/exe | grep -q 'Shared library: \[libfoo.so\]'
+readelf -lW "$t"/exe | grep -q 'DYNAMIC'
+readelf -lW "$t"/exe | grep -q 'INTERP'
+readelf -SW "$t"/exe | grep -q '\.plt '
+readelf -rW "$t"/exe > "$t"/log
+grep -Eq 'R_RISCV_JUMP_SLOT .* foo \+ 0' "$t"/log
+grep -Eq 'R_RISCV_COPY .* var \+ 0' "$t"/log
+
+# Absolute addresses in a PIE are relocated at load time.
+./rvld -pie "$t"/c.o -o "$t"/pie
+readelf -h "$t"/pie | grep -q 'DYN (Position-Independent Executable file)'
+readelf -rW "$t"/pie | grep -q 'R_RISCV_RELATIVE'
+
+# A position-dependent executable without shared objects has no dynamic
+# sections.
+./rvld "$t"/c.o -o "$t"/exe2
+readelf -SW "$t"/exe2 | grep -Eq '\.dyn|\.plt|\.hash|\.interp' && exit 1
+readelf -lW "$t"/exe2 | grep -Eq 'DYNAMIC|INTERP' && exit 1
+
+exit 0
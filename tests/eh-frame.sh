@@ -0,0 +1,55 @@
+#!/bin/bash
+
+set -e
+
+test_name=$(basename "$0" .sh)
+t=out/tests/$test_name
+
+mkdir -p "$t"
+
+cat <<EOF | $CC -o "$t"/a.o -c -xassembler -
+  .globl _start
+_start:
+  call f1
+  call f2
+  ret
+EOF
+
+# Each file has an FDE for a live function and one for a dead one.
+for i in 1 2; do
+  cat <<EOF | $CC -o "$t"/b$i.o -c -xassembler -
+  .section .text.f$i,"ax",@progbits
+  .globl f$i
+  .type f$i, @function
+f$i:
+  .cfi_startproc
+  addi sp, sp, -16
+  .cfi_def_cfa_offset 16
+  addi sp, sp, 16
+  ret
+  .cfi_endproc
+
+  .section .text.g$i,"ax",@progbits
+g$i:
+  .cfi_startproc
+  ret
+  .cfi_endproc
+EOF
+done
+
+./rvld -static --gc-sections --eh-frame-hdr "$t"/a.o "$t"/b1.o "$t"/b2.o -o "$t"/out
+
+# The identical CIEs are merged, and only the FDEs of live functions are
+# kept, pointing to the functions.
+readelf -wf "$t"/out > "$t"/log
+[ "$(grep -c ' CIE' "$t"/log)" = 1 ]
+[ "$(grep -c ' FDE' "$t"/log)" = 2 ]
+
+for f in f1 f2; do
+  addr=$(readelf -sW "$t"/out | awk -v f=$f '$8 == f { print $2 }')
+  grep -q "FDE cie=00000000 pc=$addr\.\." "$t"/log
+done
+
+# .eh_frame_hdr has a segment and a table with an entry for each FDE.
+readelf -lW "$t"/out | grep -q GNU_EH_FRAME
+readelf -x .eh_frame_hdr "$t"/out | grep -Eq '^  0x[0-9a-f]+ 011b033b [0-9a-f]{8} 02000000 '
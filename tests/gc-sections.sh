@@ -0,0 +1,37 @@
+#!/bin/bash
+
+set -e
+
+test_name=$(basename "$0" .sh)
+t=out/tests/$test_name
+
+mkdir -p "$t"
+
+cat <<EOF | $CC -o "$t"/a.o -c -xassembler -
+  .section .text._start,"ax",@progbits
+  .globl _start
+_start:
+  call used
+  ret
+
+  .section .text.used,"ax",@progbits
+used:
+  ret
+
+  .section .text.unused,"ax",@progbits
+unused:
+  ret
+EOF
+
+# Removed sections are listed on stderr, so that they don't mix with
+# other output such as the link map.
+./rvld -static --gc-sections --print-gc-sections "$t"/a.o -o "$t"/out \
+  > "$t"/stdout 2> "$t"/log
+[ ! -s "$t"/stdout ]
+grep -q '^rvld: removing unused section .*a.o:(.text.unused)$' "$t"/log
+grep -q 'text.used' "$t"/log && exit 1
+
+readelf -sW "$t"/out | grep -q ' used$'
+readelf -sW "$t"/out | grep -q ' unused$' && exit 1
+
+exit 0
@@ -0,0 +1,35 @@
+#!/bin/bash
+
+set -e
+
+test_name=$(basename "$0" .sh)
+t=out/tests/$test_name
+
+mkdir -p "$t"
+
+cat <<EOF | $CC -o "$t"/a.o -c -xassembler -
+  .globl _start
+_start:
+  lui a0, %hi(dat)
+  lw a0, %lo(dat)(a0)
+  ret
+
+  .data
+dat:
+  .word 1
+
+  .bss
+  .zero 16
+EOF
+
+./rvld -static "$t"/a.o -o "$t"/out
+
+# Without .sdata, __global_pointer$ is where an empty .sdata would be,
+# which is after .data and before .bss.
+data=$(readelf -SW "$t"/out | sed 's/^.*\]//' | awk '$1 == ".data" { print "0x" $3 }')
+gp=$(readelf -sW "$t"/out | awk '$8 == "__global_pointer$" { print "0x" $2 }')
+[ $((gp)) = $((data + 4 + 0x800)) ]
+
+# An undefined --defsym target is reported once.
+./rvld -static "$t"/a.o --defsym foo=nosuch -o "$t"/out 2> "$t"/log && exit 1
+[ "$(grep -c 'undefined symbol: nosuch' "$t"/log)" = 1 ]
@@ -0,0 +1,59 @@
+#!/bin/bash
+
+set -e
+
+test_name=$(basename "$0" .sh)
+t=out/tests/$test_name
+
+mkdir -p "$t"
+
+# _sidata refers to .data before it is laid out, and relaxation shrinks
+# .text, which moves the load address of .data.
+cat <<EOF > "$t"/script.ld
+ENTRY(_start)
+MEMORY
+{
+  FLASH (rx) : ORIGIN = 0x20000000, LENGTH = 64K
+  RAM (rwx)  : ORIGIN = 0x80000000, LENGTH = 16K
+}
+SECTIONS
+{
+  .text : { *(.text .text.*) } > FLASH
+  _sidata = LOADADDR(.data);
+  .data : { *(.data .data.*) } > RAM AT> FLASH
+  .bss (NOLOAD) : { *(.bss .bss.*) } > RAM
+}
+EOF
+
+cat <<EOF | $CC -o "$t"/a.o -c -xassembler -
+  .text
+  .globl _start, g
+_start:
+  lui a0, %hi(_sidata)
+  addi a0, a0, %lo(_sidata)
+  ret
+g:
+  ret
+EOF
+
+for i in 1 2 3 4 5 6 7 8 9; do
+  cat <<EOF | $CC -o "$t"/b$i.o -c -xassembler -
+  .text
+  .globl f$i
+f$i:
+  call g
+  call g
+  call g
+  call g
+  ret
+  .data
+  .word $i
+EOF
+done
+
+./rvld -static -T "$t"/script.ld "$t"/a.o "$t"/b?.o -o "$t"/out
+
+sidata=$(readelf -sW "$t"/out | awk '$8 == "_sidata" { print "0x" $2 }')
+paddr=$(readelf -lW "$t"/out | awk '$1 == "LOAD" && $3 == "0x0000000080000000" { print $4 }')
+
+[ -n "$sidata" ] && [ -n "$paddr" ] && [ $((sidata)) -eq $((paddr)) ]
@@ -0,0 +1,32 @@
+#!/bin/bash
+
+set -e
+
+test_name=$(basename "$0" .sh)
+t=out/tests/$test_name
+
+mkdir -p "$t"
+
+cat <<EOF | $CC -o "$t"/a.o -c -xassembler -
+  .globl _start
+_start:
+  lla a0, msg
+  ret
+EOF
+
+# Each file defines msg in a mergeable section. The first definition
+# wins.
+for i in 1 2 3 4; do
+  cat <<EOF | $CC -o "$t"/b$i.o -c -xassembler -
+  .section .rodata.str1.1,"aMS",@progbits,1
+  .weak msg
+msg:
+  .string "hello$i"
+EOF
+done
+
+./rvld -static -threads=4 "$t"/a.o "$t"/b4.o "$t"/b3.o "$t"/b2.o "$t"/b1.o -o "$t"/out
+
+msg=$(readelf -sW "$t"/out | awk '$8 == "msg" { print "0x" $2 }')
+sec=$(readelf -SW "$t"/out | sed 's/^.*\]//' | awk '$1 == ".rodata.str" { print "0x" $3 }')
+readelf -p .rodata.str "$t"/out | grep -q "\[ *$(printf %x $((msg - sec)))\] *hello4"
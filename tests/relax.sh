@@ -0,0 +1,77 @@
+#!/bin/bash
+
+set -e
+
+test_name=$(basename "$0" .sh)
+t=out/tests/$test_name
+
+mkdir -p "$t"
+
+cat <<EOF | $CC -o "$t"/a.o -c -xassembler -
+  .globl _start
+_start:
+  call near
+  tail near
+  call far
+  lui a0, %hi(small)
+  addi a0, a0, %lo(small)
+  lui a1, %hi(mid)
+  addi a1, a1, %lo(mid)
+  lui a2, %hi(sdat)
+  lw a2, %lo(sdat)(a2)
+  lui a3, %hi(sdat2)
+  .option push
+  .option norelax
+  lw a3, %lo(sdat2)(a3)
+  lui a4, %hi(small+4)
+  .option pop
+  addi a4, a4, %lo(small+4)
+  lui a5, %tprel_hi(tv)
+  add a5, a5, tp, %tprel_add(tv)
+  lw a5, %tprel_lo(tv)(a5)
+near:
+  ret
+
+  .section .text.far,"ax",@progbits
+  .skip 0x200000
+far:
+  ret
+
+  .section .sdata,"aw",@progbits
+sdat:
+  .word 1
+sdat2:
+  .word 2
+
+  .section .tbss,"awT",@nobits
+tv:
+  .word 0
+EOF
+
+./rvld -static --defsym small=0x123 --defsym mid=0x10000 "$t"/a.o -o "$t"/out
+$OBJDUMP -d -M no-aliases "$t"/out > "$t"/log
+
+# Calls to near targets become a jal, or a c.j if they don't link.
+grep -Eq 'jal\s+ra, ?(0x)?[0-9a-f]+ <near>' "$t"/log
+grep -Eq 'c\.j\s+(0x)?[0-9a-f]+ <near>' "$t"/log
+grep -Eq 'auipc\s+ra, ?' "$t"/log
+
+# The lui is deleted if the lo12 can address the symbol relative to zero
+# or to gp, and it becomes a c.lui if its immediate is small.
+grep -Eq 'addi\s+a0, ?zero, ?291$' "$t"/log
+grep -Eq 'c\.lui\s+a1, ?' "$t"/log
+grep -Eq 'addi\s+a1, ?a1, ?0$' "$t"/log
+grep -Eq 'lw\s+a2, ?-2048\(gp\)' "$t"/log
+
+# The lo12 follows the lui even if the lo12 itself is not relaxable, and
+# keeps its base register if the lui is kept.
+grep -Eq 'lw\s+a3, ?-2044\(gp\)' "$t"/log
+grep -Eq 'lui\s+a4, ?0' "$t"/log
+grep -Eq 'addi\s+a4, ?a4, ?295$' "$t"/log
+
+# The lui and the add are deleted if the TLS variable is close to tp.
+grep -Eq 'lw\s+a5, ?0\(tp\)' "$t"/log
+grep -Eq 'lui\s+a5' "$t"/log && exit 1
+grep -Eq 'add\s+a5' "$t"/log && exit 1
+
+exit 0
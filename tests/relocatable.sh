@@ -0,0 +1,71 @@
+#!/bin/bash
+
+set -e
+
+test_name=$(basename "$0" .sh)
+t=out/tests/$test_name
+
+mkdir -p "$t"
+
+cat <<EOF | $CC -o "$t"/a.o -c -xassembler -
+  .text
+  .globl _start
+_start:
+  call foo
+  call f1
+  call f2
+  lla a0, msg
+  li a7, 93
+  ecall
+  .section .rodata.str1.1,"aMS",@progbits,1
+msg:
+  .string "hello"
+EOF
+
+cat <<EOF | $CC -o "$t"/b.o -c -xassembler -
+  .text
+  .globl foo
+foo:
+  lui a1, %hi(counter)
+  addi a1, a1, %lo(counter)
+  ret
+  .data
+  .globl counter
+counter:
+  .dword 5
+EOF
+
+# c.o and d.o define the same COMDAT group.
+for i in 1 2; do
+  cat <<EOF | $CC -o "$t"/c$i.o -c -xassembler -
+  .section .text.inl,"axG",@progbits,inl,comdat
+  .weak inl
+  .type inl, @function
+inl:
+  li a0, $i
+  ret
+  .section .data.inl,"awG",@progbits,inl,comdat
+  .weak inl_data
+inl_data:
+  .dword $i
+  .text
+  .globl f$i
+f$i:
+  call inl
+  lla a0, inl_data
+EOF
+done
+
+./rvld -r "$t"/a.o "$t"/b.o "$t"/c1.o -o "$t"/r.o
+
+# The output is an object file, which is not executable.
+readelf -h "$t"/r.o | grep -q 'REL (Relocatable file)'
+[ ! -x "$t"/r.o ]
+
+# The COMDAT group is kept so that it can be deduplicated later.
+readelf -g "$t"/r.o | grep -q "COMDAT group section .* \[inl\] contains 2 sections"
+
+./rvld -static "$t"/r.o "$t"/c2.o -o "$t"/out1
+./rvld -static "$t"/a.o "$t"/b.o "$t"/c1.o "$t"/c2.o -o "$t"/out2
+
+diff <(readelf -x .text -x .data "$t"/out1) <(readelf -x .text -x .data "$t"/out2)
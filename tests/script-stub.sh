@@ -0,0 +1,74 @@
+#!/bin/bash
+
+set -e
+
+test_name=$(basename "$0" .sh)
+t=out/tests/$test_name
+
+rm -rf "$t"
+mkdir -p "$t"/root/usr/lib "$t"/root/usr/lib2
+
+cat <<EOF | $CC -o "$t"/a.o -c -xassembler -
+  .globl _start
+_start:
+  call bar
+  call qux
+  ret
+EOF
+
+cat <<EOF | $CC -o "$t"/bar.o -c -xassembler -
+  .globl bar
+bar:
+  call baz
+  ret
+EOF
+
+cat <<EOF | $CC -o "$t"/bar2.o -c -xassembler -
+  .globl bar2
+bar2:
+  ret
+EOF
+
+cat <<EOF | $CC -o "$t"/baz.o -c -xassembler -
+  .globl baz
+baz:
+  call bar2
+  ret
+EOF
+
+cat <<EOF | $CC -o "$t"/qux.o -c -xassembler -
+  .globl qux
+qux:
+  ret
+EOF
+
+ar rcs "$t"/root/usr/lib/libbar.a "$t"/bar.o "$t"/bar2.o
+ar rcs "$t"/root/usr/lib/libbaz.a "$t"/baz.o
+ar rcs "$t"/root/usr/lib2/libqux.a "$t"/qux.o
+
+# libbar.a and libbaz.a refer to each other, so a traditional linker
+# would need them in a group.
+./rvld -static --warn-backrefs "$t"/a.o "$t"/root/usr/lib/libbar.a \
+  "$t"/root/usr/lib/libbaz.a "$t"/root/usr/lib2/libqux.a -o "$t"/out 2> "$t"/log
+grep -q 'backward reference detected: bar2' "$t"/log
+
+# A stub like glibc's libc.so, whose paths are relative to the sysroot.
+cat <<EOF > "$t"/root/usr/lib/libfoo.a
+/* GNU ld script */
+OUTPUT_FORMAT(elf64-littleriscv)
+GROUP ( /usr/lib/libbar.a AS_NEEDED ( =/usr/lib/libbaz.a ) )
+EOF
+
+cat <<EOF > "$t"/stub.txt
+SEARCH_DIR("=/usr/lib2")
+INPUT(-lqux)
+EOF
+
+./rvld -static --warn-backrefs --sysroot="$t"/root -L"$t"/root/usr/lib \
+  "$t"/a.o -lfoo "$t"/stub.txt -o "$t"/out 2> "$t"/log
+[ ! -s "$t"/log ]
+
+readelf -sW "$t"/out > "$t"/log
+for sym in bar bar2 baz qux; do
+  grep -q " $sym$" "$t"/log
+done
@@ -0,0 +1,48 @@
+#!/bin/bash
+
+set -e
+
+test_name=$(basename "$0" .sh)
+t=out/tests/$test_name
+
+mkdir -p "$t"
+
+cat <<EOF | $CC -o "$t"/a.o -c -xassembler -
+  .globl _start
+_start:
+  lui a0, %hi(c1)
+  ld a0, %lo(c1)(a0)
+  lui a1, %hi(r1)
+  lw a1, %lo(r1)(a1)
+  lui a2, %hi(d1)
+  lw a2, %lo(d1)(a2)
+  ret
+
+  .section .srodata.cst8,"aM",@progbits,8
+c1:
+  .dword 0x4000000000000000
+
+  .section .srodata,"a",@progbits
+r1:
+  .word 7
+
+  .section .sdata,"aw",@progbits
+d1:
+  .word 9
+EOF
+
+./rvld -static "$t"/a.o -o "$t"/out
+
+# Small read-only data is folded into .sdata, so that all of it is
+# addressed relative to gp.
+readelf -SW "$t"/out > "$t"/log
+grep -q '\.srodata' "$t"/log && exit 1
+grep -Eq '\.sdata +PROGBITS .* WA ' "$t"/log
+
+$OBJDUMP -d -M no-aliases "$t"/out > "$t"/log
+grep -Eq 'ld\s+a0, ?-?[0-9]+\(gp\)' "$t"/log
+grep -Eq 'lw\s+a1, ?-?[0-9]+\(gp\)' "$t"/log
+grep -Eq 'lw\s+a2, ?-?[0-9]+\(gp\)' "$t"/log
+grep -Eq 'lui\s' "$t"/log && exit 1
+
+exit 0
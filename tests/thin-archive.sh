@@ -0,0 +1,42 @@
+#!/bin/bash
+
+set -e
+
+test_name=$(basename "$0" .sh)
+t=out/tests/$test_name
+
+rm -rf "$t"
+mkdir -p "$t"/obj "$t"/lib
+
+cat <<EOF | $CC -o "$t"/obj/a.o -c -xassembler -
+  .globl _start
+_start:
+  call foo
+  ret
+EOF
+
+cat <<EOF | $CC -o "$t"/obj/foo.o -c -xassembler -
+  .globl foo
+foo:
+  ret
+EOF
+
+cat <<EOF | $CC -o "$t"/obj/bad.o -c -xassembler -
+  .globl bad
+bad:
+  call missing
+  ret
+EOF
+
+# The members of a thin archive are found relative to the archive.
+(cd "$t"/lib && ar rcT libthin.a ../obj/foo.o ../obj/bad.o)
+head -c 8 "$t"/lib/libthin.a | grep -q '!<thin>'
+
+./rvld -static "$t"/obj/a.o "$t"/lib/libthin.a -o "$t"/out
+readelf -sW "$t"/out | grep -q ' foo$'
+readelf -sW "$t"/out | grep -q ' bad$' && exit 1
+
+# Diagnostics name the member along with the archive.
+./rvld -static "$t"/obj/a.o --whole-archive "$t"/lib/libthin.a -o "$t"/out \
+  2> "$t"/log && exit 1
+grep -q 'referenced by .*libthin\.a(.*bad\.o):(.text+0x0)' "$t"/log
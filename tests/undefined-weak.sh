@@ -0,0 +1,35 @@
+#!/bin/bash
+
+set -e
+
+test_name=$(basename "$0" .sh)
+t=out/tests/$test_name
+
+mkdir -p "$t"
+
+cat <<EOF | $CC -o "$t"/a.o -c -xassembler -
+  .globl _start
+  .weak zz
+_start:
+  call zz
+  ret
+EOF
+
+cat <<EOF | $CC -o "$t"/b.o -c -xassembler -
+  .globl f
+f:
+  call zz
+  ret
+EOF
+
+# A weak reference alone resolves to zero.
+./rvld -static "$t"/a.o -o "$t"/out
+
+# A strong reference is reported even if there is also a weak one,
+# regardless of the order of the files.
+./rvld -static "$t"/a.o "$t"/b.o -o "$t"/out 2> "$t"/log1 && exit 1
+grep -q 'undefined symbol: zz' "$t"/log1
+grep -q 'referenced by .*b.o:(.text+0x0)' "$t"/log1
+
+./rvld -static "$t"/b.o "$t"/a.o -o "$t"/out 2> "$t"/log2 && exit 1
+grep -q 'undefined symbol: zz' "$t"/log2